@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/internal/coredump"
+	"github.com/bigbag/papyrix-flasher/internal/detect"
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/partition"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/symbols"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+var coreFlag string
+
+func newCoreDumpCmd() *cobra.Command {
+	coreDumpCmd := &cobra.Command{
+		Use:   "coredump",
+		Short: "Read and decode the core dump of the last crash",
+		Long: `Read the core dump the firmware saved to the coredump partition when it
+crashed, and print the crashed task, its registers and backtrace.
+
+With --elf, addresses are decoded to functions and source lines. With
+--core, the dump is also written as an ELF core file for GDB:
+
+  riscv32-esp-elf-gdb firmware.elf core.elf`,
+		Args: cobra.NoArgs,
+		RunE: runCoreDump,
+	}
+	coreDumpCmd.Flags().StringVarP(&portFlag, "port", "p", "", portHelp)
+	coreDumpCmd.Flags().IntVarP(&baudFlag, "baud", "b", protocol.DefaultBaudRate, "Baud rate")
+	addResetFlags(coreDumpCmd)
+	coreDumpCmd.Flags().StringVar(&elfFlag, "elf", "", "Firmware ELF file to decode addresses with")
+	coreDumpCmd.Flags().StringVar(&coreFlag, "core", "", "Write the dump as an ELF core file for GDB")
+	return coreDumpCmd
+}
+
+// coreDumpResult is the JSON result of the coredump command.
+type coreDumpResult struct {
+	OK        bool       `json:"ok"`
+	Port      string     `json:"port"`
+	Found     bool       `json:"found"`
+	Offset    uint32     `json:"offset,omitempty"`
+	Size      int        `json:"size,omitempty"`
+	AppSHA256 string     `json:"app_elf_sha256,omitempty"`
+	Cause     string     `json:"cause,omitempty"`
+	Tasks     []coreTask `json:"tasks,omitempty"`
+	Core      string     `json:"core,omitempty"`
+}
+
+type coreTask struct {
+	TCB       uint32            `json:"tcb"`
+	Name      string            `json:"name"`
+	Crashed   bool              `json:"crashed"`
+	Registers map[string]uint32 `json:"registers"`
+	Backtrace []coreFrame       `json:"backtrace"`
+}
+
+type coreFrame struct {
+	Address  uint32 `json:"address"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+func runCoreDump(cmd *cobra.Command, args []string) error {
+	var syms *symbols.Table
+	if elfFlag != "" {
+		var err error
+		if syms, err = symbols.Open(elfFlag); err != nil {
+			return withType(errTypeIO, fmt.Errorf("failed to load symbols: %w", err))
+		}
+	}
+
+	portName := portFlag
+	if portName == "" {
+		fmt.Fprintln(console, "Detecting device...")
+		result, err := detect.DetectDevice(baudFlag)
+		if err != nil {
+			return withType(errTypeNoDevice, fmt.Errorf("device detection failed: %w", err))
+		}
+		portName = result.Port
+		fmt.Fprintf(console, "Found %s on %s\n", result.ChipName, result.Port)
+	}
+
+	port, err := transport.Open(portName, baudFlag)
+	if err != nil {
+		return withType(errTypePort, fmt.Errorf("failed to open port: %w", err))
+	}
+	defer port.Close()
+
+	f := flasher.New(port)
+	f.SetLogger(newLogger(console))
+	if !machineOutput() {
+		f.SetProgress(newProgressPrinter(console).update)
+	}
+	if err := setReset(f, console); err != nil {
+		return err
+	}
+	fmt.Fprintln(console, "Connecting to bootloader...")
+	if err := f.Connect(); err != nil {
+		return withType(errTypeConnect, err)
+	}
+
+	entry, data, err := readCoreDump(f)
+	leave(f, console)
+	result := coreDumpResult{OK: true, Port: portName}
+	if errors.Is(err, coredump.ErrEmpty) {
+		fmt.Fprintln(console, "No core dump: the device has not crashed since the partition was erased")
+		emitResult(result)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dump, err := coredump.Parse(data)
+	if err != nil {
+		return withType(errTypeChecksum, err)
+	}
+	result.Found, result.Offset, result.Size = true, entry.Offset, len(data)
+	result.AppSHA256, result.Cause = dump.AppSHA256, dump.Cause()
+
+	if coreFlag != "" {
+		if err := os.WriteFile(coreFlag, dump.Core, 0o644); err != nil {
+			return withType(errTypeIO, fmt.Errorf("failed to write core file: %w", err))
+		}
+		result.Core = coreFlag
+	}
+
+	fmt.Fprintf(console, "\nCore dump: %d bytes at 0x%X, %s rev %d, %s OK\n",
+		len(data), entry.Offset, protocol.ChipName(dump.ChipID), dump.ChipRev, dump.Checksum)
+	if dump.AppSHA256 != "" {
+		fmt.Fprintf(console, "Firmware ELF SHA256: %s\n", dump.AppSHA256)
+		if elfFlag != "" && !elfMatches(elfFlag, dump.AppSHA256) {
+			fmt.Fprintf(console, "Warning: %s is not the firmware that crashed; decoded lines may be wrong\n", elfFlag)
+		}
+	}
+
+	var code coredump.Code
+	if syms != nil {
+		code = syms
+	}
+	for _, task := range dump.Tasks {
+		frames := dump.Backtrace(task, code)
+		result.Tasks = append(result.Tasks, newCoreTask(task, frames, syms))
+		if task.Crashed {
+			printCrashedTask(console, dump, task, frames, syms)
+		}
+	}
+	printOtherTasks(console, dump.Tasks, syms)
+
+	if coreFlag != "" {
+		fmt.Fprintf(console, "\nWrote ELF core to %s; load it with: riscv32-esp-elf-gdb <firmware.elf> %s\n", coreFlag, coreFlag)
+	}
+	emitResult(result)
+	return nil
+}
+
+// readCoreDump finds the coredump partition in the device's partition
+// table and reads the dump it holds.
+func readCoreDump(f *flasher.Flasher) (*partition.Entry, []byte, error) {
+	raw, err := f.ReadFlash(protocol.PartitionsAddress, partition.TableSize)
+	if err != nil {
+		return nil, nil, withType(errTypeFlash, fmt.Errorf("failed to read partition table: %w", err))
+	}
+	table, err := partition.Parse(raw)
+	if err != nil {
+		return nil, nil, withType(errTypeChecksum, fmt.Errorf("failed to read partition table: %w", err))
+	}
+	entry, ok := table.Find(partition.TypeData, partition.SubTypeCoreDump)
+	if !ok {
+		return nil, nil, fmt.Errorf("the partition table has no coredump partition")
+	}
+
+	header, err := f.ReadFlash(entry.Offset, coredump.HeaderSize)
+	if err != nil {
+		return nil, nil, withType(errTypeFlash, fmt.Errorf("failed to read core dump: %w", err))
+	}
+	size, err := coredump.Length(header)
+	if err != nil {
+		return entry, nil, err
+	}
+	if size > entry.Size {
+		return nil, nil, withType(errTypeChecksum, fmt.Errorf("core dump header claims %d bytes, the partition holds %d", size, entry.Size))
+	}
+
+	fmt.Fprintf(console, "Reading core dump from partition %q at 0x%X...\n", entry.Label, entry.Offset)
+	data, err := f.ReadFlash(entry.Offset, size)
+	if err != nil {
+		return nil, nil, withType(errTypeFlash, fmt.Errorf("failed to read core dump: %w", err))
+	}
+	return entry, data, nil
+}
+
+// elfMatches reports whether the ELF file at path has the SHA256 the
+// firmware recorded, which may be shortened.
+func elfMatches(path, appSHA256 string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	return strings.HasPrefix(hex.EncodeToString(sum[:]), strings.ToLower(appSHA256))
+}
+
+func newCoreTask(task coredump.Task, frames []uint32, syms *symbols.Table) coreTask {
+	t := coreTask{TCB: task.TCB, Name: task.Name, Crashed: task.Crashed, Registers: map[string]uint32{}}
+	for i, name := range coredump.RegisterNames {
+		t.Registers[name] = task.Regs[i]
+	}
+	for _, addr := range frames {
+		frame := coreFrame{Address: addr}
+		if syms != nil {
+			if loc, ok := syms.Lookup(uint64(addr)); ok {
+				frame.Function, frame.File, frame.Line = loc.Function, loc.File, loc.Line
+			}
+		}
+		t.Backtrace = append(t.Backtrace, frame)
+	}
+	return t
+}
+
+// describe returns the source of addr, or "" without symbols.
+func describe(syms *symbols.Table, addr uint32) string {
+	if syms == nil {
+		return ""
+	}
+	if loc, ok := syms.Lookup(uint64(addr)); ok {
+		return loc.String()
+	}
+	return ""
+}
+
+func printCrashedTask(w io.Writer, dump *coredump.Dump, task coredump.Task, frames []uint32, syms *symbols.Table) {
+	name := task.Name
+	if name == "" {
+		name = "(unknown)"
+	}
+	fmt.Fprintf(w, "\nCrashed task: %s (TCB 0x%08X)\n", name, task.TCB)
+	if cause := dump.Cause(); cause != "" {
+		fmt.Fprintf(w, "Exception: %s\n", cause)
+	}
+
+	fmt.Fprintln(w, "\nRegisters:")
+	for i, name := range coredump.RegisterNames {
+		fmt.Fprintf(w, "%-8s: 0x%08x", name, task.Regs[i])
+		if i%4 == 3 {
+			fmt.Fprintln(w)
+		} else {
+			fmt.Fprint(w, "  ")
+		}
+	}
+	for i, r := range dump.Exception {
+		fmt.Fprintf(w, "%-8s: 0x%08x", r.Name, r.Value)
+		if i%4 == 3 || i == len(dump.Exception)-1 {
+			fmt.Fprintln(w)
+		} else {
+			fmt.Fprint(w, "  ")
+		}
+	}
+
+	fmt.Fprintln(w, "\nBacktrace:")
+	if syms == nil {
+		fmt.Fprintln(w, "  (only PC and RA; use --elf to search the stack and decode addresses)")
+	}
+	for i, addr := range frames {
+		fmt.Fprintf(w, "  #%-2d 0x%08x  %s\n", i, addr, describe(syms, addr))
+	}
+}
+
+func printOtherTasks(w io.Writer, tasks []coredump.Task, syms *symbols.Table) {
+	if len(tasks) < 2 {
+		return
+	}
+	fmt.Fprintln(w, "\nOther tasks:")
+	for _, task := range tasks[1:] {
+		fmt.Fprintf(w, "  %-16s TCB 0x%08X  PC 0x%08x  %s\n", task.Name, task.TCB, task.PC(), describe(syms, task.PC()))
+	}
+}
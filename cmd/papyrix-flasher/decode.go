@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/trace"
+)
+
+func newDecodeTraceCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "decode-trace <file>",
+		Short: "Print the bootloader conversation in a recorded session",
+		Long: `Decode a session recorded with --record, or a raw capture of the serial
+line from a logic analyzer or sniffer, into a readable conversation: every
+request by command name with its decoded fields, and every response with
+its status. Requests whose checksum the ROM would reject are flagged.
+
+Raw captures have no timing or direction; the direction of each frame is
+taken from its first byte.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runDecodeTrace,
+	}
+}
+
+// decodedFrame is one line of the decoded conversation.
+type decodedFrame struct {
+	TimeMS   *float64 `json:"time_ms,omitempty"`
+	Dir      string   `json:"direction"` // request or response
+	Command  string   `json:"command,omitempty"`
+	Fields   string   `json:"fields,omitempty"`
+	Status   string   `json:"status,omitempty"` // ok or failed, for responses
+	Error    string   `json:"error,omitempty"`
+	Checksum *bool    `json:"checksum_ok,omitempty"`
+	Skipped  string   `json:"skipped,omitempty"`
+}
+
+func runDecodeTrace(cmd *cobra.Command, args []string) error {
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	var frames []trace.Frame
+	timed := bytes.HasPrefix(data, []byte(trace.Header))
+	if timed {
+		events, err := trace.Parse(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse trace: %w", err)
+		}
+		frames = trace.Frames(events)
+	} else {
+		frames = trace.RawFrames(data)
+	}
+
+	decoded := make([]decodedFrame, 0, len(frames))
+	var mismatches, failures int
+	for i, frame := range frames {
+		d := decodeFrame(frame)
+		if timed {
+			ms := float64(frame.Time.Microseconds()) / 1000
+			d.TimeMS = &ms
+		}
+		if d.Checksum != nil && !*d.Checksum {
+			mismatches++
+		}
+		if d.Status == "failed" {
+			failures++
+		}
+		decoded = append(decoded, d)
+		printFrame(i, d)
+	}
+
+	fmt.Fprintf(console, "\n%d frames, %d failed responses, %d checksum mismatches\n", len(frames), failures, mismatches)
+
+	emitResult(struct {
+		OK                 bool           `json:"ok"`
+		Frames             []decodedFrame `json:"frames"`
+		Failures           int            `json:"failures"`
+		ChecksumMismatches int            `json:"checksum_mismatches"`
+	}{true, decoded, failures, mismatches})
+	return nil
+}
+
+// decodeFrame decodes a request or response packet.
+func decodeFrame(frame trace.Frame) decodedFrame {
+	var d decodedFrame
+	if len(frame.Skipped) > 0 {
+		d.Skipped = string(frame.Skipped)
+	}
+
+	if frame.Dir == trace.Write {
+		d.Dir = "request"
+		req, err := protocol.DecodeRequest(frame.Data)
+		if err != nil {
+			d.Error = err.Error()
+			return d
+		}
+		d.Command = protocol.CommandName(req.Command)
+		d.Fields = req.Fields()
+		if protocol.IsDataCommand(req.Command) {
+			ok := req.ChecksumValid()
+			d.Checksum = &ok
+			if !ok {
+				d.Error = fmt.Sprintf("checksum 0x%02X, expected 0x%02X", req.Checksum, req.ExpectedChecksum())
+			}
+		}
+		return d
+	}
+
+	d.Dir = "response"
+	resp, err := protocol.DecodeResponse(frame.Data)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Command = protocol.CommandName(resp.Command)
+	if resp.IsSuccess() {
+		d.Status = "ok"
+		d.Fields = resp.Fields()
+	} else {
+		d.Status = "failed"
+		d.Error = resp.ErrorString()
+	}
+	return d
+}
+
+// printFrame prints one frame of the conversation, e.g.
+//
+//	1.234  >  FLASH_DEFL_DATA     size=1024 seq=3 data=1024
+func printFrame(i int, d decodedFrame) {
+	if d.Skipped != "" {
+		skipped := d.Skipped
+		if len(skipped) > 60 {
+			skipped = skipped[:60] + "..."
+		}
+		fmt.Fprintf(console, "%10s     (%d bytes outside frames: %s)\n", "", len(d.Skipped), strconv.Quote(skipped))
+	}
+
+	at := fmt.Sprintf("#%d", i+1)
+	if d.TimeMS != nil {
+		at = fmt.Sprintf("%.3f", *d.TimeMS/1000)
+	}
+	arrow := ">"
+	if d.Dir == "response" {
+		arrow = "<"
+	}
+
+	line := fmt.Sprintf("%10s  %s  %-18s", at, arrow, d.Command)
+	if d.Status != "" {
+		line += " " + strings.ToUpper(d.Status)
+	}
+	if d.Fields != "" {
+		line += " " + d.Fields
+	}
+	switch {
+	case d.Checksum != nil && !*d.Checksum:
+		line += "  !! CHECKSUM MISMATCH: " + d.Error
+	case d.Command == "":
+		line += "invalid frame: " + d.Error
+	case d.Error != "":
+		line += " " + d.Error
+	}
+	fmt.Fprintln(console, strings.TrimRight(line, " "))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/internal/image"
+)
+
+var (
+	elfOutputFlag string
+	elfSettings   image.FlashSettings
+)
+
+func newELF2ImageCmd() *cobra.Command {
+	elf2ImageCmd := &cobra.Command{
+		Use:   "elf2image <app.elf>",
+		Short: "Convert a firmware ELF file to a flashable image",
+		Long: `Convert an ESP32-C3 application ELF file to the image the bootloader loads
+from the firmware partition, as esptool's elf2image does. The flash
+command does this itself when given an .elf file.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runELF2Image,
+	}
+	elf2ImageCmd.Flags().StringVarP(&elfOutputFlag, "out", "o", "", "Output image file")
+	elf2ImageCmd.Flags().StringVar(&elfSettings.Mode, "flash-mode", "dio", "Flash mode: qio, qout, dio or dout")
+	elf2ImageCmd.Flags().StringVar(&elfSettings.Freq, "flash-freq", "80m", "Flash frequency: 80m, 40m, 26m or 20m")
+	elf2ImageCmd.Flags().StringVar(&elfSettings.Size, "flash-size", "16MB", "Flash size")
+	elf2ImageCmd.MarkFlagRequired("out")
+	return elf2ImageCmd
+}
+
+func runELF2Image(cmd *cobra.Command, args []string) error {
+	elfPath := args[0]
+	data, err := os.ReadFile(elfPath)
+	if err != nil {
+		return withType(errTypeIO, fmt.Errorf("failed to read ELF file: %w", err))
+	}
+
+	img, err := convertELF(elfPath, data, elfSettings)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(elfOutputFlag, img, 0o644); err != nil {
+		return withType(errTypeIO, fmt.Errorf("failed to write image: %w", err))
+	}
+	fmt.Fprintf(console, "Wrote %s (%d bytes)\n", elfOutputFlag, len(img))
+
+	emitResult(struct {
+		OK     bool   `json:"ok"`
+		Output string `json:"output"`
+		Size   int    `json:"size"`
+	}{true, elfOutputFlag, len(img)})
+	return nil
+}
+
+// convertELF converts a firmware ELF file to an image.
+func convertELF(path string, data []byte, settings image.FlashSettings) ([]byte, error) {
+	img, err := image.FromELF(data, settings)
+	if err != nil {
+		return nil, withType(errTypeUsage, fmt.Errorf("failed to convert %s: %w", path, err))
+	}
+	fmt.Fprintf(console, "Converted %s to a %d-byte image with %d segments\n", path, len(img), img[1])
+	return img, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+)
+
+var (
+	emulatePTYFlag       bool
+	emulateFlashFlag     string
+	emulateFlashSizeFlag string
+)
+
+func newEmulateCmd() *cobra.Command {
+	emulateCmd := &cobra.Command{
+		Use:   "emulate --pty",
+		Short: "Emulate an ESP32-C3 in download mode for testing",
+		Long: `Run a software emulator of the ESP32-C3 ROM bootloader on a Linux
+pseudo-terminal. Point the flasher, or any other tool that speaks the ROM
+protocol, at the printed port to test it without hardware.
+
+The flash contents are kept in memory, or in the file given with --flash,
+which is created if needed and written back on exit. A pseudo-terminal has
+no DTR/RTS lines, so the emulated device behaves as if BOOT were held down:
+every reset returns to the bootloader.`,
+		Args: cobra.NoArgs,
+		RunE: runEmulate,
+	}
+	emulateCmd.Flags().BoolVar(&emulatePTYFlag, "pty", false, "Serve on a new pseudo-terminal (Linux only)")
+	emulateCmd.Flags().StringVar(&emulateFlashFlag, "flash", "", "Keep the flash contents in this file")
+	emulateCmd.Flags().StringVar(&emulateFlashSizeFlag, "flash-size", "4MB", "Flash size")
+	return emulateCmd
+}
+
+func runEmulate(cmd *cobra.Command, args []string) error {
+	if !emulatePTYFlag {
+		return usageError(fmt.Errorf("specify where to serve the emulator: --pty"))
+	}
+	size, err := parseSize(emulateFlashSizeFlag)
+	if err != nil {
+		return usageError(fmt.Errorf("invalid flash size: %w", err))
+	}
+
+	var dev *emulator.Device
+	if emulateFlashFlag != "" {
+		dev, err = emulator.Open(emulateFlashFlag, int(size))
+		if err != nil {
+			return withType(errTypeIO, fmt.Errorf("failed to open flash file: %w", err))
+		}
+	} else {
+		dev = emulator.New(int(size))
+	}
+	dev.HoldBoot = true
+
+	pty, err := emulator.OpenPTY()
+	if err != nil {
+		return err
+	}
+	defer pty.Close()
+
+	fmt.Fprintf(console, "Emulating ESP32-C3 on %s\n", pty.Name)
+	if emulateFlashFlag != "" {
+		fmt.Fprintf(console, "Flash: %s (%d bytes)\n", emulateFlashFlag, size)
+	} else {
+		fmt.Fprintf(console, "Flash: in memory (%d bytes)\n", size)
+	}
+	fmt.Fprintln(console, "Press Ctrl+C to stop.")
+	emitEvent(struct {
+		Event string `json:"event"`
+		Port  string `json:"port"`
+	}{"listening", pty.Name})
+
+	served := make(chan error, 1)
+	go func() { served <- dev.Serve(pty.Master) }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+		err = nil
+	case err = <-served:
+		err = fmt.Errorf("emulator stopped: %w", err)
+	}
+
+	if saveErr := dev.Save(); saveErr != nil {
+		return withType(errTypeIO, fmt.Errorf("failed to save flash: %w", saveErr))
+	}
+	if emulateFlashFlag != "" {
+		fmt.Fprintf(console, "Flash saved to %s\n", emulateFlashFlag)
+	}
+	if err != nil {
+		return err
+	}
+
+	emitResult(struct {
+		OK    bool   `json:"ok"`
+		Port  string `json:"port"`
+		Flash string `json:"flash,omitempty"`
+	}{true, pty.Name, emulateFlashFlag})
+	return nil
+}
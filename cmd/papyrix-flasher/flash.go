@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/journal"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/trace"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// flashReport is the result of the flash and update commands.
+type flashReport struct {
+	OK         bool            `json:"ok"`
+	Source     string          `json:"source,omitempty"`
+	Release    *releaseInfo    `json:"release,omitempty"`
+	Devices    []*deviceResult `json:"devices"`
+	DurationMS int64           `json:"duration_ms"`
+	Error      *jsonError      `json:"error,omitempty"`
+}
+
+func (r *flashReport) finish(err error) {
+	r.OK = err == nil
+	r.Error = newJSONError(err)
+	if r.Devices == nil {
+		r.Devices = []*deviceResult{}
+	}
+}
+
+// deviceResult is the outcome of flashing one device.
+type deviceResult struct {
+	Port       string         `json:"port"`
+	Chip       string         `json:"chip,omitempty"`
+	MAC        string         `json:"mac,omitempty"`
+	OK         bool           `json:"ok"`
+	Written    int            `json:"written"`
+	Regions    []regionResult `json:"regions"`
+	After      string         `json:"after,omitempty"` // the --after action taken
+	DurationMS int64          `json:"duration_ms"`
+	Error      *jsonError     `json:"error,omitempty"`
+
+	Duration time.Duration `json:"-"`
+	Err      error         `json:"-"`
+}
+
+// regionResult is the outcome of writing one region.
+type regionResult struct {
+	Name       string `json:"name"`
+	Address    uint32 `json:"address"`
+	Size       int    `json:"size"`
+	Status     string `json:"status"` // written, skipped or failed
+	Written    int    `json:"written"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// started reports whether the device was left running its application.
+func (r *deviceResult) started() bool {
+	return r.After != "" && r.After != flasher.AfterStayInBootloader
+}
+
+// skipped returns the names of the regions that were already up to date.
+func (r *deviceResult) skipped() []string {
+	var names []string
+	for _, region := range r.Regions {
+		if region.Status == "skipped" {
+			names = append(names, region.Name)
+		}
+	}
+	return names
+}
+
+// NDJSON events
+type (
+	detectedEvent struct {
+		Event string `json:"event"`
+		Port  string `json:"port"`
+		Chip  string `json:"chip"`
+	}
+	connectedEvent struct {
+		Event string `json:"event"`
+		Port  string `json:"port"`
+		Chip  string `json:"chip"`
+		MAC   string `json:"mac,omitempty"`
+	}
+	regionEvent struct {
+		Event string `json:"event"`
+		Port  string `json:"port"`
+		regionResult
+	}
+	progressEvent struct {
+		Event   string  `json:"event"`
+		Port    string  `json:"port"`
+		Stage   string  `json:"stage"`
+		Address uint32  `json:"address"`
+		Done    int     `json:"done"`
+		Total   int     `json:"total"`
+		Block   int     `json:"block,omitempty"`
+		Blocks  int     `json:"blocks,omitempty"`
+		Rate    float64 `json:"bytes_per_second"`
+		ETAMS   int64   `json:"eta_ms"`
+	}
+)
+
+// progressEvents returns a progress callback that emits NDJSON events,
+// at most a few per second per stage.
+func progressEvents(portName string) flasher.ProgressFunc {
+	var last time.Time
+	return func(p flasher.Progress) {
+		if p.Done > 0 && !p.Finished() && time.Since(last) < 250*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		emitEvent(progressEvent{
+			Event:   "progress",
+			Port:    portName,
+			Stage:   strings.ToLower(p.Stage.String()),
+			Address: p.Address,
+			Done:    p.Done,
+			Total:   p.Total,
+			Block:   p.Block,
+			Blocks:  p.Blocks,
+			Rate:    p.Rate,
+			ETAMS:   p.ETA.Milliseconds(),
+		})
+	}
+}
+
+// flashDevice connects to the device on portName and writes the plan,
+// reporting progress to out.
+func flashDevice(portName string, plan *flashPlan, out io.Writer) (result *deviceResult, err error) {
+	started := time.Now()
+	result = &deviceResult{Port: portName, Regions: []regionResult{}}
+	defer func() {
+		result.Duration = time.Since(started)
+		result.DurationMS = result.Duration.Milliseconds()
+		result.Err = err
+		result.OK = err == nil
+		result.Error = newJSONError(err)
+	}()
+
+	// Open port
+	port, err := transport.Open(portName, baudFlag)
+	if err != nil {
+		return result, withType(errTypePort, fmt.Errorf("failed to open port: %w", err))
+	}
+
+	// Record the session for bug reports
+	if recordFlag != "" {
+		recorder, err := trace.Create(recordFlag, port)
+		if err != nil {
+			port.Close()
+			return result, withType(errTypeIO, fmt.Errorf("failed to create trace: %w", err))
+		}
+		port = recorder
+	}
+	defer func() {
+		if err := port.Close(); err != nil {
+			fmt.Fprintf(out, "Warning: failed to close port: %v\n", err)
+		} else if recordFlag != "" {
+			fmt.Fprintf(out, "Recorded session to %s\n", recordFlag)
+		}
+	}()
+
+	fmt.Fprintf(out, "Port: %s @ %d baud\n", portName, baudFlag)
+
+	// Create flasher
+	f := flasher.New(port)
+	f.SetLogger(newLogger(out))
+	if outputFlag == outputNDJSON {
+		f.SetProgress(progressEvents(portName))
+	} else {
+		f.SetProgress(newProgressPrinter(out).update)
+	}
+	if plan.flashSize != 0 {
+		f.SetFlashSize(plan.flashSize)
+	}
+	if err := setReset(f, out); err != nil {
+		return result, err
+	}
+
+	// Connect to bootloader
+	fmt.Fprintln(out, "Connecting to bootloader...")
+	if err := f.Connect(); err != nil {
+		return result, withType(errTypeConnect, err)
+	}
+	fmt.Fprintln(out, "Connected!")
+
+	chipID, err := f.ChipID()
+	if err != nil {
+		return result, withType(errTypeConnect, fmt.Errorf("failed to read chip ID: %w", err))
+	}
+	result.Chip = protocol.ChipName(chipID)
+
+	// Pick the build for this chip when the bundle has several
+	if plan.bundle != nil {
+		devicePlan := *plan
+		if err := devicePlan.resolve(result.Chip); err != nil {
+			return result, err
+		}
+		plan = &devicePlan
+		fmt.Fprintf(out, "Using %s build\n", result.Chip)
+	}
+
+	// Identify the device so interrupted writes can be resumed
+	result.MAC, err = f.MAC()
+	if err != nil && resumeFlag {
+		fmt.Fprintf(out, "Warning: could not read MAC address, resume disabled: %v\n", err)
+	}
+	emitEvent(connectedEvent{Event: "connected", Port: portName, Chip: result.Chip, MAC: result.MAC})
+
+	// Flash each region using compressed transfer, skipping regions the
+	// device already holds
+	var delta flasher.DeltaResult
+	for _, region := range plan.regions {
+		regionStarted := time.Now()
+		r := regionResult{Name: region.Name, Address: region.Address, Size: len(region.Data), Status: "written"}
+
+		written, err := flashRegion(f, region, result.MAC, out, &delta)
+		switch {
+		case err != nil:
+			r.Status = "failed"
+		case written < 0:
+			r.Status = "skipped"
+		default:
+			r.Written = written
+		}
+		r.DurationMS = time.Since(regionStarted).Milliseconds()
+		result.Regions = append(result.Regions, r)
+		result.Written += r.Written
+		emitEvent(regionEvent{Event: "region", Port: portName, regionResult: r})
+
+		if err != nil {
+			return result, withType(errTypeFlash, err)
+		}
+	}
+
+	fmt.Fprintln(out, "\nFlash complete!")
+	if skipped := result.skipped(); len(skipped) > 0 {
+		fmt.Fprintf(out, "Skipped unchanged: %s (use --force-write to rewrite)\n", strings.Join(skipped, ", "))
+	}
+	if delta.Total > 0 {
+		fmt.Fprintf(out, "Delta flashing saved %d of %d bytes (%.0f%%)\n",
+			delta.Saved(), delta.Total, 100*float64(delta.Saved())/float64(delta.Total))
+	}
+
+	result.After = leave(f, out)
+
+	fmt.Fprintln(out, "Done!")
+	return result, nil
+}
+
+// flashRegion writes one region and returns the number of bytes written,
+// or -1 if the device already held the region.
+func flashRegion(f *flasher.Flasher, region flasher.FlashRegion, device string, out io.Writer, delta *flasher.DeltaResult) (int, error) {
+	if !forceWriteFlag {
+		match, err := f.RegionMatches(region)
+		if err != nil {
+			fmt.Fprintf(out, "Warning: could not compare %s with flash: %v\n", region.Name, err)
+		} else if match {
+			fmt.Fprintf(out, "Skipping %s at 0x%X (already up to date)\n", region.Name, region.Address)
+			return -1, nil
+		}
+	}
+
+	fmt.Fprintf(out, "Flashing %s at 0x%X (%d bytes)...\n", region.Name, region.Address, len(region.Data))
+	if deltaFlag && !forceWriteFlag {
+		d, err := f.FlashImageDelta(region.Data, region.Address)
+		if err != nil {
+			return d.Written, err
+		}
+		fmt.Fprintf(out, "  %d of %d bytes changed in %d run(s)\n", d.Written, d.Total, d.Runs)
+		delta.Total += d.Total
+		delta.Written += d.Written
+		return d.Written, nil
+	}
+
+	if err := writeRegion(f, region, device, out); err != nil {
+		return 0, err
+	}
+	return len(region.Data), nil
+}
+
+// writeRegion flashes a region. With --resume, large regions are written
+// in segments and their progress is kept in a journal, so that running
+// again with --resume picks up after an interrupted transfer. Each segment
+// costs a FLASH_DEFL_BEGIN, a deflate stream of its own and an MD5 check,
+// so other flashes write a region in one go.
+func writeRegion(f *flasher.Flasher, region flasher.FlashRegion, device string, out io.Writer) error {
+	if !resumeFlag || device == "" || len(region.Data) <= flasher.SegmentSize {
+		return f.FlashImageCompressed(region.Data, region.Address, false)
+	}
+
+	dir, err := journal.DefaultDir()
+	if err != nil {
+		return f.FlashImageCompressed(region.Data, region.Address, false)
+	}
+	j, err := journal.Open(dir, device, region.Address, region.Data)
+	if err != nil {
+		return err
+	}
+
+	from, err := f.ResumePoint(region.Data, region.Address, j.Verified)
+	if err != nil {
+		return fmt.Errorf("failed to check written data: %w", err)
+	}
+	if from > 0 {
+		fmt.Fprintf(out, "  Resuming at 0x%X (%d of %d bytes already written)\n", region.Address+uint32(from), from, len(region.Data))
+	}
+
+	err = f.FlashImageSegmented(region.Data, region.Address, from, func(n int) {
+		if err := j.Record(n); err != nil {
+			fmt.Fprintf(out, "Warning: failed to update journal: %v\n", err)
+		}
+	})
+	if err != nil {
+		if j.Verified > 0 {
+			fmt.Fprintf(out, "%d bytes of %s verified; run again with --resume to continue\n", j.Verified, region.Name)
+		}
+		return err
+	}
+	return j.Remove()
+}
+
+// flashSource describes what the flash command writes, for reports.
+func flashSource(args []string) string {
+	if buildDirFlag != "" {
+		return buildDirFlag
+	}
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/trace"
+)
+
+// countRequests returns how many requests of each command a trace holds.
+func countRequests(t *testing.T, tr *bytes.Buffer) map[byte]int {
+	t.Helper()
+	events, err := trace.Parse(tr)
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	counts := map[byte]int{}
+	for _, frame := range trace.Frames(events) {
+		if frame.Dir != trace.Write {
+			continue
+		}
+		if req, err := protocol.DecodeRequest(frame.Data); err == nil {
+			counts[req.Command]++
+		}
+	}
+	return counts
+}
+
+func TestWriteRegion(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	journalDir := filepath.Join(cache, "papyrix-flasher", "journal")
+
+	data := make([]byte, 3*flasher.SegmentSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	region := flasher.FlashRegion{Name: "firmware", Address: 0x10000, Data: data}
+
+	tests := []struct {
+		name    string
+		resume  bool
+		begins  int
+		md5s    int
+		journal bool // the journal directory is created
+	}{
+		{"plain", false, 1, 0, false},
+		{"resume", true, 2, 3, true}, // the resume check, then each segment
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resumeFlag = tt.resume
+			defer func() { resumeFlag = false }()
+
+			dev := emulator.New(0x100000)
+			var tr bytes.Buffer
+			rec := trace.NewRecorder(emulator.NewPort(dev), &tr)
+			f := flasher.New(rec)
+			if err := f.Connect(); err != nil {
+				t.Fatalf("Connect() error: %v", err)
+			}
+			tr.Reset()
+
+			if err := writeRegion(f, region, "aa:bb:cc:dd:ee:ff", io.Discard); err != nil {
+				t.Fatalf("writeRegion() error: %v", err)
+			}
+			rec.Close()
+
+			if !bytes.Equal(dev.Flash()[0x10000:0x10000+len(data)], data) {
+				t.Error("flash does not hold the region")
+			}
+			counts := countRequests(t, &tr)
+			if counts[protocol.CmdFlashDeflBegin] != tt.begins || counts[protocol.CmdSpiFlashMD5] != tt.md5s {
+				t.Errorf("sent %d FLASH_DEFL_BEGIN and %d SPI_FLASH_MD5, want %d and %d",
+					counts[protocol.CmdFlashDeflBegin], counts[protocol.CmdSpiFlashMD5], tt.begins, tt.md5s)
+			}
+			if _, err := os.Stat(journalDir); (err == nil) != tt.journal {
+				t.Errorf("journal directory exists = %v, want %v", err == nil, tt.journal)
+			}
+		})
+	}
+}
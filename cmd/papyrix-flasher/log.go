@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+)
+
+var (
+	verboseFlag int
+	quietFlag   bool
+)
+
+// logLevel returns the level selected by -v, -vv and --quiet.
+func logLevel() slog.Level {
+	switch {
+	case quietFlag:
+		return slog.LevelError
+	case verboseFlag >= 2:
+		return flasher.LevelTrace
+	case verboseFlag == 1:
+		return slog.LevelDebug
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// newLogger returns a logger that writes human-readable lines to w.
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(&consoleHandler{w: w, level: logLevel(), mu: &sync.Mutex{}})
+}
+
+// consoleHandler formats log records for a terminal as the message and its
+// attributes. Warnings and errors get a prefix; debug and trace records
+// get a timestamp and a level tag.
+type consoleHandler struct {
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	case r.Level >= slog.LevelInfo:
+	case r.Level >= slog.LevelDebug:
+		fmt.Fprintf(&b, "%s DEBUG ", r.Time.Format("15:04:05.000"))
+	default:
+		fmt.Fprintf(&b, "%s TRACE ", r.Time.Format("15:04:05.000"))
+	}
+	b.WriteString(r.Message)
+
+	writeAttr := func(a slog.Attr) bool {
+		if a.Key == "err" && r.Level >= slog.LevelWarn {
+			fmt.Fprintf(&b, ": %v", a.Value.Any())
+			return true
+		}
+		value := a.Value.Resolve()
+		if d, ok := value.Any().(time.Duration); ok {
+			fmt.Fprintf(&b, " %s=%s", a.Key, d)
+		} else {
+			fmt.Fprintf(&b, " %s=%v", a.Key, value.Any())
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
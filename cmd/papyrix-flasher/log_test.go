@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+func TestConsoleHandler(t *testing.T) {
+	var out bytes.Buffer
+	log := slog.New(&consoleHandler{w: &out, level: slog.LevelInfo, mu: &sync.Mutex{}})
+
+	log.Info("compressed", "size", 1000, "compressed", 573, "ratio", 1.7)
+	log.Warn("flash end failed", "err", errors.New("timeout"))
+	log.Debug("hidden")
+
+	want := "compressed size=1000 compressed=573 ratio=1.7\nWarning: flash end failed: timeout\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
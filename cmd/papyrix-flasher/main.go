@@ -3,38 +3,74 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"github.com/bigbag/papyrix-flasher/embedded"
 	"github.com/bigbag/papyrix-flasher/internal/detect"
-	"github.com/bigbag/papyrix-flasher/internal/flasher"
 	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	_ "github.com/bigbag/papyrix-flasher/internal/remote" // rfc2217:// and socket:// ports
 	"github.com/bigbag/papyrix-flasher/internal/serial"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
 )
 
 var (
 	portFlag         string
 	baudFlag         int
 	firmwareOnlyFlag bool
+	mergedFlag       bool
+	buildDirFlag     string
+	forceWriteFlag   bool
+	deltaFlag        bool
+	resumeFlag       bool
+	allFlag          bool
+	portsFlag        []string
+	recordFlag       string
 )
 
+// portHelp describes --port, listing the URL schemes of other transports.
+var portHelp = "Serial port, or a URL: " + strings.Join(transport.Schemes(), "://, ") + "://; auto-detect if not specified"
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "papyrix-flasher",
 		Short: "Flash firmware to Xteink X4 (ESP32-C3) devices",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := setupOutput(); err != nil {
+				return err
+			}
+			// Errors are reported as JSON instead of text
+			cmd.SilenceErrors = machineOutput()
+			cmd.SilenceUsage = machineOutput()
+			return nil
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(&outputFlag, "output", outputText, "Output format: text, json, or ndjson (JSON events, one per line)")
+	rootCmd.PersistentFlags().CountVarP(&verboseFlag, "verbose", "v", "Verbose output; -vv also logs every bootloader request and response")
+	rootCmd.PersistentFlags().BoolVarP(&quietFlag, "quiet", "q", false, "Print errors only")
 
 	// Flash command
 	flashCmd := &cobra.Command{
-		Use:   "flash <firmware.bin>",
+		Use:   "flash [firmware.bin | app.elf | bundle.zip | manifest.json]",
 		Short: "Flash firmware to device",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		RunE:  runFlash,
 	}
-	flashCmd.Flags().StringVarP(&portFlag, "port", "p", "", "Serial port (auto-detect if not specified)")
+	flashCmd.Flags().StringVarP(&portFlag, "port", "p", "", portHelp)
 	flashCmd.Flags().IntVarP(&baudFlag, "baud", "b", protocol.DefaultBaudRate, "Baud rate")
+	addResetFlags(flashCmd)
 	flashCmd.Flags().BoolVar(&firmwareOnlyFlag, "firmware-only", false, "Flash firmware only (skip bootloader/partitions)")
+	flashCmd.Flags().BoolVar(&mergedFlag, "merged", false, "Treat the file as a merged image to be written at 0x0")
+	flashCmd.Flags().StringVar(&buildDirFlag, "build-dir", "", "Flash the output of an ESP-IDF or PlatformIO build directory")
+	flashCmd.Flags().BoolVar(&forceWriteFlag, "force-write", false, "Write every region even if the device already holds the same data")
+	flashCmd.Flags().BoolVar(&deltaFlag, "delta", false, "Write only the sectors that differ from the device")
+	flashCmd.Flags().BoolVar(&resumeFlag, "resume", false, "Journal large writes, and continue an interrupted flash from the last verified sector")
+	flashCmd.Flags().BoolVar(&allFlag, "all", false, "Flash every connected device in parallel")
+	flashCmd.Flags().StringSliceVar(&portsFlag, "ports", nil, "Flash the devices on these ports in parallel (comma-separated)")
+	flashCmd.Flags().StringVar(&recordFlag, "record", "", "Record all serial traffic to a trace file")
+	addMonitorFlags(flashCmd)
 
 	// Info command
 	infoCmd := &cobra.Command{
@@ -42,140 +78,197 @@ func main() {
 		Short: "Show device info",
 		RunE:  runInfo,
 	}
-	infoCmd.Flags().StringVarP(&portFlag, "port", "p", "", "Serial port (auto-detect if not specified)")
+	infoCmd.Flags().StringVarP(&portFlag, "port", "p", "", portHelp)
 	infoCmd.Flags().IntVarP(&baudFlag, "baud", "b", protocol.DefaultBaudRate, "Baud rate")
 
-	rootCmd.AddCommand(flashCmd, infoCmd)
+	// List command
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List serial ports",
+		Args:  cobra.NoArgs,
+		RunE:  runList,
+	}
+
+	rootCmd.AddCommand(flashCmd, infoCmd, listCmd, newUpdateCmd(), newNVSCmd(), newMergeCmd(), newELF2ImageCmd(), newDecodeTraceCmd(), newEmulateCmd(), newMonitorCmd(), newCoreDumpCmd())
 
 	if err := rootCmd.Execute(); err != nil {
+		if machineOutput() {
+			emitError(err)
+		}
 		os.Exit(1)
 	}
 }
 
 func runFlash(cmd *cobra.Command, args []string) error {
-	firmwarePath := args[0]
+	if monitorFlag && (allFlag || len(portsFlag) > 0) {
+		return usageError(fmt.Errorf("--monitor cannot be combined with --all or --ports"))
+	}
 
-	// Read firmware file
-	firmware, err := os.ReadFile(firmwarePath)
+	// Load the images to flash
+	plan, err := loadRegions(args)
 	if err != nil {
-		return fmt.Errorf("failed to read firmware file: %w", err)
+		return err
+	}
+
+	report, err := flashPlanned(plan, flashSource(args))
+	emitResult(report)
+	if err != nil || !monitorFlag {
+		return err
 	}
 
-	fmt.Printf("Firmware: %s (%d bytes)\n", firmwarePath, len(firmware))
+	// Flashing again reloads the images, to pick up a new build
+	portName := report.Devices[0].Port
+	return monitorDevice(portName, func() error {
+		plan, err := loadRegions(args)
+		if err != nil {
+			return err
+		}
+		_, err = flashDevice(portName, plan, console)
+		return err
+	})
+}
+
+// flashPlanned writes the plan to the selected device or devices.
+func flashPlanned(plan *flashPlan, source string) (*flashReport, error) {
+	started := time.Now()
+	report := &flashReport{Source: source}
+	defer func() { report.DurationMS = time.Since(started).Milliseconds() }()
+
+	if allFlag || len(portsFlag) > 0 {
+		err := runFlashAll(plan, report)
+		report.finish(err)
+		return report, err
+	}
 
 	// Find or use specified port
 	portName := portFlag
 	if portName == "" {
-		fmt.Println("Detecting device...")
+		fmt.Fprintln(console, "Detecting device...")
 		result, err := detect.DetectDevice(baudFlag)
 		if err != nil {
-			return fmt.Errorf("device detection failed: %w", err)
+			err = withType(errTypeNoDevice, fmt.Errorf("device detection failed: %w", err))
+			report.finish(err)
+			return report, err
 		}
 		portName = result.Port
-		fmt.Printf("Found %s on %s\n", result.ChipName, result.Port)
+		fmt.Fprintf(console, "Found %s on %s\n", result.ChipName, result.Port)
+		emitEvent(detectedEvent{Event: "detected", Port: result.Port, Chip: result.ChipName})
 	}
 
-	// Open port
-	port, err := serial.Open(portName, baudFlag)
+	result, err := flashDevice(portName, plan, console)
+	report.Devices = append(report.Devices, result)
+	report.finish(err)
 	if err != nil {
-		return fmt.Errorf("failed to open port: %w", err)
-	}
-	defer port.Close()
-
-	fmt.Printf("Port: %s @ %d baud\n", portName, baudFlag)
-
-	// Create flasher
-	f := flasher.New(port)
-
-	// Connect to bootloader
-	fmt.Println("Connecting to bootloader...")
-	if err := f.Connect(); err != nil {
-		return err
+		return report, err
 	}
-	fmt.Println("Connected!")
-
-	// Prepare regions to flash
-	var regions []flasher.FlashRegion
-
-	if !firmwareOnlyFlag {
-		regions = append(regions,
-			flasher.FlashRegion{
-				Address: protocol.BootloaderAddress,
-				Data:    embedded.Bootloader(),
-				Name:    "bootloader",
-			},
-			flasher.FlashRegion{
-				Address: protocol.PartitionsAddress,
-				Data:    embedded.Partitions(),
-				Name:    "partitions",
-			},
-		)
-	}
-
-	regions = append(regions, flasher.FlashRegion{
-		Address: protocol.FirmwareAddress,
-		Data:    firmware,
-		Name:    "firmware",
-	})
 
-	// Flash each region using compressed transfer
-	for _, region := range regions {
-		fmt.Printf("Flashing %s at 0x%X (%d bytes)...\n", region.Name, region.Address, len(region.Data))
-		if err := f.FlashImageCompressed(region.Data, region.Address, false); err != nil {
-			return err
-		}
-	}
-
-	fmt.Println("\nFlash complete!")
-
-	// Reboot
-	fmt.Println("Rebooting device...")
-	if err := f.Reboot(); err != nil {
-		fmt.Printf("Warning: reboot failed: %v\n", err)
+	if !monitorFlag && !result.started() {
+		fmt.Fprintln(console, "\nNote: To start your device, hold the power button and press the reset button.")
 	}
+	return report, nil
+}
 
-	fmt.Println("Done!")
-	fmt.Println("\nNote: To start your device, hold the power button and press the reset button.")
-	return nil
+// deviceInfo is a detected device in JSON output.
+type deviceInfo struct {
+	Port   string `json:"port"`
+	Chip   string `json:"chip"`
+	ChipID uint32 `json:"chip_id"`
 }
 
 func runInfo(cmd *cobra.Command, args []string) error {
+	var devices []detect.Result
 	if portFlag != "" {
 		// Check specific port
 		result, err := detect.DetectOnPort(portFlag, baudFlag)
 		if err != nil {
-			return fmt.Errorf("failed to detect device on %s: %w", portFlag, err)
+			return withType(errTypeNoDevice, fmt.Errorf("failed to detect device on %s: %w", portFlag, err))
 		}
+		devices = append(devices, *result)
 		printDeviceInfo(result)
-		return nil
+	} else {
+		// Auto-detect
+		fmt.Fprintln(console, "Scanning for ESP32 devices...")
+		var err error
+		devices, err = detect.ListDevices(baudFlag)
+		if err != nil {
+			return err
+		}
+
+		if len(devices) == 0 {
+			fmt.Fprintln(console, "No ESP32 devices found")
+		} else {
+			fmt.Fprintf(console, "Found %d device(s):\n\n", len(devices))
+		}
+		for i, d := range devices {
+			fmt.Fprintf(console, "Device %d:\n", i+1)
+			printDeviceInfo(&d)
+			fmt.Fprintln(console)
+		}
 	}
 
-	// Auto-detect
-	fmt.Println("Scanning for ESP32 devices...")
-	devices, err := detect.ListDevices(baudFlag)
-	if err != nil {
-		return err
+	infos := make([]deviceInfo, 0, len(devices))
+	for _, d := range devices {
+		infos = append(infos, deviceInfo{Port: d.Port, Chip: d.ChipName, ChipID: d.ChipID})
 	}
+	emitResult(struct {
+		OK      bool         `json:"ok"`
+		Devices []deviceInfo `json:"devices"`
+	}{true, infos})
+	return nil
+}
 
-	if len(devices) == 0 {
-		fmt.Println("No ESP32 devices found")
-		return nil
+func printDeviceInfo(d *detect.Result) {
+	fmt.Fprintf(console, "  Port:     %s\n", d.Port)
+	fmt.Fprintf(console, "  Chip:     %s\n", d.ChipName)
+	if d.ChipID != 0 {
+		fmt.Fprintf(console, "  Chip ID:  0x%02X\n", d.ChipID)
 	}
+}
 
-	fmt.Printf("Found %d device(s):\n\n", len(devices))
-	for i, d := range devices {
-		fmt.Printf("Device %d:\n", i+1)
-		printDeviceInfo(&d)
-		fmt.Println()
+func runList(cmd *cobra.Command, args []string) error {
+	ports, err := serial.ListPorts()
+	if err != nil {
+		return fmt.Errorf("failed to list ports: %w", err)
 	}
 
+	if len(ports) == 0 {
+		fmt.Fprintln(console, "No serial ports found")
+	}
+	for _, p := range ports {
+		fmt.Fprintln(console, p)
+	}
+
+	if ports == nil {
+		ports = []string{}
+	}
+	emitResult(struct {
+		OK    bool     `json:"ok"`
+		Ports []string `json:"ports"`
+	}{true, ports})
 	return nil
 }
 
-func printDeviceInfo(d *detect.Result) {
-	fmt.Printf("  Port:     %s\n", d.Port)
-	fmt.Printf("  Chip:     %s\n", d.ChipName)
-	if d.ChipID != 0 {
-		fmt.Printf("  Chip ID:  0x%02X\n", d.ChipID)
+// parseSize parses a size given in bytes (decimal or 0x-prefixed hex) or
+// with a KB/MB suffix, e.g. "0x6000", "24576", "4MB".
+func parseSize(s string) (uint32, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "MB"):
+		multiplier = 1024 * 1024
+		s = strings.TrimSuffix(s, "MB")
+	case strings.HasSuffix(s, "KB"):
+		multiplier = 1024
+		s = strings.TrimSuffix(s, "KB")
+	}
+
+	value, err := strconv.ParseUint(strings.ToLower(s), 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	value *= multiplier
+	if value > 0xFFFFFFFF {
+		return 0, fmt.Errorf("size %s is too large", s)
 	}
+	return uint32(value), nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+	"github.com/bigbag/papyrix-flasher/internal/image"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+var (
+	mergeOutputFlag   string
+	mergeFillSizeFlag string
+)
+
+func newMergeCmd() *cobra.Command {
+	mergeCmd := &cobra.Command{
+		Use:   "merge <firmware.bin>",
+		Short: "Combine bootloader, partitions and firmware into a single image",
+		Long: `Combine the embedded bootloader and partition table with the firmware into
+a single image that can be written at address 0x0 by any flashing tool.
+A manifest recording each component's offset and SHA-256 is written next
+to the output file.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runMerge,
+	}
+	mergeCmd.Flags().StringVarP(&mergeOutputFlag, "out", "o", "", "Output image file")
+	mergeCmd.Flags().StringVar(&mergeFillSizeFlag, "fill-flash-size", "", "Pad the image with 0xFF to this size (e.g. 16MB)")
+	mergeCmd.MarkFlagRequired("out")
+	return mergeCmd
+}
+
+func runMerge(cmd *cobra.Command, args []string) error {
+	firmwarePath := args[0]
+
+	firmware, err := os.ReadFile(firmwarePath)
+	if err != nil {
+		return fmt.Errorf("failed to read firmware file: %w", err)
+	}
+
+	var fillSize uint32
+	if mergeFillSizeFlag != "" {
+		fillSize, err = parseSize(mergeFillSizeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid fill size: %w", err)
+		}
+	}
+
+	parts := []image.Part{
+		{Name: "bootloader", Offset: protocol.BootloaderAddress, Data: embedded.Bootloader()},
+		{Name: "partitions", Offset: protocol.PartitionsAddress, Data: embedded.Partitions()},
+		{Name: "firmware", Offset: protocol.FirmwareAddress, Data: firmware},
+	}
+
+	merged, manifest, err := image.Merge(parts, fillSize)
+	if err != nil {
+		return fmt.Errorf("failed to merge image: %w", err)
+	}
+
+	if err := os.WriteFile(mergeOutputFlag, merged, 0o644); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	manifestPath := manifestPathFor(mergeOutputFlag)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath, append(manifestData, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	for _, p := range manifest.Parts {
+		fmt.Fprintf(console, "  %-10s at 0x%06X (%d bytes)\n", p.Name, p.Offset, p.Size)
+	}
+	fmt.Fprintf(console, "Wrote %s (%d bytes)\n", mergeOutputFlag, len(merged))
+	fmt.Fprintf(console, "Wrote %s\n", manifestPath)
+
+	emitResult(struct {
+		OK       bool            `json:"ok"`
+		Output   string          `json:"output"`
+		Manifest string          `json:"manifest"`
+		Image    *image.Manifest `json:"image"`
+	}{true, mergeOutputFlag, manifestPath, manifest})
+	return nil
+}
+
+// manifestPathFor returns the sidecar manifest path for an image file,
+// e.g. full.bin -> full.manifest.json.
+func manifestPathFor(imagePath string) string {
+	return strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".manifest.json"
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/bigbag/papyrix-flasher/internal/detect"
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/monitor"
+	"github.com/bigbag/papyrix-flasher/internal/symbols"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// defaultConsoleBaud is the speed of the ESP32-C3 boot log and of the
+// firmware console.
+const defaultConsoleBaud = 115200
+
+var (
+	monitorFlag     bool
+	monitorBaudFlag int
+	monitorLogFlag  string
+	timestampsFlag  bool
+	noResetFlag     bool
+	elfFlag         string
+)
+
+func newMonitorCmd() *cobra.Command {
+	monitorCmd := &cobra.Command{
+		Use:   "monitor",
+		Short: "Show the device's serial console",
+		Long: `Open the device's serial console, reset the device and stream its output.
+
+Keys typed are sent to the device, except:
+  Ctrl+] or Ctrl+C  exit
+  Ctrl+T R          reset the device
+  Ctrl+T B          reset into the bootloader
+  Ctrl+T F          flash again (with flash --monitor)
+  Ctrl+T S          toggle timestamps
+  Ctrl+T H          show the keys
+  Ctrl+T Ctrl+T     send Ctrl+T to the device
+
+With --elf, the code addresses of panics and backtraces are decoded to
+functions and source lines using the firmware's debug information.`,
+		Args: cobra.NoArgs,
+		RunE: runMonitor,
+	}
+	monitorCmd.Flags().StringVarP(&portFlag, "port", "p", "", portHelp)
+	monitorCmd.Flags().IntVarP(&monitorBaudFlag, "baud", "b", defaultConsoleBaud, "Console baud rate")
+	monitorCmd.Flags().StringVar(&monitorLogFlag, "log", "", "Append the output to a log file")
+	monitorCmd.Flags().BoolVar(&timestampsFlag, "timestamps", false, "Prefix each line with the time it was received")
+	monitorCmd.Flags().BoolVar(&noResetFlag, "no-reset", false, "Do not reset the device when the monitor starts")
+	monitorCmd.Flags().StringVar(&elfFlag, "elf", "", "Firmware ELF file to decode crash backtraces with")
+	addBeforeFlag(monitorCmd)
+	return monitorCmd
+}
+
+// addMonitorFlags adds the flags of flash --monitor.
+func addMonitorFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&monitorFlag, "monitor", false, "Open the serial console after flashing")
+	cmd.Flags().IntVar(&monitorBaudFlag, "monitor-baud", defaultConsoleBaud, "Console baud rate for --monitor")
+	cmd.Flags().StringVar(&monitorLogFlag, "monitor-log", "", "Append the console output of --monitor to a log file")
+	cmd.Flags().BoolVar(&timestampsFlag, "timestamps", false, "Prefix each console line with the time it was received")
+}
+
+func runMonitor(cmd *cobra.Command, args []string) error {
+	portName := portFlag
+	if portName == "" {
+		fmt.Fprintln(console, "Detecting device...")
+		result, err := detect.DetectDevice(monitorBaudFlag)
+		if err != nil {
+			return withType(errTypeNoDevice, fmt.Errorf("device detection failed: %w", err))
+		}
+		portName = result.Port
+		fmt.Fprintf(console, "Found %s on %s\n", result.ChipName, result.Port)
+	}
+
+	if err := monitorDevice(portName, nil); err != nil {
+		return err
+	}
+	emitResult(struct {
+		OK   bool   `json:"ok"`
+		Port string `json:"port"`
+	}{true, portName})
+	return nil
+}
+
+// monitorDevice streams the console of the device on portName until the
+// user exits. When the user asks to flash again, reflash is called with
+// the console closed; without it, the request is declined.
+func monitorDevice(portName string, reflash func() error) error {
+	var syms monitor.Resolver
+	if elfFlag != "" {
+		table, err := symbols.Open(elfFlag)
+		if err != nil {
+			return withType(errTypeIO, fmt.Errorf("failed to load symbols: %w", err))
+		}
+		syms = table
+	}
+
+	// Device output is the point of the command: it is shown even with
+	// --quiet, and kept off stdout when that carries JSON
+	var out io.Writer = os.Stdout
+	if machineOutput() {
+		out = os.Stderr
+	}
+	display := &crlfWriter{w: out}
+	bootReset, err := flasher.BootloaderReset(beforeFlag, resetPrompt(display))
+	if err != nil {
+		return usageError(err)
+	}
+
+	open := func() (transport.Transport, error) {
+		return transport.Open(portName, monitorBaudFlag)
+	}
+	port, err := open()
+	if err != nil {
+		return withType(errTypePort, fmt.Errorf("failed to open port: %w", err))
+	}
+
+	var log io.Writer
+	if monitorLogFlag != "" {
+		file, err := os.OpenFile(monitorLogFlag, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			port.Close()
+			return withType(errTypeIO, fmt.Errorf("failed to open log: %w", err))
+		}
+		defer file.Close()
+		log = file
+	}
+
+	kb := openKeyboard()
+	defer kb.restore()
+	if kb.keys != nil {
+		// The manual reset prompt must not race the keyboard reader
+		defer func(wait func()) { waitEnter = wait }(waitEnter)
+		waitEnter = kb.waitEnter
+	}
+
+	m := &monitor.Monitor{Port: port, Out: display, Log: log, Timestamps: timestampsFlag, Reopen: open, Symbols: syms, BootReset: bootReset}
+	defer func() { m.Port.Close() }()
+
+	start := func() {
+		fmt.Fprintf(out, "--- Monitoring %s @ %d baud ---\n", portName, monitorBaudFlag)
+		if syms != nil {
+			fmt.Fprintf(out, "--- Decoding crashes with %s ---\n", elfFlag)
+		}
+		if kb.keys != nil {
+			fmt.Fprintf(out, "--- %s ---\n", monitor.Help)
+		}
+		if !noResetFlag {
+			if err := m.Port.HardReset(); err != nil {
+				fmt.Fprintf(out, "--- Reset failed: %v ---\n", err)
+			}
+		}
+		display.on = kb.raw(out)
+	}
+	start()
+
+	for {
+		action, err := m.Run(kb.keys)
+		if err != nil || action == monitor.Exit {
+			return err
+		}
+
+		if reflash == nil {
+			fmt.Fprintln(display, "--- Nothing to flash; start the monitor with flash --monitor ---")
+			continue
+		}
+		m.Port.Close()
+		kb.restore()
+		display.on = false
+		fmt.Fprintln(out)
+		if err := reflash(); err != nil {
+			fmt.Fprintf(out, "--- Flash failed: %v ---\n", err)
+		}
+
+		port, err := open()
+		if err != nil {
+			return withType(errTypePort, fmt.Errorf("failed to reopen port: %w", err))
+		}
+		m.Port = port
+		start()
+	}
+}
+
+// keyboard reads keys from a terminal on stdin.
+type keyboard struct {
+	fd    int
+	keys  chan byte // nil when stdin is not a terminal
+	state *term.State
+}
+
+func openKeyboard() *keyboard {
+	kb := &keyboard{fd: int(os.Stdin.Fd())}
+	if !term.IsTerminal(kb.fd) {
+		return kb
+	}
+	kb.keys = make(chan byte, 64)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			for _, k := range buf[:n] {
+				kb.keys <- k
+			}
+			if err != nil {
+				close(kb.keys)
+				return
+			}
+		}
+	}()
+	return kb
+}
+
+// waitEnter waits for Enter to be typed, in raw mode or not.
+func (kb *keyboard) waitEnter() {
+	for k := range kb.keys {
+		if k == '\r' || k == '\n' {
+			return
+		}
+	}
+}
+
+// raw puts the terminal in raw mode, so that keys arrive as typed. It
+// reports whether out is that terminal and now needs "\r\n" line endings.
+func (kb *keyboard) raw(out io.Writer) bool {
+	if kb.keys == nil || kb.state != nil {
+		return false
+	}
+	state, err := term.MakeRaw(kb.fd)
+	if err != nil {
+		return false
+	}
+	kb.state = state
+	file, ok := out.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// restore returns the terminal to the mode it had before raw.
+func (kb *keyboard) restore() {
+	if kb.state != nil {
+		term.Restore(kb.fd, kb.state)
+		kb.state = nil
+	}
+}
+
+// crlfWriter turns bare "\n" into "\r\n" while on, for a terminal in raw
+// mode.
+type crlfWriter struct {
+	w    io.Writer
+	on   bool
+	last byte
+}
+
+func (c *crlfWriter) Write(data []byte) (int, error) {
+	if !c.on || len(data) == 0 {
+		if len(data) > 0 {
+			c.last = data[len(data)-1]
+		}
+		return c.w.Write(data)
+	}
+	out := make([]byte, 0, len(data)+8)
+	for _, b := range data {
+		if b == '\n' && c.last != '\r' {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		c.last = b
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/detect"
+	"github.com/bigbag/papyrix-flasher/internal/serial"
+)
+
+// runFlashAll flashes several devices in parallel, one Flasher per port,
+// and prints a summary table. It fails if any device fails.
+func runFlashAll(plan *flashPlan, report *flashReport) error {
+	if portFlag != "" {
+		return usageError(fmt.Errorf("--port cannot be combined with --all or --ports"))
+	}
+	if allFlag && len(portsFlag) > 0 {
+		return usageError(fmt.Errorf("--all and --ports cannot be combined"))
+	}
+	if recordFlag != "" {
+		return usageError(fmt.Errorf("--record records a single device and cannot be combined with --all or --ports"))
+	}
+
+	ports := portsFlag
+	if allFlag {
+		fmt.Fprintln(console, "Detecting devices...")
+		var err error
+		ports, err = detectAll()
+		if err != nil {
+			return err
+		}
+		if len(ports) == 0 {
+			return withType(errTypeNoDevice, fmt.Errorf("no ESP32 devices found"))
+		}
+	}
+	fmt.Fprintf(console, "Flashing %d device(s)\n\n", len(ports))
+
+	var stdout sync.Mutex
+	results := make([]*deviceResult, len(ports))
+	var wg sync.WaitGroup
+	for i, portName := range ports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prefix := "[" + filepath.Base(portName) + "] "
+			out := &prefixWriter{prefix: prefix, w: console, mu: &stdout}
+			result, err := flashDevice(portName, plan, out)
+			out.Flush()
+			if err != nil {
+				fmt.Fprintf(&prefixWriter{prefix: prefix, w: os.Stderr, mu: &stdout}, "Error: %v\n", err)
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	report.Devices = results
+	failed := printSummary(console, results)
+	if failed > 0 {
+		return withType(errTypeDevicesFail, fmt.Errorf("%d of %d device(s) failed", failed, len(results)))
+	}
+	for _, r := range results {
+		if !r.started() {
+			fmt.Fprintln(console, "\nNote: To start your devices, hold the power button and press the reset button.")
+			break
+		}
+	}
+	return nil
+}
+
+// detectAll probes every serial port in parallel and returns those with
+// an ESP32 bootloader.
+func detectAll() ([]string, error) {
+	candidates, err := serial.ListPorts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports: %w", err)
+	}
+
+	found := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for i, portName := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := detect.DetectOnPort(portName, baudFlag)
+			if err == nil {
+				found[i] = true
+				emitEvent(detectedEvent{Event: "detected", Port: result.Port, Chip: result.ChipName})
+			}
+		}()
+	}
+	wg.Wait()
+
+	var ports []string
+	for i, ok := range found {
+		if ok {
+			ports = append(ports, candidates[i])
+		}
+	}
+	return ports, nil
+}
+
+// printSummary prints one row per device and returns the number of failures.
+func printSummary(w io.Writer, results []*deviceResult) int {
+	failed := 0
+	fmt.Fprintln(w, "\nSummary:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tMAC\tSTATUS\tWRITTEN\tTIME\tERROR")
+	for _, r := range results {
+		status, errText := "ok", ""
+		if r.Err != nil {
+			status, errText = "FAILED", r.Err.Error()
+			failed++
+		} else if r.Written == 0 {
+			status = "up to date"
+		}
+		mac := r.MAC
+		if mac == "" {
+			mac = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Port, mac, status, r.Written, r.Duration.Round(100*time.Millisecond), errText)
+	}
+	tw.Flush()
+	return failed
+}
+
+// prefixWriter prefixes each line with the device name and writes whole
+// lines to a shared writer, so output from parallel devices does not
+// interleave within a line.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.writeLine(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes any incomplete final line.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	io.WriteString(p.w, p.prefix)
+	p.w.Write(line)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/internal/nvs"
+)
+
+var nvsSizeFlag string
+
+func newNVSCmd() *cobra.Command {
+	nvsCmd := &cobra.Command{
+		Use:   "nvs",
+		Short: "Work with NVS partition images",
+	}
+
+	genCmd := &cobra.Command{
+		Use:   "gen <input.csv> <output.bin>",
+		Short: "Generate an NVS partition image from a CSV file",
+		Long: `Generate an NVS partition image from a CSV file in the ESP-IDF
+nvs_partition_gen format (key,type,encoding,value).`,
+		Args: cobra.ExactArgs(2),
+		RunE: runNVSGen,
+	}
+	genCmd.Flags().StringVar(&nvsSizeFlag, "size", "", "Partition size (e.g. 0x6000)")
+	genCmd.MarkFlagRequired("size")
+
+	dumpCmd := &cobra.Command{
+		Use:   "dump <image.bin>",
+		Short: "Print the contents of an NVS partition image as CSV",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runNVSDump,
+	}
+
+	nvsCmd.AddCommand(genCmd, dumpCmd)
+	return nvsCmd
+}
+
+func runNVSGen(cmd *cobra.Command, args []string) error {
+	inputPath, outputPath := args[0], args[1]
+
+	size, err := parseSize(nvsSizeFlag)
+	if err != nil {
+		return fmt.Errorf("invalid size: %w", err)
+	}
+
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open CSV file: %w", err)
+	}
+	defer input.Close()
+
+	entries, err := nvs.ParseCSV(input)
+	if err != nil {
+		return err
+	}
+
+	image, err := nvs.Generate(entries, int(size))
+	if err != nil {
+		return fmt.Errorf("failed to generate NVS image: %w", err)
+	}
+
+	if err := os.WriteFile(outputPath, image, 0o644); err != nil {
+		return fmt.Errorf("failed to write NVS image: %w", err)
+	}
+
+	fmt.Fprintf(console, "Wrote %s (%d entries, %d bytes)\n", outputPath, len(entries), len(image))
+
+	emitResult(struct {
+		OK      bool   `json:"ok"`
+		Output  string `json:"output"`
+		Entries int    `json:"entries"`
+		Size    int    `json:"size"`
+	}{true, outputPath, len(entries), len(image)})
+	return nil
+}
+
+func runNVSDump(cmd *cobra.Command, args []string) error {
+	image, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read NVS image: %w", err)
+	}
+
+	entries, err := nvs.Parse(image)
+	if err != nil {
+		return fmt.Errorf("failed to parse NVS image: %w", err)
+	}
+
+	if !machineOutput() {
+		return nvs.WriteCSV(os.Stdout, entries)
+	}
+
+	type jsonEntry struct {
+		Namespace string `json:"namespace"`
+		Key       string `json:"key"`
+		Type      string `json:"type"`
+		Value     any    `json:"value"` // blobs are base64-encoded
+	}
+	out := make([]jsonEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, jsonEntry{Namespace: e.Namespace, Key: e.Key, Type: e.Type.String(), Value: e.Value()})
+	}
+	emitResult(struct {
+		OK      bool        `json:"ok"`
+		Entries []jsonEntry `json:"entries"`
+	}{true, out})
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/bigbag/papyrix-flasher/internal/update"
+)
+
+// Output formats for --output
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+)
+
+var outputFlag string
+
+// console receives human-readable messages. With JSON output they go to
+// stderr so that stdout carries only JSON.
+var console io.Writer = os.Stdout
+
+var (
+	stdoutMu sync.Mutex
+	emitted  bool
+)
+
+// setupOutput validates --output and --quiet and redirects messages
+// accordingly.
+func setupOutput() error {
+	switch outputFlag {
+	case outputText:
+		console = os.Stdout
+	case outputJSON, outputNDJSON:
+		console = os.Stderr
+	default:
+		return usageError(fmt.Errorf("unknown output format %q (use %s, %s or %s)", outputFlag, outputText, outputJSON, outputNDJSON))
+	}
+	if quietFlag {
+		if verboseFlag > 0 {
+			return usageError(fmt.Errorf("--quiet cannot be combined with -v"))
+		}
+		console = io.Discard
+	}
+	return nil
+}
+
+// machineOutput reports whether results are emitted as JSON.
+func machineOutput() bool {
+	return outputFlag == outputJSON || outputFlag == outputNDJSON
+}
+
+// emitResult writes the final result of a command: a JSON document, or a
+// "result" event in NDJSON mode. It does nothing in text mode.
+func emitResult(result any) {
+	switch outputFlag {
+	case outputJSON:
+		stdoutMu.Lock()
+		defer stdoutMu.Unlock()
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		emitted = true
+	case outputNDJSON:
+		emitEvent(struct {
+			Event  string `json:"event"`
+			Result any    `json:"result"`
+		}{"result", result})
+		emitted = true
+	}
+}
+
+// emitEvent writes one line of the NDJSON event stream. Events carry an
+// "event" field naming their kind. It does nothing in other modes.
+func emitEvent(event any) {
+	if outputFlag != outputNDJSON {
+		return
+	}
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	json.NewEncoder(os.Stdout).Encode(event)
+}
+
+// emitError reports a command failure, unless the command already emitted
+// a result describing it.
+func emitError(err error) {
+	if emitted {
+		return
+	}
+	emitResult(struct {
+		OK    bool       `json:"ok"`
+		Error *jsonError `json:"error"`
+	}{false, newJSONError(err)})
+}
+
+// Error types reported in JSON output
+const (
+	errTypeUsage       = "usage"
+	errTypeIO          = "io"
+	errTypeNoDevice    = "device_not_found"
+	errTypePort        = "port"
+	errTypeConnect     = "connect"
+	errTypeFlash       = "flash"
+	errTypeChecksum    = "checksum"
+	errTypeNetwork     = "network"
+	errTypeDevicesFail = "devices_failed"
+	errTypeOther       = "error"
+)
+
+// jsonError is the JSON form of an error.
+type jsonError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func newJSONError(err error) *jsonError {
+	if err == nil {
+		return nil
+	}
+	return &jsonError{Type: errorType(err), Message: err.Error()}
+}
+
+// typedError attaches an error type for JSON output.
+type typedError struct {
+	typ string
+	err error
+}
+
+func (e *typedError) Error() string { return e.err.Error() }
+func (e *typedError) Unwrap() error { return e.err }
+
+func withType(typ string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &typedError{typ: typ, err: err}
+}
+
+func usageError(err error) error {
+	return withType(errTypeUsage, err)
+}
+
+// errorType classifies an error for JSON output.
+func errorType(err error) string {
+	var typed *typedError
+	var checksum *update.ChecksumError
+	var pathErr *os.PathError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &typed):
+		return typed.typ
+	case errors.As(err, &checksum):
+		return errTypeChecksum
+	case errors.As(err, &pathErr):
+		return errTypeIO
+	case errors.As(err, &netErr):
+		return errTypeNetwork
+	default:
+		return errTypeOther
+	}
+}
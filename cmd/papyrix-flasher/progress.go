@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+)
+
+const (
+	barWidth = 30
+
+	// How often the bar is redrawn, and how often a line is printed when
+	// output is not a terminal
+	redrawInterval = 100 * time.Millisecond
+	lineInterval   = 2 * time.Second
+)
+
+// progressPrinter renders flasher progress as a bar on a terminal, or as
+// periodic lines otherwise (log files, CI, parallel flashing).
+type progressPrinter struct {
+	out  io.Writer
+	tty  bool
+	last time.Time
+}
+
+func newProgressPrinter(out io.Writer) *progressPrinter {
+	tty := out == io.Writer(os.Stdout) && term.IsTerminal(int(os.Stdout.Fd()))
+	return &progressPrinter{out: out, tty: tty}
+}
+
+func (p *progressPrinter) update(pr flasher.Progress) {
+	now := time.Now()
+	if p.tty {
+		if !pr.Finished() && pr.Done > 0 && now.Sub(p.last) < redrawInterval {
+			return
+		}
+		p.last = now
+		fmt.Fprintf(p.out, "\r\033[K  %s", formatBar(pr))
+		if pr.Finished() {
+			fmt.Fprintln(p.out)
+		}
+		return
+	}
+
+	switch {
+	case pr.Done == 0:
+		p.last = now
+	case pr.Finished():
+		// Quick erases and verifies are not worth a line of their own
+		if pr.Stage == flasher.StageWrite || pr.Elapsed >= lineInterval {
+			fmt.Fprintf(p.out, "  %s\n", formatLine(pr))
+		}
+	case now.Sub(p.last) >= lineInterval:
+		p.last = now
+		fmt.Fprintf(p.out, "  %s\n", formatLine(pr))
+	}
+}
+
+// formatBar renders e.g.
+// "Writing   [=============>                ]  45%  1.2 MB/2.6 MB  210 KB/s  ETA 7s".
+func formatBar(pr flasher.Progress) string {
+	filled := int(pr.Fraction() * barWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	s := fmt.Sprintf("%-9s [%s] %3.0f%%  %s/%s", pr.Stage, bar, pr.Fraction()*100, formatBytes(pr.Done), formatBytes(pr.Total))
+	return s + formatRate(pr)
+}
+
+// formatLine renders e.g. "Writing 45% (1.2 MB of 2.6 MB, 210 KB/s, ETA 7s)".
+func formatLine(pr flasher.Progress) string {
+	s := fmt.Sprintf("%s %.0f%% (%s of %s", pr.Stage, pr.Fraction()*100, formatBytes(pr.Done), formatBytes(pr.Total))
+	return s + strings.ReplaceAll(formatRate(pr), "  ", ", ") + ")"
+}
+
+func formatRate(pr flasher.Progress) string {
+	if pr.Rate == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("  %s/s", formatBytes(int(pr.Rate)))
+	if pr.Finished() {
+		return s + fmt.Sprintf("  in %s", pr.Elapsed.Round(100*time.Millisecond))
+	}
+	if pr.ETA > 0 {
+		s += fmt.Sprintf("  ETA %s", pr.ETA.Round(time.Second))
+	}
+	return s
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.0f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
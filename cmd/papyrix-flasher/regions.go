@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+	"github.com/bigbag/papyrix-flasher/internal/bundle"
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/image"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// flashPlan describes what the flash command writes.
+type flashPlan struct {
+	regions   []flasher.FlashRegion
+	flashSize uint32 // 0 keeps the default
+
+	// bundle is set when the regions depend on the connected chip
+	bundle *bundle.Bundle
+	source string
+}
+
+// resolve picks the build matching the connected chip for multi-chip bundles.
+func (p *flashPlan) resolve(chip string) error {
+	if p.bundle == nil {
+		return nil
+	}
+	layout, err := p.bundle.ForChip(chip)
+	if err != nil {
+		return err
+	}
+	p.regions, p.flashSize, err = layoutRegions(layout, p.source)
+	return err
+}
+
+// loadRegions returns what to flash for the flash command arguments.
+func loadRegions(args []string) (*flashPlan, error) {
+	if buildDirFlag != "" {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("a firmware file cannot be combined with --build-dir")
+		}
+		return loadBuildDir(buildDirFlag)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("a firmware file or --build-dir is required")
+	}
+
+	firmwarePath := args[0]
+	if bundle.IsBundle(firmwarePath) {
+		return loadBundle(firmwarePath)
+	}
+
+	// Read firmware file (.bin.gz is decompressed)
+	firmware, err := bundle.ReadFile(firmwarePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read firmware file: %w", err)
+	}
+
+	fmt.Fprintf(console, "Firmware: %s (%d bytes)\n", firmwarePath, len(firmware))
+
+	if image.IsELF(firmware) {
+		if mergedFlag {
+			return nil, fmt.Errorf("--merged cannot be used with an ELF file")
+		}
+		// Match the flash settings of the bootloader written with it
+		settings, err := image.ReadFlashSettings(embedded.Bootloader())
+		if err != nil {
+			return nil, err
+		}
+		if firmware, err = convertELF(firmwarePath, firmware, settings); err != nil {
+			return nil, err
+		}
+	}
+
+	merged := mergedFlag || image.IsMerged(firmware)
+	if merged && firmwareOnlyFlag {
+		return nil, fmt.Errorf("--firmware-only cannot be used with a merged image")
+	}
+
+	var regions []flasher.FlashRegion
+
+	if merged {
+		// Merged images start at 0x0; skip long runs of erased flash
+		parts := image.Split(firmware, image.MinSkipGap)
+		regions = partsToRegions(parts)
+		fmt.Fprintf(console, "Merged image: %d region(s), skipping %d bytes of empty flash\n", len(regions), len(firmware)-regionsSize(regions))
+		return &flashPlan{regions: regions}, nil
+	}
+
+	if !firmwareOnlyFlag {
+		regions = append(regions,
+			flasher.FlashRegion{
+				Address: protocol.BootloaderAddress,
+				Data:    embedded.Bootloader(),
+				Name:    "bootloader",
+			},
+			flasher.FlashRegion{
+				Address: protocol.PartitionsAddress,
+				Data:    embedded.Partitions(),
+				Name:    "partitions",
+			},
+		)
+	}
+
+	regions = append(regions, flasher.FlashRegion{
+		Address: protocol.FirmwareAddress,
+		Data:    firmware,
+		Name:    "firmware",
+	})
+
+	return &flashPlan{regions: regions}, nil
+}
+
+// loadBuildDir loads the regions and flash settings from a build directory.
+func loadBuildDir(dir string) (*flashPlan, error) {
+	layout, err := bundle.FromBuildDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load build directory: %w", err)
+	}
+	regions, flashSize, err := layoutRegions(layout, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &flashPlan{regions: regions, flashSize: flashSize}, nil
+}
+
+// loadBundle loads a release archive or web installer manifest. Bundles
+// with builds for several chips are resolved once the chip is known.
+func loadBundle(name string) (*flashPlan, error) {
+	b, err := bundle.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle: %w", err)
+	}
+
+	fmt.Fprintf(console, "Bundle: %s (%d build(s))\n", b.Name, len(b.Layouts))
+	if len(b.Layouts) > 1 {
+		return &flashPlan{bundle: b, source: name}, nil
+	}
+
+	regions, flashSize, err := layoutRegions(b.Layouts[0], name)
+	if err != nil {
+		return nil, err
+	}
+	return &flashPlan{regions: regions, flashSize: flashSize}, nil
+}
+
+// layoutRegions converts a bundle layout into flash regions.
+func layoutRegions(layout *bundle.Layout, source string) ([]flasher.FlashRegion, uint32, error) {
+	if layout.Chip != "" && !strings.EqualFold(strings.ReplaceAll(layout.Chip, "-", ""), "esp32c3") {
+		return nil, 0, fmt.Errorf("%s was built for %s, not esp32c3", source, layout.Chip)
+	}
+
+	flashSize, err := layout.FlashSize()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fmt.Fprintf(console, "Build: %s (%s)\n", source, layout.Source)
+	if s := layout.Settings; s.Mode != "" || s.Freq != "" || s.Size != "" {
+		fmt.Fprintf(console, "Flash settings: mode=%s freq=%s size=%s\n", orKeep(s.Mode), orKeep(s.Freq), orKeep(s.Size))
+	}
+
+	parts := layout.Parts
+	if firmwareOnlyFlag {
+		parts = nil
+		for _, p := range layout.Parts {
+			if p.Offset != protocol.BootloaderAddress && p.Offset != protocol.PartitionsAddress {
+				parts = append(parts, p)
+			}
+		}
+	}
+
+	return partsToRegions(parts), flashSize, nil
+}
+
+func partsToRegions(parts []image.Part) []flasher.FlashRegion {
+	regions := make([]flasher.FlashRegion, 0, len(parts))
+	for _, p := range parts {
+		regions = append(regions, flasher.FlashRegion{Address: p.Offset, Data: p.Data, Name: p.Name})
+	}
+	return regions
+}
+
+func regionsSize(regions []flasher.FlashRegion) int {
+	total := 0
+	for _, r := range regions {
+		total += len(r.Data)
+	}
+	return total
+}
+
+func orKeep(s string) string {
+	if s == "" {
+		return "keep"
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+)
+
+var (
+	beforeFlag string
+	afterFlag  string
+)
+
+// waitEnter waits for the user to press Enter. The monitor replaces it
+// while its keyboard reader owns stdin.
+var waitEnter = func() {
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+// addBeforeFlag adds --before to a command that resets devices into the
+// bootloader.
+func addBeforeFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&beforeFlag, "before", flasher.ResetAuto,
+		"How to enter the bootloader: "+strings.Join(flasher.ResetNames, ", "))
+}
+
+// addResetFlags adds --before and --after to a command that connects to
+// the bootloader.
+func addResetFlags(cmd *cobra.Command) {
+	addBeforeFlag(cmd)
+	cmd.Flags().StringVar(&afterFlag, "after", flasher.AfterAuto,
+		"What to do when done: "+strings.Join(flasher.AfterNames, ", "))
+}
+
+// setReset configures the reset strategies of --before and checks
+// --after. The user is asked to reset the device by hand only when one
+// device is flashed from a terminal.
+func setReset(f *flasher.Flasher, out io.Writer) error {
+	if err := flasher.CheckAfter(afterFlag); err != nil {
+		return usageError(err)
+	}
+
+	strategies, err := flasher.ResetStrategies(beforeFlag, resetPrompt(out))
+	if err != nil {
+		return usageError(err)
+	}
+	f.SetReset(strategies)
+	return nil
+}
+
+// resetPrompt returns the prompt of the manual reset, or nil when the
+// user cannot answer it.
+func resetPrompt(out io.Writer) func() {
+	if allFlag || len(portsFlag) > 0 || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+	return func() {
+		fmt.Fprintln(out, "Put the device into its bootloader: hold BOOT, press and release RESET, then release BOOT.")
+		fmt.Fprint(out, "Press Enter when done...")
+		waitEnter()
+	}
+}
+
+// leave ends the session with the action of --after and reports it. It
+// returns the action taken, or "" if it failed.
+func leave(f *flasher.Flasher, out io.Writer) string {
+	after, err := f.Leave(afterFlag)
+	switch {
+	case err != nil:
+		fmt.Fprintf(out, "Warning: %s failed: %v\n", after, err)
+		return ""
+	case after == flasher.AfterStayInBootloader:
+		fmt.Fprintln(out, "Leaving the device in its bootloader")
+	default:
+		fmt.Fprintf(out, "Started the application (%s)\n", after)
+	}
+	return after
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/update"
+)
+
+// updateServerEnv overrides the default release server, e.g. for a mirror.
+const updateServerEnv = "PAPYRIX_FLASHER_UPDATE_URL"
+
+var (
+	updateChannelFlag  string
+	updateFirmwareFlag string
+	updateServerFlag   string
+)
+
+func newUpdateCmd() *cobra.Command {
+	server := os.Getenv(updateServerEnv)
+	if server == "" {
+		server = update.DefaultBaseURL
+	}
+
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "Download the latest firmware release and flash it",
+		Long: `Find the latest firmware release, download it, verify its published
+SHA-256 and flash it. Downloads are cached, so flashing the same release
+again does not download it twice.
+
+Releases are read from a GitHub-Releases-compatible API. Use --server or
+the ` + updateServerEnv + ` environment variable to point at a mirror.`,
+		Args: cobra.NoArgs,
+		RunE: runUpdate,
+	}
+	updateCmd.Flags().StringVar(&updateChannelFlag, "channel", update.ChannelStable, "Release channel (stable or beta)")
+	updateCmd.Flags().StringVar(&updateFirmwareFlag, "firmware", "papyrix", "Firmware to install ("+strings.Join(firmwareNames(), " or ")+")")
+	updateCmd.Flags().StringVar(&updateServerFlag, "server", server, "Release API base URL")
+	updateCmd.Flags().StringVarP(&portFlag, "port", "p", "", portHelp)
+	updateCmd.Flags().IntVarP(&baudFlag, "baud", "b", protocol.DefaultBaudRate, "Baud rate")
+	addResetFlags(updateCmd)
+	updateCmd.Flags().BoolVar(&firmwareOnlyFlag, "firmware-only", false, "Flash firmware only (skip bootloader/partitions)")
+	updateCmd.Flags().StringVar(&recordFlag, "record", "", "Record all serial traffic to a trace file")
+	return updateCmd
+}
+
+func runUpdate(cmd *cobra.Command, args []string) error {
+	repo, ok := update.Repos[updateFirmwareFlag]
+	if !ok {
+		return usageError(fmt.Errorf("unknown firmware %q (use %s)", updateFirmwareFlag, strings.Join(firmwareNames(), " or ")))
+	}
+
+	cacheDir, err := update.DefaultCacheDir()
+	if err != nil {
+		return withType(errTypeIO, fmt.Errorf("failed to locate cache directory: %w", err))
+	}
+	client := update.NewClient(updateServerFlag, cacheDir)
+
+	fmt.Fprintf(console, "Checking for the latest %s release of %s...\n", updateChannelFlag, updateFirmwareFlag)
+	release, err := client.Latest(repo, updateChannelFlag)
+	if err != nil {
+		return withType(errTypeNetwork, fmt.Errorf("failed to fetch releases: %w", err))
+	}
+
+	asset, err := release.FirmwareAsset()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(console, "Release: %s (%s)\n", release.TagName, asset.Name)
+
+	checksum, err := client.Checksum(release, asset)
+	if err != nil {
+		return err
+	}
+
+	path, cached, err := client.Download(repo, release, asset, checksum)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", asset.Name, err)
+	}
+	if cached {
+		fmt.Fprintln(console, "Using cached download")
+	}
+	fmt.Fprintf(console, "SHA-256 verified: %s\n", checksum)
+
+	plan, err := loadRegions([]string{path})
+	if err != nil {
+		return err
+	}
+	report, err := flashPlanned(plan, path)
+	report.Release = &releaseInfo{
+		Firmware: updateFirmwareFlag,
+		Channel:  updateChannelFlag,
+		Tag:      release.TagName,
+		Asset:    asset.Name,
+		SHA256:   checksum,
+		Cached:   cached,
+	}
+	emitResult(report)
+	return err
+}
+
+// releaseInfo describes the release installed by the update command.
+type releaseInfo struct {
+	Firmware string `json:"firmware"`
+	Channel  string `json:"channel"`
+	Tag      string `json:"tag"`
+	Asset    string `json:"asset"`
+	SHA256   string `json:"sha256"`
+	Cached   bool   `json:"cached"`
+}
+
+func firmwareNames() []string {
+	names := make([]string, 0, len(update.Repos))
+	for name := range update.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
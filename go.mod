@@ -5,6 +5,7 @@ go 1.25.5
 require (
 	github.com/spf13/cobra v1.10.2
 	go.bug.st/serial v1.6.4
+	golang.org/x/term v0.28.0
 )
 
 require (
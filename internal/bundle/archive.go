@@ -0,0 +1,334 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/image"
+)
+
+// maxArchiveFile limits the size of a single file unpacked from an archive.
+const maxArchiveFile = 64 * 1024 * 1024
+
+// Bundle is a release archive or web installer manifest. It may contain
+// builds for several chip families.
+type Bundle struct {
+	Name    string
+	Layouts []*Layout
+}
+
+// IsBundle reports whether path names a file that Open understands.
+func IsBundle(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".json"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open loads a release bundle: a .zip or .tar.gz archive, or an ESP Web
+// Tools manifest.json. Archives are unpacked in memory and may contain a
+// manifest.json, an ESP-IDF flasher_args.json or PlatformIO build output.
+func Open(name string) (*Bundle, error) {
+	lower := strings.ToLower(name)
+	if strings.HasSuffix(lower, ".json") {
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return fromWebManifest(os.DirFS(filepath.Dir(name)), ".", raw)
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var files memFS
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		files, err = readZip(data)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		files, err = readTarGz(data)
+	default:
+		return nil, fmt.Errorf("unsupported bundle format: %s", filepath.Base(name))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack %s: %w", filepath.Base(name), err)
+	}
+
+	b, err := fromArchive(files)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(name), err)
+	}
+	if b.Name == "" {
+		b.Name = filepath.Base(name)
+	}
+	return b, nil
+}
+
+// ForChip returns the layout built for the given chip family, e.g.
+// "ESP32-C3". Layouts without a chip match any family.
+func (b *Bundle) ForChip(chip string) (*Layout, error) {
+	for _, l := range b.Layouts {
+		if l.Chip == "" || normalizeChip(l.Chip) == normalizeChip(chip) {
+			return l, nil
+		}
+	}
+
+	var chips []string
+	for _, l := range b.Layouts {
+		chips = append(chips, l.Chip)
+	}
+	return nil, fmt.Errorf("no build for %s (bundle has %s)", chip, strings.Join(chips, ", "))
+}
+
+// normalizeChip maps "ESP32-C3" and "esp32c3" to the same key.
+func normalizeChip(chip string) string {
+	return strings.ReplaceAll(strings.ToLower(chip), "-", "")
+}
+
+// fromArchive finds the flash layout inside an unpacked archive.
+func fromArchive(files memFS) (*Bundle, error) {
+	for _, marker := range []string{"manifest.json", "flasher_args.json", "firmware.bin"} {
+		dir, ok := files.find(marker)
+		if !ok {
+			continue
+		}
+		switch marker {
+		case "manifest.json":
+			raw, _ := fs.ReadFile(files, path.Join(dir, marker))
+			return fromWebManifest(files, dir, raw)
+		case "flasher_args.json":
+			layout, err := fromFlasherArgs(files, dir)
+			if err != nil {
+				return nil, err
+			}
+			return &Bundle{Layouts: []*Layout{layout}}, nil
+		default:
+			sub, err := fs.Sub(files, dir)
+			if err != nil {
+				return nil, err
+			}
+			layout, err := fromPlatformIO(sub)
+			if err != nil {
+				return nil, err
+			}
+			return &Bundle{Layouts: []*Layout{layout}}, nil
+		}
+	}
+	return nil, errors.New("archive contains no manifest.json, flasher_args.json or firmware.bin")
+}
+
+// webManifest is an ESP Web Tools manifest.
+type webManifest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Builds  []struct {
+		ChipFamily string `json:"chipFamily"`
+		Parts      []struct {
+			Path   string `json:"path"`
+			Offset uint32 `json:"offset"`
+		} `json:"parts"`
+	} `json:"builds"`
+}
+
+func fromWebManifest(fsys fs.FS, dir string, raw []byte) (*Bundle, error) {
+	var m webManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+	if len(m.Builds) == 0 {
+		return nil, errors.New("manifest.json lists no builds")
+	}
+
+	b := &Bundle{Name: strings.TrimSpace(m.Name + " " + m.Version)}
+	for _, build := range m.Builds {
+		layout := &Layout{Chip: build.ChipFamily, Source: "manifest.json"}
+		for _, part := range build.Parts {
+			if strings.Contains(part.Path, "://") {
+				return nil, fmt.Errorf("remote part %s is not supported", part.Path)
+			}
+			data, err := fs.ReadFile(fsys, path.Join(dir, part.Path))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", build.ChipFamily, err)
+			}
+			data, err = maybeGunzip(part.Path, data)
+			if err != nil {
+				return nil, err
+			}
+			name := strings.TrimSuffix(path.Base(part.Path), path.Ext(part.Path))
+			layout.Parts = append(layout.Parts, image.Part{Name: name, Offset: part.Offset, Data: data})
+		}
+		if err := layout.finish(); err != nil {
+			return nil, err
+		}
+		b.Layouts = append(b.Layouts, layout)
+	}
+	return b, nil
+}
+
+// ReadFile reads a firmware file, decompressing it if it ends in .gz.
+func ReadFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return maybeGunzip(name, data)
+}
+
+func maybeGunzip(name string, data []byte) ([]byte, error) {
+	if !strings.HasSuffix(strings.ToLower(name), ".gz") {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxArchiveFile+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(out) > maxArchiveFile {
+		return nil, fmt.Errorf("%s: decompressed size exceeds %d bytes", name, maxArchiveFile)
+	}
+	return out, nil
+}
+
+func readZip(data []byte) (memFS, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(memFS)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if f.UncompressedSize64 > maxArchiveFile {
+			return nil, fmt.Errorf("%s is too large", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		contents, err := io.ReadAll(io.LimitReader(rc, maxArchiveFile))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files.add(f.Name, contents)
+	}
+	return files, nil
+}
+
+func readTarGz(data []byte) (memFS, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make(memFS)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Size > maxArchiveFile {
+			return nil, fmt.Errorf("%s is too large", hdr.Name)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files.add(hdr.Name, contents)
+	}
+	return files, nil
+}
+
+// memFS is an in-memory file system holding the files of an archive.
+// Only regular files are stored; directories are implied by the paths.
+type memFS map[string][]byte
+
+func (m memFS) add(name string, data []byte) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if fs.ValidPath(name) {
+		m[name] = data
+	}
+}
+
+// find returns the directory of the shallowest file with the given base name.
+func (m memFS) find(base string) (string, bool) {
+	var dirs []string
+	for name := range m {
+		if path.Base(name) == base {
+			dirs = append(dirs, path.Dir(name))
+		}
+	}
+	if len(dirs) == 0 {
+		return "", false
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := strings.Count(dirs[i], "/"), strings.Count(dirs[j], "/")
+		if dirs[i] == "." {
+			di = -1
+		}
+		if dirs[j] == "." {
+			dj = -1
+		}
+		if di != dj {
+			return di < dj
+		}
+		return dirs[i] < dirs[j]
+	})
+	return dirs[0], true
+}
+
+// Open implements fs.FS.
+func (m memFS) Open(name string) (fs.File, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{name: path.Base(name), Reader: bytes.NewReader(data)}, nil
+}
+
+type memFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+
+// fs.FileInfo
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Mode() fs.FileMode  { return 0o444 }
+func (f *memFile) ModTime() time.Time { return time.Time{} }
+func (f *memFile) IsDir() bool        { return false }
+func (f *memFile) Sys() any           { return nil }
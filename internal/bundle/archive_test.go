@@ -0,0 +1,226 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+)
+
+const webManifestJSON = `{
+  "name": "Papyrix",
+  "version": "1.2.0",
+  "builds": [
+    {
+      "chipFamily": "ESP32",
+      "parts": [{ "path": "esp32/firmware.bin", "offset": 65536 }]
+    },
+    {
+      "chipFamily": "ESP32-C3",
+      "parts": [
+        { "path": "bootloader.bin", "offset": 0 },
+        { "path": "partitions.bin", "offset": 32768 },
+        { "path": "firmware.bin.gz", "offset": 65536 }
+      ]
+    }
+  ]
+}`
+
+var testFirmware = []byte{0xE9, 0x01, 0x02, 0x20, 0xAA, 0xBB}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeZip(t *testing.T, name string, files map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for n, data := range files {
+		w, err := zw.Create(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, name string, files map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for n, data := range files {
+		tw.WriteHeader(&tar.Header{Name: n, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+	zw.Close()
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpen_ZipWithWebManifest(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "papyrix-1.2.0.zip")
+	writeZip(t, name, map[string][]byte{
+		"release/manifest.json":      []byte(webManifestJSON),
+		"release/bootloader.bin":     embedded.Bootloader(),
+		"release/partitions.bin":     embedded.Partitions(),
+		"release/firmware.bin.gz":    gzipBytes(t, testFirmware),
+		"release/esp32/firmware.bin": {0xE9, 0xFF},
+	})
+
+	b, err := Open(name)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if b.Name != "Papyrix 1.2.0" || len(b.Layouts) != 2 {
+		t.Fatalf("Open() = %q with %d layouts", b.Name, len(b.Layouts))
+	}
+
+	layout, err := b.ForChip("ESP32-C3")
+	if err != nil {
+		t.Fatalf("ForChip() error = %v", err)
+	}
+	if len(layout.Parts) != 3 {
+		t.Fatalf("ESP32-C3 build has %d parts, want 3", len(layout.Parts))
+	}
+	fw := layout.Part(0x10000)
+	if fw == nil || !bytes.Equal(fw.Data, testFirmware) {
+		t.Errorf("firmware part = %+v, want decompressed firmware", fw)
+	}
+
+	if layout, _ := b.ForChip("esp32"); layout == nil || len(layout.Parts) != 1 {
+		t.Error("ForChip(esp32) did not pick the ESP32 build")
+	}
+	if _, err := b.ForChip("ESP32-S3"); err == nil {
+		t.Error("ForChip(ESP32-S3) expected error")
+	}
+}
+
+func TestOpen_TarGzWithFlasherArgs(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "build.tar.gz")
+	writeTarGz(t, name, map[string][]byte{
+		"build/flasher_args.json":                   []byte(flasherArgsJSON),
+		"build/bootloader/bootloader.bin":           embedded.Bootloader(),
+		"build/partition_table/partition-table.bin": embedded.Partitions(),
+		"build/papyrix.bin":                         testFirmware,
+		"build/ota_data_initial.bin":                {0xFF},
+	})
+
+	b, err := Open(name)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	layout, err := b.ForChip("ESP32-C3")
+	if err != nil {
+		t.Fatalf("ForChip() error = %v", err)
+	}
+	if len(layout.Parts) != 4 || layout.Settings.Size != "4MB" {
+		t.Errorf("layout = %d parts, settings %+v", len(layout.Parts), layout.Settings)
+	}
+}
+
+func TestOpen_ZipWithPlatformIOOutput(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "release.zip")
+	writeZip(t, name, map[string][]byte{
+		"firmware.bin": testFirmware,
+	})
+
+	b, err := Open(name)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if len(b.Layouts) != 1 || len(b.Layouts[0].Parts) != 1 {
+		t.Fatalf("Open() = %+v", b.Layouts)
+	}
+}
+
+func TestOpen_ManifestFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"manifest.json":      []byte(webManifestJSON),
+		"bootloader.bin":     embedded.Bootloader(),
+		"partitions.bin":     embedded.Partitions(),
+		"firmware.bin.gz":    gzipBytes(t, testFirmware),
+		"esp32/firmware.bin": {0xE9},
+	}
+	for n, data := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, n)), 0o755)
+		if err := os.WriteFile(filepath.Join(dir, n), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := Open(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if len(b.Layouts) != 2 {
+		t.Errorf("Open() returned %d layouts, want 2", len(b.Layouts))
+	}
+}
+
+func TestOpen_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	empty := filepath.Join(dir, "empty.zip")
+	writeZip(t, empty, map[string][]byte{"README.md": []byte("hi")})
+	if _, err := Open(empty); err == nil {
+		t.Error("Open() of archive without firmware expected error")
+	}
+
+	remote := filepath.Join(dir, "manifest.json")
+	os.WriteFile(remote, []byte(`{"builds":[{"chipFamily":"ESP32-C3","parts":[{"path":"https://example.com/fw.bin","offset":0}]}]}`), 0o644)
+	if _, err := Open(remote); err == nil {
+		t.Error("Open() of manifest with remote parts expected error")
+	}
+}
+
+func TestReadFile_Gzip(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "firmware.bin.gz")
+	os.WriteFile(name, gzipBytes(t, testFirmware), 0o644)
+
+	data, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(data, testFirmware) {
+		t.Errorf("ReadFile() = % X, want % X", data, testFirmware)
+	}
+}
+
+func TestIsBundle(t *testing.T) {
+	for name, want := range map[string]bool{
+		"release.zip":     true,
+		"release.TAR.GZ":  true,
+		"release.tgz":     true,
+		"manifest.json":   true,
+		"firmware.bin":    false,
+		"firmware.bin.gz": false,
+	} {
+		if got := IsBundle(name); got != want {
+			t.Errorf("IsBundle(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package bundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bigbag/papyrix-flasher/internal/image"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// Layout is a set of images to flash together with the flash settings
+// they were built for.
+type Layout struct {
+	Parts    []image.Part
+	Settings image.FlashSettings
+	Chip     string
+	Source   string
+}
+
+// FlashSize returns the flash size in bytes, or 0 if the layout does not
+// specify one. Like "keep", esptool's "detect" leaves the size to the
+// device.
+func (l *Layout) FlashSize() (uint32, error) {
+	switch l.Settings.Size {
+	case "", "keep", "detect":
+		return 0, nil
+	}
+	return image.FlashSizeBytes(l.Settings.Size)
+}
+
+// FromBuildDir loads the flash layout from an ESP-IDF build directory
+// (flasher_args.json), a PlatformIO project or a PlatformIO environment
+// build directory (.pio/build/<env>).
+func FromBuildDir(dir string) (*Layout, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	// A PlatformIO project root: pick the environment build directory
+	pioBuild := filepath.Join(dir, ".pio", "build")
+	if _, err := os.Stat(pioBuild); err == nil {
+		env, err := pioEnvironment(pioBuild)
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(pioBuild, env)
+	}
+
+	layout, err := FromFS(os.DirFS(dir))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	return layout, nil
+}
+
+// FromFS loads a flash layout from a file system containing either an
+// ESP-IDF flasher_args.json or PlatformIO build output.
+func FromFS(fsys fs.FS) (*Layout, error) {
+	if _, err := fs.Stat(fsys, "flasher_args.json"); err == nil {
+		return fromFlasherArgs(fsys, ".")
+	}
+	if _, err := fs.Stat(fsys, "firmware.bin"); err == nil {
+		return fromPlatformIO(fsys)
+	}
+	return nil, errors.New("no flasher_args.json or firmware.bin found")
+}
+
+// pioEnvironment returns the single environment built in .pio/build.
+func pioEnvironment(buildDir string) (string, error) {
+	entries, err := os.ReadDir(buildDir)
+	if err != nil {
+		return "", err
+	}
+
+	var envs []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(buildDir, e.Name(), "firmware.bin")); err == nil {
+			envs = append(envs, e.Name())
+		}
+	}
+
+	switch len(envs) {
+	case 0:
+		return "", fmt.Errorf("no built PlatformIO environments in %s", buildDir)
+	case 1:
+		return envs[0], nil
+	default:
+		return "", fmt.Errorf("multiple PlatformIO environments in %s (%s); pass .pio/build/<env> instead",
+			buildDir, strings.Join(envs, ", "))
+	}
+}
+
+// flasherArgs is the subset of ESP-IDF's flasher_args.json we use.
+type flasherArgs struct {
+	FlashSettings struct {
+		FlashMode string `json:"flash_mode"`
+		FlashSize string `json:"flash_size"`
+		FlashFreq string `json:"flash_freq"`
+	} `json:"flash_settings"`
+	FlashFiles       map[string]string `json:"flash_files"`
+	ExtraEsptoolArgs struct {
+		Chip string `json:"chip"`
+	} `json:"extra_esptool_args"`
+	Bootloader     *flasherArgsFile `json:"bootloader"`
+	App            *flasherArgsFile `json:"app"`
+	PartitionTable *flasherArgsFile `json:"partition-table"`
+}
+
+type flasherArgsFile struct {
+	Offset string `json:"offset"`
+	File   string `json:"file"`
+}
+
+func fromFlasherArgs(fsys fs.FS, dir string) (*Layout, error) {
+	raw, err := fs.ReadFile(fsys, path.Join(dir, "flasher_args.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var args flasherArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("invalid flasher_args.json: %w", err)
+	}
+	if len(args.FlashFiles) == 0 {
+		return nil, errors.New("flasher_args.json lists no flash files")
+	}
+
+	names := make(map[string]string)
+	for name, f := range map[string]*flasherArgsFile{
+		"bootloader": args.Bootloader,
+		"partitions": args.PartitionTable,
+		"firmware":   args.App,
+	} {
+		if f != nil {
+			names[f.File] = name
+		}
+	}
+
+	layout := &Layout{
+		Settings: image.FlashSettings{
+			Mode: args.FlashSettings.FlashMode,
+			Freq: args.FlashSettings.FlashFreq,
+			Size: args.FlashSettings.FlashSize,
+		},
+		Chip:   args.ExtraEsptoolArgs.Chip,
+		Source: "flasher_args.json",
+	}
+
+	for offsetStr, file := range args.FlashFiles {
+		offset, err := strconv.ParseUint(offsetStr, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q in flasher_args.json", offsetStr)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		name, ok := names[file]
+		if !ok {
+			name = strings.TrimSuffix(path.Base(file), path.Ext(file))
+		}
+		layout.Parts = append(layout.Parts, image.Part{Name: name, Offset: uint32(offset), Data: data})
+	}
+
+	if err := layout.finish(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// fromPlatformIO loads a PlatformIO environment build directory. Offsets
+// are the standard ESP32-C3 ones; flash settings come from the bootloader
+// header written by the build.
+func fromPlatformIO(fsys fs.FS) (*Layout, error) {
+	layout := &Layout{Source: "PlatformIO"}
+
+	files := []struct {
+		name     string
+		file     string
+		offset   uint32
+		required bool
+	}{
+		{"bootloader", "bootloader.bin", protocol.BootloaderAddress, false},
+		{"partitions", "partitions.bin", protocol.PartitionsAddress, false},
+		{"firmware", "firmware.bin", protocol.FirmwareAddress, true},
+	}
+	for _, f := range files {
+		data, err := fs.ReadFile(fsys, f.file)
+		if errors.Is(err, fs.ErrNotExist) && !f.required {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		layout.Parts = append(layout.Parts, image.Part{Name: f.name, Offset: f.offset, Data: data})
+	}
+
+	if bootloader := layout.Part(protocol.BootloaderAddress); bootloader != nil {
+		settings, err := image.ReadFlashSettings(bootloader.Data)
+		if err != nil {
+			return nil, fmt.Errorf("bootloader.bin: %w", err)
+		}
+		layout.Settings = settings
+	}
+
+	if err := layout.finish(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// Part returns the part placed at offset, or nil.
+func (l *Layout) Part(offset uint32) *image.Part {
+	for i := range l.Parts {
+		if l.Parts[i].Offset == offset {
+			return &l.Parts[i]
+		}
+	}
+	return nil
+}
+
+// finish sorts the parts and applies the flash settings to the bootloader
+// header, the same way esptool does when writing it.
+func (l *Layout) finish() error {
+	sort.Slice(l.Parts, func(i, j int) bool { return l.Parts[i].Offset < l.Parts[j].Offset })
+
+	if bootloader := l.Part(protocol.BootloaderAddress); bootloader != nil && len(bootloader.Data) > 0 && bootloader.Data[0] == image.Magic {
+		data, err := image.ApplyFlashSettings(bootloader.Data, l.Settings)
+		if err != nil {
+			return fmt.Errorf("bootloader: %w", err)
+		}
+		bootloader.Data = data
+	}
+	return nil
+}
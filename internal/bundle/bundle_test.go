@@ -0,0 +1,172 @@
+package bundle
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+	"github.com/bigbag/papyrix-flasher/internal/image"
+)
+
+const flasherArgsJSON = `{
+    "write_flash_args" : [ "--flash_mode", "qio", "--flash_size", "4MB", "--flash_freq", "40m" ],
+    "flash_settings" : { "flash_mode": "qio", "flash_size": "4MB", "flash_freq": "40m" },
+    "flash_files" : {
+        "0x0" : "bootloader/bootloader.bin",
+        "0x20000" : "papyrix.bin",
+        "0x8000" : "partition_table/partition-table.bin",
+        "0xd000" : "ota_data_initial.bin"
+    },
+    "bootloader" : { "offset" : "0x0", "file" : "bootloader/bootloader.bin", "encrypted" : "false" },
+    "app" : { "offset" : "0x20000", "file" : "papyrix.bin", "encrypted" : "false" },
+    "partition-table" : { "offset" : "0x8000", "file" : "partition_table/partition-table.bin", "encrypted" : "false" },
+    "extra_esptool_args" : { "after" : "hard_reset", "before" : "default_reset", "stub" : true, "chip" : "esp32c3" }
+}`
+
+func TestFromFS_FlasherArgs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"flasher_args.json":                   {Data: []byte(flasherArgsJSON)},
+		"bootloader/bootloader.bin":           {Data: embedded.Bootloader()},
+		"partition_table/partition-table.bin": {Data: embedded.Partitions()},
+		"papyrix.bin":                         {Data: []byte{0xE9, 1, 2, 3}},
+		"ota_data_initial.bin":                {Data: []byte{0xFF, 0xFF}},
+	}
+
+	layout, err := FromFS(fsys)
+	if err != nil {
+		t.Fatalf("FromFS() error = %v", err)
+	}
+
+	if layout.Chip != "esp32c3" {
+		t.Errorf("Chip = %q, want esp32c3", layout.Chip)
+	}
+	if layout.Settings != (image.FlashSettings{Mode: "qio", Freq: "40m", Size: "4MB"}) {
+		t.Errorf("Settings = %+v", layout.Settings)
+	}
+	if size, _ := layout.FlashSize(); size != 4*1024*1024 {
+		t.Errorf("FlashSize() = %d, want 4MB", size)
+	}
+
+	expected := []struct {
+		name   string
+		offset uint32
+	}{
+		{"bootloader", 0x0},
+		{"partitions", 0x8000},
+		{"ota_data_initial", 0xD000},
+		{"firmware", 0x20000},
+	}
+	if len(layout.Parts) != len(expected) {
+		t.Fatalf("got %d parts, want %d", len(layout.Parts), len(expected))
+	}
+	for i, e := range expected {
+		if layout.Parts[i].Name != e.name || layout.Parts[i].Offset != e.offset {
+			t.Errorf("part %d = %s@0x%X, want %s@0x%X", i, layout.Parts[i].Name, layout.Parts[i].Offset, e.name, e.offset)
+		}
+	}
+
+	// The bootloader header must be patched with the requested settings.
+	settings, err := image.ReadFlashSettings(layout.Parts[0].Data)
+	if err != nil {
+		t.Fatalf("ReadFlashSettings() error = %v", err)
+	}
+	if settings != layout.Settings {
+		t.Errorf("bootloader header settings = %+v, want %+v", settings, layout.Settings)
+	}
+}
+
+func TestFromFS_FlasherArgsDetectSize(t *testing.T) {
+	// esptool writes "detect" when the build leaves the size to the device
+	fsys := fstest.MapFS{
+		"flasher_args.json": {Data: []byte(`{
+    "flash_settings" : { "flash_mode": "dio", "flash_size": "detect", "flash_freq": "80m" },
+    "flash_files" : { "0x0" : "bootloader/bootloader.bin", "0x10000" : "papyrix.bin" },
+    "extra_esptool_args" : { "chip" : "esp32c3" }
+}`)},
+		"bootloader/bootloader.bin": {Data: embedded.Bootloader()},
+		"papyrix.bin":               {Data: []byte{0xE9, 1, 2, 3}},
+	}
+
+	layout, err := FromFS(fsys)
+	if err != nil {
+		t.Fatalf("FromFS() error = %v", err)
+	}
+	if size, err := layout.FlashSize(); size != 0 || err != nil {
+		t.Errorf("FlashSize() = %d, %v; want 0 (keep)", size, err)
+	}
+
+	// The bootloader keeps its size and takes the other settings
+	want, _ := image.ReadFlashSettings(embedded.Bootloader())
+	want.Mode, want.Freq = "dio", "80m"
+	got, err := image.ReadFlashSettings(layout.Part(0).Data)
+	if err != nil {
+		t.Fatalf("ReadFlashSettings() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("bootloader settings = %+v, want %+v", got, want)
+	}
+}
+
+func TestFromFS_PlatformIO(t *testing.T) {
+	firmware := []byte{0xE9, 0x03, 0x02, 0x4F}
+	fsys := fstest.MapFS{
+		"bootloader.bin": {Data: embedded.Bootloader()},
+		"partitions.bin": {Data: embedded.Partitions()},
+		"firmware.bin":   {Data: firmware},
+		"firmware.elf":   {Data: []byte("ignored")},
+	}
+
+	layout, err := FromFS(fsys)
+	if err != nil {
+		t.Fatalf("FromFS() error = %v", err)
+	}
+
+	if len(layout.Parts) != 3 {
+		t.Fatalf("got %d parts, want 3", len(layout.Parts))
+	}
+	if p := layout.Part(0x10000); p == nil || !bytes.Equal(p.Data, firmware) {
+		t.Errorf("firmware part = %+v", p)
+	}
+	if !bytes.Equal(layout.Part(0x0).Data, embedded.Bootloader()) {
+		t.Error("bootloader must be unchanged when applying its own settings")
+	}
+	if layout.Settings != (image.FlashSettings{Mode: "dio", Freq: "80m", Size: "16MB"}) {
+		t.Errorf("Settings = %+v", layout.Settings)
+	}
+}
+
+func TestFromFS_Empty(t *testing.T) {
+	if _, err := FromFS(fstest.MapFS{}); err == nil {
+		t.Error("FromFS() of empty directory expected error")
+	}
+}
+
+func TestFromBuildDir_PlatformIOProject(t *testing.T) {
+	root := t.TempDir()
+	envDir := filepath.Join(root, ".pio", "build", "default")
+	if err := os.MkdirAll(envDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(envDir, "firmware.bin"), []byte{0xE9}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	layout, err := FromBuildDir(root)
+	if err != nil {
+		t.Fatalf("FromBuildDir() error = %v", err)
+	}
+	if len(layout.Parts) != 1 || layout.Parts[0].Name != "firmware" {
+		t.Errorf("Parts = %+v", layout.Parts)
+	}
+
+	// A second built environment makes the choice ambiguous.
+	other := filepath.Join(root, ".pio", "build", "debug")
+	os.MkdirAll(other, 0o755)
+	os.WriteFile(filepath.Join(other, "firmware.bin"), []byte{0xE9}, 0o644)
+	if _, err := FromBuildDir(root); err == nil {
+		t.Error("FromBuildDir() with two environments expected error")
+	}
+}
@@ -0,0 +1,300 @@
+// Package coredump decodes the core dumps ESP-IDF saves to the coredump
+// partition when the firmware crashes.
+//
+// A dump is a header, an ELF core file and a checksum. The ELF core holds
+// a note with the registers of each task, a note naming the crashed task
+// with the exception registers, and the memory of each task's control
+// block and stack. Only the ELF format, the default since ESP-IDF 4.1, is
+// supported, for the RISC-V chips.
+package coredump
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Dump format versions, in the low 16 bits of the header version. The
+// high 16 bits hold the chip ID.
+const (
+	versionBinLegacy    = 0x0001
+	versionBin          = 0x0002
+	versionELFCRC32     = 0x0100
+	versionELFSHA256    = 0x0101
+	versionELFCRC32V22  = 0x0102 // adds the chip revision to the header
+	versionELFSHA256V22 = 0x0103
+)
+
+// HeaderSize is the size of the largest dump header. Reading that much of
+// the partition is enough for Length.
+const HeaderSize = 24
+
+// Notes in the ELF core
+const (
+	noteCore      = "CORE"
+	noteInfo      = "ESP_CORE_DUMP_INFO"
+	noteExtraInfo = "EXTRA_INFO"
+
+	notePRStatus  = 1
+	noteInfoType  = 8266
+	noteExtraType = 677
+)
+
+// Layout of a RISC-V NT_PRSTATUS note. ESP-IDF stores the task's TCB
+// address in pr_pid.
+const (
+	prstatusPID  = 24
+	prstatusRegs = 72
+)
+
+// FreeRTOS task control block
+const (
+	tcbNameOffset = 52
+	taskNameLen   = 16
+)
+
+// ErrEmpty is returned for a partition that holds no core dump, e.g. when
+// the device has not crashed since it was flashed.
+var ErrEmpty = errors.New("no core dump")
+
+// Task is a task of the firmware at the time of the crash.
+type Task struct {
+	TCB     uint32
+	Name    string // empty if the TCB was not dumped
+	Regs    [32]uint32
+	Crashed bool
+}
+
+// PC returns the address the task was executing.
+func (t Task) PC() uint32 {
+	return t.Regs[0]
+}
+
+// Register is a named register value.
+type Register struct {
+	Name  string
+	Value uint32
+}
+
+// Dump is a decoded core dump.
+type Dump struct {
+	ChipID    uint32
+	ChipRev   uint32 // zero before format 2.2
+	Checksum  string // "CRC32" or "SHA256"
+	AppSHA256 string // SHA256 of the firmware ELF file, in hex
+	// Tasks holds the tasks, the crashed one first.
+	Tasks []Task
+	// Exception holds the exception registers, e.g. MCAUSE and MTVAL.
+	Exception []Register
+	// Core is the ELF core file, which GDB loads with the firmware ELF.
+	Core []byte
+
+	memory []segment
+}
+
+type segment struct {
+	addr uint32
+	data []byte
+}
+
+// Length returns the size of the dump at the start of a partition, from
+// the first HeaderSize bytes. It returns ErrEmpty for an erased partition.
+func Length(header []byte) (uint32, error) {
+	if len(header) < 8 {
+		return 0, fmt.Errorf("core dump header is %d bytes, want %d", len(header), HeaderSize)
+	}
+	length := binary.LittleEndian.Uint32(header)
+	if length == 0 || length == 0xFFFFFFFF {
+		return 0, ErrEmpty
+	}
+	return length, nil
+}
+
+// Parse decodes the dump at the start of data, verifying its checksum.
+func Parse(data []byte) (*Dump, error) {
+	length, err := Length(data)
+	if err != nil {
+		return nil, err
+	}
+	if int64(length) > int64(len(data)) {
+		return nil, fmt.Errorf("core dump is %d bytes, only %d available", length, len(data))
+	}
+	data = data[:length]
+
+	version := binary.LittleEndian.Uint32(data[4:])
+	d := &Dump{ChipID: version >> 16}
+	headerSize, sumSize := 20, crc32.Size
+	switch version & 0xFFFF {
+	case versionELFCRC32:
+		d.Checksum = "CRC32"
+	case versionELFSHA256:
+		d.Checksum, sumSize = "SHA256", sha256.Size
+	case versionELFCRC32V22:
+		d.Checksum, headerSize = "CRC32", 24
+	case versionELFSHA256V22:
+		d.Checksum, headerSize, sumSize = "SHA256", 24, sha256.Size
+	case versionBinLegacy, versionBin:
+		return nil, fmt.Errorf("core dump is in the binary format; build the firmware with the ELF core dump format")
+	default:
+		return nil, fmt.Errorf("unknown core dump version 0x%X", version)
+	}
+	if len(data) < headerSize+sumSize {
+		return nil, fmt.Errorf("core dump is too short: %d bytes", len(data))
+	}
+
+	body, sum := data[:len(data)-sumSize], data[len(data)-sumSize:]
+	var want []byte
+	if sumSize == crc32.Size {
+		want = binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(body))
+	} else {
+		digest := sha256.Sum256(body)
+		want = digest[:]
+	}
+	if !bytes.Equal(sum, want) {
+		return nil, fmt.Errorf("core dump %s mismatch: got %x, want %x", d.Checksum, sum, want)
+	}
+
+	if headerSize == 24 {
+		d.ChipRev = binary.LittleEndian.Uint32(data[20:])
+	}
+	d.Core = bytes.Clone(body[headerSize:])
+	if err := d.parseCore(); err != nil {
+		return nil, fmt.Errorf("invalid ELF core: %w", err)
+	}
+	return d, nil
+}
+
+func (d *Dump) parseCore() error {
+	f, err := elf.NewFile(bytes.NewReader(d.Core))
+	if err != nil {
+		return err
+	}
+	if f.Type != elf.ET_CORE {
+		return fmt.Errorf("file type is %v, want %v", f.Type, elf.ET_CORE)
+	}
+	if f.Machine != elf.EM_RISCV {
+		return fmt.Errorf("dump is for %v; only RISC-V chips are supported", f.Machine)
+	}
+
+	var notes []note
+	for _, p := range f.Progs {
+		data, err := io.ReadAll(p.Open())
+		if err != nil {
+			return err
+		}
+		switch p.Type {
+		case elf.PT_LOAD:
+			d.memory = append(d.memory, segment{uint32(p.Vaddr), data})
+		case elf.PT_NOTE:
+			n, err := parseNotes(data)
+			if err != nil {
+				return err
+			}
+			notes = append(notes, n...)
+		}
+	}
+
+	crashed, found := uint32(0), false
+	for _, n := range notes {
+		switch {
+		case n.name == noteCore && n.typ == notePRStatus:
+			if len(n.desc) < prstatusRegs+4*32 {
+				return fmt.Errorf("task status note is %d bytes", len(n.desc))
+			}
+			t := Task{TCB: binary.LittleEndian.Uint32(n.desc[prstatusPID:])}
+			for i := range t.Regs {
+				t.Regs[i] = binary.LittleEndian.Uint32(n.desc[prstatusRegs+4*i:])
+			}
+			d.Tasks = append(d.Tasks, t)
+
+		case n.name == noteInfo && n.typ == noteInfoType && len(n.desc) > 4:
+			sha, _, _ := bytes.Cut(n.desc[4:], []byte{0})
+			d.AppSHA256 = string(sha)
+
+		case n.name == noteExtraInfo && n.typ == noteExtraType && len(n.desc) >= 4:
+			crashed, found = binary.LittleEndian.Uint32(n.desc), true
+			for off := 4; off+8 <= len(n.desc); off += 8 {
+				d.Exception = append(d.Exception, Register{
+					Name:  csrName(binary.LittleEndian.Uint32(n.desc[off:])),
+					Value: binary.LittleEndian.Uint32(n.desc[off+4:]),
+				})
+			}
+		}
+	}
+	if len(d.Tasks) == 0 {
+		return fmt.Errorf("no tasks")
+	}
+
+	// ESP-IDF dumps the crashed task first, and names it in EXTRA_INFO
+	if found {
+		for i := range d.Tasks {
+			if d.Tasks[i].TCB == crashed {
+				d.Tasks[0], d.Tasks[i] = d.Tasks[i], d.Tasks[0]
+				break
+			}
+		}
+	}
+	d.Tasks[0].Crashed = true
+	for i := range d.Tasks {
+		d.Tasks[i].Name = d.taskName(d.Tasks[i].TCB)
+	}
+	return nil
+}
+
+type note struct {
+	name string
+	typ  uint32
+	desc []byte
+}
+
+func parseNotes(data []byte) ([]note, error) {
+	align := func(n int) int { return (n + 3) &^ 3 }
+	var notes []note
+	for len(data) >= 12 {
+		nameSize := int(binary.LittleEndian.Uint32(data))
+		descSize := int(binary.LittleEndian.Uint32(data[4:]))
+		typ := binary.LittleEndian.Uint32(data[8:])
+		data = data[12:]
+		if nameSize < 0 || descSize < 0 || align(nameSize)+descSize > len(data) {
+			return nil, fmt.Errorf("truncated note")
+		}
+		name := strings.TrimRight(string(data[:nameSize]), "\x00")
+		desc := data[align(nameSize) : align(nameSize)+descSize]
+		notes = append(notes, note{name, typ, desc})
+		data = data[min(align(nameSize)+align(descSize), len(data)):]
+	}
+	return notes, nil
+}
+
+// Read returns n bytes of the dumped memory at addr, or false if the dump
+// does not hold them.
+func (d *Dump) Read(addr uint32, n int) ([]byte, bool) {
+	for _, s := range d.memory {
+		if addr >= s.addr && uint64(addr-s.addr)+uint64(n) <= uint64(len(s.data)) {
+			off := addr - s.addr
+			return s.data[off : off+uint32(n)], true
+		}
+	}
+	return nil, false
+}
+
+// taskName reads the name of a task from its control block.
+func (d *Dump) taskName(tcb uint32) string {
+	raw, ok := d.Read(tcb+tcbNameOffset, taskNameLen)
+	if !ok {
+		return ""
+	}
+	name, _, _ := bytes.Cut(raw, []byte{0})
+	for _, c := range name {
+		if c < 0x20 || c > 0x7E {
+			return ""
+		}
+	}
+	return string(name)
+}
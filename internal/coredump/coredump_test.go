@@ -0,0 +1,238 @@
+package coredump
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	crashedTCB = 0x3FC90000
+	idleTCB    = 0x3FC90400
+	stackTop   = 0x3FC91000
+	codeBase   = 0x42000000
+)
+
+// testCode is firmware code at codeBase: a JAL RA, a NOP and a C.JALR A5,
+// so 0x42000004 and 0x4200000A are return addresses.
+var testCode = fakeCode{0xEF, 0x00, 0x00, 0x00, 0x13, 0x00, 0x00, 0x00, 0x82, 0x97, 0x01, 0x00}
+
+type fakeCode []byte
+
+func (c fakeCode) Code(addr uint64, n int) ([]byte, bool) {
+	if addr < codeBase || addr+uint64(n) > codeBase+uint64(len(c)) {
+		return nil, false
+	}
+	return c[addr-codeBase : addr-codeBase+uint64(n)], true
+}
+
+func appendNote(buf []byte, name string, typ uint32, desc []byte) []byte {
+	pad := func(b []byte) []byte { return append(b, make([]byte, -len(b)&3)...) }
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(name)+1))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(desc)))
+	buf = binary.LittleEndian.AppendUint32(buf, typ)
+	buf = pad(append(buf, name+"\x00"...))
+	return pad(append(buf, desc...))
+}
+
+func prstatus(tcb uint32, regs [32]uint32) []byte {
+	desc := make([]byte, prstatusRegs+4*32+4)
+	binary.LittleEndian.PutUint32(desc[prstatusPID:], tcb)
+	for i, r := range regs {
+		binary.LittleEndian.PutUint32(desc[prstatusRegs+4*i:], r)
+	}
+	return desc
+}
+
+// buildCore returns an ELF core with the given notes and memory segments,
+// as ESP-IDF writes it.
+func buildCore(notes []byte, memory []segment) []byte {
+	type prog struct {
+		typ  elf.ProgType
+		addr uint32
+		data []byte
+	}
+	progs := []prog{{typ: elf.PT_NOTE, data: notes}}
+	for _, s := range memory {
+		progs = append(progs, prog{elf.PT_LOAD, s.addr, s.data})
+	}
+
+	var buf bytes.Buffer
+	header := elf.Header32{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     uint16(len(progs)),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&buf, binary.LittleEndian, header)
+
+	off := uint32(52 + 32*len(progs))
+	for _, p := range progs {
+		binary.Write(&buf, binary.LittleEndian, elf.Prog32{
+			Type: uint32(p.typ), Off: off, Vaddr: p.addr, Paddr: p.addr,
+			Filesz: uint32(len(p.data)), Memsz: uint32(len(p.data)), Align: 4,
+		})
+		off += uint32(len(p.data))
+	}
+	for _, p := range progs {
+		buf.Write(p.data)
+	}
+	return buf.Bytes()
+}
+
+// wrap adds the dump header and checksum for version to an ELF core.
+func wrap(version uint32, core []byte) []byte {
+	headerSize, sumSize := 24, 4
+	if version&0xFFFF == versionELFSHA256 || version&0xFFFF == versionELFCRC32 {
+		headerSize = 20
+	}
+	if version&0xFFFF == versionELFSHA256 || version&0xFFFF == versionELFSHA256V22 {
+		sumSize = 32
+	}
+	var data []byte
+	for _, w := range []uint32{uint32(headerSize + len(core) + sumSize), version, 2, 0x150, 4, 3} {
+		data = binary.LittleEndian.AppendUint32(data, w)
+	}
+	data = append(data[:headerSize], core...)
+	if sumSize == 4 {
+		return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	}
+	sum := sha256.Sum256(data)
+	return append(data, sum[:]...)
+}
+
+// testCore returns the ELF core of a crash in the task "main" while the
+// task "IDLE" runs: main's stack holds a return address, a word that
+// follows no call, and data.
+func testCore() []byte {
+	var crashed, idle [32]uint32
+	crashed[0], crashed[1], crashed[2] = 0x42000008, 0x42000004, stackTop-16
+	idle[0], idle[2] = 0x4200000A, stackTop-16
+
+	extra := binary.LittleEndian.AppendUint32(nil, crashedTCB)
+	for _, w := range []uint32{0x342, 5, 0x343, 0x1234} { // MCAUSE, MTVAL
+		extra = binary.LittleEndian.AppendUint32(extra, w)
+	}
+	info := append(binary.LittleEndian.AppendUint32(nil, 0x00050102), "a1b2c3d4e5f60718\x00"...)
+
+	var notes []byte
+	notes = appendNote(notes, noteCore, notePRStatus, prstatus(idleTCB, idle))
+	notes = appendNote(notes, noteCore, notePRStatus, prstatus(crashedTCB, crashed))
+	notes = appendNote(notes, noteInfo, noteInfoType, info)
+	notes = appendNote(notes, noteExtraInfo, noteExtraType, extra)
+
+	tcb := make([]byte, 0x60)
+	copy(tcb[tcbNameOffset:], "main\x00")
+	idleTCBData := make([]byte, 0x60)
+	copy(idleTCBData[tcbNameOffset:], "IDLE\x00")
+	var stack []byte
+	for _, w := range []uint32{0x42000004, 0x42000008, 0x3FC80000, 0x4200000A} {
+		stack = binary.LittleEndian.AppendUint32(stack, w)
+	}
+	return buildCore(notes, []segment{
+		{crashedTCB, tcb},
+		{idleTCB, idleTCBData},
+		{stackTop - 16, stack},
+	})
+}
+
+func TestParse(t *testing.T) {
+	for _, version := range []uint32{0x00050102, 0x00050103, 0x00050100} {
+		data := wrap(version, testCore())
+		// The partition continues after the dump
+		data = append(data, bytes.Repeat([]byte{0xFF}, 64)...)
+
+		d, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Parse(version 0x%X) error: %v", version, err)
+		}
+		if d.ChipID != 5 {
+			t.Errorf("ChipID = %d, want 5", d.ChipID)
+		}
+		if !bytes.Equal(d.Core, testCore()) {
+			t.Error("Core differs from the ELF core in the dump")
+		}
+	}
+
+	d, err := Parse(wrap(0x00050102, testCore()))
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if d.ChipRev != 3 || d.Checksum != "CRC32" || d.AppSHA256 != "a1b2c3d4e5f60718" {
+		t.Errorf("ChipRev, Checksum, AppSHA256 = %d, %q, %q", d.ChipRev, d.Checksum, d.AppSHA256)
+	}
+	if len(d.Tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(d.Tasks))
+	}
+	main, idle := d.Tasks[0], d.Tasks[1]
+	if main.Name != "main" || !main.Crashed || main.PC() != 0x42000008 || main.Regs[2] != stackTop-16 {
+		t.Errorf("crashed task = %+v", main)
+	}
+	if idle.Name != "IDLE" || idle.Crashed || idle.TCB != idleTCB {
+		t.Errorf("other task = %+v", idle)
+	}
+	want := []Register{{"MCAUSE", 5}, {"MTVAL", 0x1234}}
+	if !slices.Equal(d.Exception, want) {
+		t.Errorf("Exception = %v, want %v", d.Exception, want)
+	}
+	if d.Cause() != "Load access fault" {
+		t.Errorf("Cause() = %q", d.Cause())
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	good := wrap(0x00050102, testCore())
+	corrupt := bytes.Clone(good)
+	corrupt[100] ^= 1
+	binFormat := wrap(0x00050002, testCore())
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"erased", bytes.Repeat([]byte{0xFF}, 64), ErrEmpty.Error()},
+		{"corrupted", corrupt, "CRC32 mismatch"},
+		{"truncated", good[:len(good)-10], "only"},
+		{"binary format", binFormat, "binary format"},
+		{"not ELF", wrap(0x00050102, []byte("not an ELF core")), "invalid ELF core"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Parse() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := Parse(bytes.Repeat([]byte{0xFF}, 64)); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Parse(erased) error = %v, want ErrEmpty", err)
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	d, err := Parse(wrap(0x00050102, testCore()))
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+
+	// The RA saved on the stack is not repeated, and the PC on the
+	// stack follows no call
+	if got, want := d.Backtrace(d.Tasks[0], testCode), []uint32{0x42000008, 0x42000004, 0x4200000A}; !slices.Equal(got, want) {
+		t.Errorf("Backtrace() = %x, want %x", got, want)
+	}
+	if got, want := d.Backtrace(d.Tasks[0], nil), []uint32{0x42000008, 0x42000004}; !slices.Equal(got, want) {
+		t.Errorf("Backtrace() without code = %x, want %x", got, want)
+	}
+}
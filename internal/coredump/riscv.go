@@ -0,0 +1,133 @@
+package coredump
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RegisterNames names the registers of Task.Regs: the PC, then x1 to x31
+// by their ABI names, as an ESP-IDF panic dump prints them.
+var RegisterNames = [32]string{
+	"PC", "RA", "SP", "GP", "TP", "T0", "T1", "T2",
+	"S0/FP", "S1", "A0", "A1", "A2", "A3", "A4", "A5",
+	"A6", "A7", "S2", "S3", "S4", "S5", "S6", "S7",
+	"S8", "S9", "S10", "S11", "T3", "T4", "T5", "T6",
+}
+
+// csrName names a control and status register by its number.
+func csrName(csr uint32) string {
+	switch csr {
+	case 0x300:
+		return "MSTATUS"
+	case 0x305:
+		return "MTVEC"
+	case 0x341:
+		return "MEPC"
+	case 0x342:
+		return "MCAUSE"
+	case 0x343:
+		return "MTVAL"
+	case 0xF14:
+		return "MHARTID"
+	default:
+		return fmt.Sprintf("CSR_0x%03X", csr)
+	}
+}
+
+// exceptionNames are the RISC-V exception causes, by MCAUSE.
+var exceptionNames = map[uint32]string{
+	0:  "Instruction address misaligned",
+	1:  "Instruction access fault",
+	2:  "Illegal instruction",
+	3:  "Breakpoint",
+	4:  "Load address misaligned",
+	5:  "Load access fault",
+	6:  "Store address misaligned",
+	7:  "Store access fault",
+	8:  "Environment call from U-mode",
+	11: "Environment call from M-mode",
+}
+
+// Cause describes the exception of the crash from MCAUSE, e.g. "Load
+// access fault", or returns "" if the dump has no MCAUSE.
+func (d *Dump) Cause() string {
+	for _, r := range d.Exception {
+		if r.Name != "MCAUSE" {
+			continue
+		}
+		if r.Value&(1<<31) != 0 {
+			return fmt.Sprintf("Interrupt %d", r.Value&^(1<<31))
+		}
+		if name, ok := exceptionNames[r.Value]; ok {
+			return name
+		}
+		return fmt.Sprintf("Exception %d", r.Value)
+	}
+	return ""
+}
+
+// Code reads the firmware's instructions, e.g. a *symbols.Table.
+type Code interface {
+	Code(addr uint64, n int) ([]byte, bool)
+}
+
+// maxFrames bounds the length of a backtrace.
+const maxFrames = 32
+
+// Backtrace returns the likely call stack of a task, innermost first: its
+// PC, its return address and the return addresses found on its stack.
+// Without the unwind tables, RISC-V frames cannot be walked, so the stack
+// is scanned for words that follow a call instruction in code; a return
+// address left behind by an earlier call shows up too. Without code,
+// only the PC and RA are returned.
+func (d *Dump) Backtrace(t Task, code Code) []uint32 {
+	frames := []uint32{t.PC()}
+	if code == nil {
+		return append(frames, t.Regs[1])
+	}
+	if isReturn(code, t.Regs[1]) {
+		frames = append(frames, t.Regs[1])
+	}
+
+	stack := d.stack(t.Regs[2])
+	for off := 0; off+4 <= len(stack) && len(frames) < maxFrames; off += 4 {
+		addr := binary.LittleEndian.Uint32(stack[off:])
+		if addr != frames[len(frames)-1] && isReturn(code, addr) {
+			frames = append(frames, addr)
+		}
+	}
+	return frames
+}
+
+// stack returns the dumped memory from sp to the end of its segment, the
+// top of the task's stack.
+func (d *Dump) stack(sp uint32) []byte {
+	for _, s := range d.memory {
+		if sp >= s.addr && uint64(sp-s.addr) < uint64(len(s.data)) {
+			return s.data[sp-s.addr:]
+		}
+	}
+	return nil
+}
+
+// isReturn reports whether addr follows a call: a JAL or JALR that links
+// to RA, or their compressed forms.
+func isReturn(code Code, addr uint32) bool {
+	if addr%2 != 0 {
+		return false
+	}
+	if ins, ok := code.Code(uint64(addr)-4, 4); ok {
+		word := binary.LittleEndian.Uint32(ins)
+		op, rd := word&0x7F, word>>7&0x1F
+		if (op == 0x6F || op == 0x67) && rd == 1 {
+			return true
+		}
+	}
+	if ins, ok := code.Code(uint64(addr)-2, 2); ok {
+		half := binary.LittleEndian.Uint16(ins)
+		cJAL := half&0xE003 == 0x2001
+		cJALR := half&0xF07F == 0x9002 && half&0x0F80 != 0
+		return cJAL || cJALR
+	}
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/bigbag/papyrix-flasher/internal/protocol"
 	"github.com/bigbag/papyrix-flasher/internal/serial"
 	"github.com/bigbag/papyrix-flasher/internal/slip"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
 )
 
 // Result represents a detected ESP32 device.
@@ -68,12 +69,18 @@ func ListDevices(baudRate int) ([]Result, error) {
 }
 
 func tryPort(portName string, baudRate int) (*Result, error) {
-	port, err := serial.Open(portName, baudRate)
+	port, err := transport.Open(portName, baudRate)
 	if err != nil {
 		return nil, err
 	}
 	defer port.Close()
 
+	return Probe(port)
+}
+
+// Probe resets the device on an open transport into its bootloader and
+// identifies it.
+func Probe(port transport.Transport) (*Result, error) {
 	// Try to reset into bootloader
 	if err := port.ResetToBootloader(); err != nil {
 		return nil, fmt.Errorf("failed to reset: %w", err)
@@ -89,20 +96,20 @@ func tryPort(portName string, baudRate int) (*Result, error) {
 	if err != nil {
 		// Even if we can't get chip ID, sync worked so it's likely an ESP32
 		return &Result{
-			Port:     portName,
+			Port:     port.PortName(),
 			ChipID:   0,
 			ChipName: "ESP32 (unknown variant)",
 		}, nil
 	}
 
 	return &Result{
-		Port:     portName,
+		Port:     port.PortName(),
 		ChipID:   chipID,
 		ChipName: protocol.ChipName(chipID),
 	}, nil
 }
 
-func syncWithBootloader(port *serial.Port) error {
+func syncWithBootloader(port transport.Transport) error {
 	syncReq := protocol.NewRequest(protocol.CmdSync, protocol.SyncData())
 	frame := slip.Encode(syncReq.Encode())
 
@@ -117,7 +124,7 @@ func syncWithBootloader(port *serial.Port) error {
 		time.Sleep(50 * time.Millisecond)
 
 		// Read response
-		response, err := port.ReadAll(200 * time.Millisecond)
+		response, err := readAll(port, 200*time.Millisecond)
 		if err != nil {
 			continue
 		}
@@ -150,7 +157,7 @@ func syncWithBootloader(port *serial.Port) error {
 	return fmt.Errorf("sync failed after 5 attempts")
 }
 
-func getChipID(port *serial.Port) (uint32, error) {
+func getChipID(port transport.Transport) (uint32, error) {
 	// Send GET_SECURITY_INFO command to get chip info
 	req := protocol.NewRequest(protocol.CmdGetSecurityInfo, nil)
 	frame := slip.Encode(req.Encode())
@@ -161,7 +168,7 @@ func getChipID(port *serial.Port) (uint32, error) {
 
 	time.Sleep(50 * time.Millisecond)
 
-	response, err := port.ReadAll(200 * time.Millisecond)
+	response, err := readAll(port, 200*time.Millisecond)
 	if err != nil {
 		return 0, err
 	}
@@ -188,3 +195,22 @@ func getChipID(port *serial.Port) (uint32, error) {
 
 	return info.ChipID, nil
 }
+
+// readAll reads until the device stops sending or timeout passes.
+func readAll(port transport.Transport, timeout time.Duration) ([]byte, error) {
+	var result []byte
+	buf := make([]byte, 1024)
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		n, err := port.ReadWithTimeout(buf, 100*time.Millisecond)
+		if n > 0 {
+			result = append(result, buf[:n]...)
+		}
+		if err != nil || n == 0 {
+			break
+		}
+	}
+
+	return result, nil
+}
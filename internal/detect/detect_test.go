@@ -0,0 +1,54 @@
+package detect
+
+import (
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+func TestProbe(t *testing.T) {
+	result, err := Probe(emulator.NewPort(emulator.New(0x10000)))
+	if err != nil {
+		t.Fatalf("Probe() error: %v", err)
+	}
+	if result.ChipID != protocol.ChipIDESP32C3 || result.ChipName != "ESP32-C3" {
+		t.Errorf("Probe() = %+v, want an ESP32-C3", result)
+	}
+	if result.Port != "emulator" {
+		t.Errorf("Probe() port = %q, want emulator", result.Port)
+	}
+}
+
+func TestProbe_NoBootloader(t *testing.T) {
+	d := emulator.New(0x10000)
+	port := emulator.NewPort(d)
+	// A device whose reset lines are not wired keeps running its
+	// application
+	d.Reset(false)
+
+	if _, err := Probe(&stuckPort{port}); err == nil {
+		t.Error("Probe() should fail without a bootloader")
+	}
+}
+
+// stuckPort is a port whose reset lines are not connected.
+type stuckPort struct {
+	*emulator.Port
+}
+
+func (p *stuckPort) ResetToBootloader() error { return nil }
+
+func TestDetectOnPort_URL(t *testing.T) {
+	result, err := DetectOnPort("emulator://", protocol.DefaultBaudRate)
+	if err != nil {
+		t.Fatalf("DetectOnPort(emulator://) error: %v", err)
+	}
+	if result.ChipID != protocol.ChipIDESP32C3 {
+		t.Errorf("DetectOnPort(emulator://) chip = 0x%X", result.ChipID)
+	}
+
+	if _, err := DetectOnPort("bogus://x", protocol.DefaultBaudRate); err == nil {
+		t.Error("DetectOnPort() with an unknown scheme should fail")
+	}
+}
@@ -0,0 +1,485 @@
+// Package emulator emulates the ESP32-C3 ROM bootloader, so that the
+// flasher can be tested end to end without hardware.
+//
+// A Device holds the flash contents, in memory or backed by a file, and
+// answers SLIP-framed ROM commands: SYNC, SPI_ATTACH, SPI_SET_PARAMS,
+// FLASH_BEGIN/DATA/END and their deflate variants, SPI_FLASH_MD5,
+// READ_REG, WRITE_REG and GET_SECURITY_INFO. Of the registers, only the
+// SPI1 controller acts on writes: it runs flash READ commands. Connect it to a Flasher in-process with
+// NewPort, or serve it on a byte stream such as a pseudo-terminal.
+package emulator
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+)
+
+// DefaultMAC is the factory MAC address of an emulated device.
+var DefaultMAC = [6]byte{0x58, 0xCF, 0x79, 0x00, 0x00, 0x01}
+
+// BootMessage is printed by the ROM when it starts in download mode.
+const BootMessage = "ESP-ROM:esp32c3-api1-20210207\r\n" +
+	"Build:Feb  7 2021\r\n" +
+	"rst:0x15 (USB_UART_CHIP_RESET),boot:0x5 (DOWNLOAD(USB/UART0/1))\r\n" +
+	"waiting for download\r\n"
+
+// AppBootMessage is printed by the ROM when it boots the application from
+// flash.
+const AppBootMessage = "ESP-ROM:esp32c3-api1-20210207\r\n" +
+	"Build:Feb  7 2021\r\n" +
+	"rst:0x15 (USB_UART_CHIP_RESET),boot:0xc (SPI_FAST_FLASH_BOOT)\r\n"
+
+// Device is an emulated ESP32-C3 in download mode.
+type Device struct {
+	// HoldBoot keeps the boot strapping pin low, so every reset enters
+	// the bootloader again, as when the BOOT button is held. Use it when
+	// the emulator is reached through a line without DTR/RTS.
+	HoldBoot bool
+
+	mu        sync.Mutex
+	inROM     bool
+	regs      map[uint32]uint32
+	flashSize uint32
+	write     *flashWrite
+
+	flashMu sync.Mutex
+	flash   []byte
+	path    string
+}
+
+// New returns a device with size bytes of erased flash, running the ROM
+// bootloader.
+func New(size int) *Device {
+	d := &Device{
+		inROM: true,
+		regs:  map[uint32]uint32{},
+		flash: bytes.Repeat([]byte{0xFF}, size),
+	}
+	d.SetMAC(DefaultMAC)
+	return d
+}
+
+// Open returns a device whose flash is kept in the file at path. A new
+// file is created with size bytes of erased flash. Call Save to write the
+// flash back.
+func Open(path string, size int) (*Device, error) {
+	d := New(size)
+	d.path = path
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return d, d.Save()
+	case err != nil:
+		return nil, err
+	case len(data) != size:
+		return nil, fmt.Errorf("flash file %s is %d bytes, want %d", path, len(data), size)
+	}
+	d.flash = data
+	return d, nil
+}
+
+// Save writes the flash contents to the file the device was opened with.
+func (d *Device) Save() error {
+	if d.path == "" {
+		return nil
+	}
+	d.flashMu.Lock()
+	defer d.flashMu.Unlock()
+	return os.WriteFile(d.path, d.flash, 0o644)
+}
+
+// Flash returns a copy of the flash contents.
+func (d *Device) Flash() []byte {
+	d.flashMu.Lock()
+	defer d.flashMu.Unlock()
+	return bytes.Clone(d.flash)
+}
+
+// SetMAC sets the factory MAC address in eFuse.
+func (d *Device) SetMAC(mac [6]byte) {
+	d.SetReg(protocol.EfuseMacWord0, binary.BigEndian.Uint32(mac[2:6]))
+	d.SetReg(protocol.EfuseMacWord1, uint32(mac[0])<<8|uint32(mac[1]))
+}
+
+// SetReg sets the value READ_REG returns for addr.
+func (d *Device) SetReg(addr, value uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.regs[addr] = value
+}
+
+// InBootloader reports whether the device runs the ROM bootloader, rather
+// than the flashed application.
+func (d *Device) InBootloader() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inROM
+}
+
+// Reset restarts the chip. With boot set, or with HoldBoot, it enters the
+// bootloader and returns the boot message; otherwise it returns the
+// banner of a flash boot and runs the application, which does not answer
+// commands.
+func (d *Device) Reset(boot bool) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reset(boot)
+}
+
+func (d *Device) reset(boot bool) []byte {
+	if d.write != nil {
+		d.write.close()
+		d.write = nil
+	}
+	d.inROM = boot || d.HoldBoot
+	if !d.inROM {
+		return []byte(AppBootMessage)
+	}
+	return []byte(BootMessage)
+}
+
+// Handle processes a request packet (after SLIP decoding) and returns the
+// bytes the device sends back: response packets, SLIP-encoded, and the
+// boot message after a reboot.
+func (d *Device) Handle(packet []byte) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.inROM {
+		return nil
+	}
+
+	req, err := protocol.DecodeRequest(packet)
+	if err != nil {
+		// The ROM ignores malformed packets
+		return nil
+	}
+
+	var out []byte
+	for _, resp := range d.execute(req) {
+		out = append(out, slip.Encode(resp.Encode())...)
+	}
+	if (req.Command == protocol.CmdFlashEnd || req.Command == protocol.CmdFlashDeflEnd) && len(req.Data) >= 4 {
+		// A zero flag reboots the chip; any other value makes the ROM jump
+		// to the application, whatever the boot pin says
+		if binary.LittleEndian.Uint32(req.Data) == 0 {
+			out = append(out, d.reset(false)...)
+		} else {
+			d.finishWrite()
+			d.inROM = false
+		}
+	}
+	// The watchdog fires some milliseconds after it is armed, once the
+	// host has locked its registers again
+	if d.regs[protocol.RTCWDTConfig0]&protocol.RTCWDTEnable != 0 && d.regs[protocol.RTCWDTProtect] != protocol.RTCWDTKey {
+		delete(d.regs, protocol.RTCWDTConfig0)
+		out = append(out, d.reset(false)...)
+	}
+	return out
+}
+
+// execute runs a request and returns its responses.
+func (d *Device) execute(req *protocol.Request) []*protocol.Response {
+	ok := &protocol.Response{Command: req.Command}
+	fail := func(code byte) []*protocol.Response {
+		return []*protocol.Response{{Command: req.Command, Status: 1, Error: code}}
+	}
+
+	if !req.ChecksumValid() {
+		return fail(protocol.ErrInvalidCRC)
+	}
+	words := func(n int) ([]uint32, bool) {
+		if len(req.Data) < 4*n {
+			return nil, false
+		}
+		w := make([]uint32, n)
+		for i := range w {
+			w[i] = binary.LittleEndian.Uint32(req.Data[4*i:])
+		}
+		return w, true
+	}
+
+	switch req.Command {
+	case protocol.CmdSync:
+		if !bytes.Equal(req.Data, protocol.SyncData()) {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		// The ROM answers SYNC eight times
+		responses := make([]*protocol.Response, 8)
+		for i := range responses {
+			responses[i] = ok
+		}
+		return responses
+
+	case protocol.CmdSpiAttach:
+		return []*protocol.Response{ok}
+
+	case protocol.CmdSpiSetParams:
+		w, valid := words(6)
+		if !valid {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		d.flashSize = w[1]
+		return []*protocol.Response{ok}
+
+	case protocol.CmdGetSecurityInfo:
+		// The chip ID leads the security info, see protocol.ParseSecurityInfo
+		info := make([]byte, 20)
+		binary.LittleEndian.PutUint32(info, protocol.ChipIDESP32C3)
+		return []*protocol.Response{{Command: req.Command, Data: info}}
+
+	case protocol.CmdReadReg:
+		w, valid := words(1)
+		if !valid {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		return []*protocol.Response{{Command: req.Command, Value: d.regs[w[0]]}}
+
+	case protocol.CmdWriteReg:
+		w, valid := words(4)
+		if !valid {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		addr, value, mask := w[0], w[1], w[2]
+		locked := d.regs[protocol.RTCWDTProtect] != protocol.RTCWDTKey
+		if (addr == protocol.RTCWDTConfig0 || addr == protocol.RTCWDTConfig1) && locked {
+			return []*protocol.Response{ok}
+		}
+		d.regs[addr] = d.regs[addr]&^mask | value&mask
+		if addr == protocol.SPI1Cmd && d.regs[addr]&protocol.SPI1CmdUsr != 0 {
+			d.finishWrite()
+			d.runSPI()
+		}
+		return []*protocol.Response{ok}
+
+	case protocol.CmdSpiFlashMD5:
+		w, valid := words(2)
+		if !valid {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		d.finishWrite()
+		data, err := d.read(w[0], w[1])
+		if err != nil {
+			return fail(protocol.ErrFlashReadLenErr)
+		}
+		sum := md5.Sum(data)
+		// The ROM sends the digest as hex characters
+		return []*protocol.Response{{Command: req.Command, Data: []byte(hex.EncodeToString(sum[:]))}}
+
+	case protocol.CmdFlashBegin, protocol.CmdFlashDeflBegin:
+		w, valid := words(4)
+		if !valid {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		d.finishWrite()
+		size, blocks, blockSize, offset := w[0], w[1], w[2], w[3]
+		if err := d.erase(offset, size); err != nil {
+			return fail(protocol.ErrFailedToAct)
+		}
+		d.write = &flashWrite{
+			deflate:   req.Command == protocol.CmdFlashDeflBegin,
+			offset:    offset,
+			size:      size,
+			blocks:    blocks,
+			blockSize: blockSize,
+		}
+		if d.write.deflate {
+			d.write.startInflate(d, offset, size)
+		}
+		return []*protocol.Response{ok}
+
+	case protocol.CmdFlashData, protocol.CmdFlashDeflData:
+		w, valid := words(4)
+		if !valid || d.write == nil || d.write.deflate != (req.Command == protocol.CmdFlashDeflData) {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		size, seq := w[0], w[1]
+		payload := req.Data[16:]
+		if int(size) != len(payload) || seq != d.write.seq || seq >= d.write.blocks {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		if err := d.write.data(d, payload); err != nil {
+			if d.write.deflate {
+				return fail(protocol.ErrDeflateError)
+			}
+			return fail(protocol.ErrFlashWriteErr)
+		}
+		d.write.seq++
+		// The ROM has written everything once the last block arrives
+		if d.write.seq == d.write.blocks {
+			if err := d.finishWrite(); err != nil {
+				return fail(protocol.ErrDeflateError)
+			}
+		}
+		return []*protocol.Response{ok}
+
+	case protocol.CmdFlashEnd, protocol.CmdFlashDeflEnd:
+		if d.write != nil && d.write.deflate != (req.Command == protocol.CmdFlashDeflEnd) {
+			return fail(protocol.ErrInvalidMessage)
+		}
+		if err := d.finishWrite(); err != nil {
+			return fail(protocol.ErrDeflateError)
+		}
+		return []*protocol.Response{ok}
+
+	default:
+		return fail(protocol.ErrInvalidMessage)
+	}
+}
+
+// runSPI runs the user command set up in the SPI1 registers. Only READ is
+// emulated, and it completes at once.
+func (d *Device) runSPI() {
+	d.regs[protocol.SPI1Cmd] &^= protocol.SPI1CmdUsr
+	if d.regs[protocol.SPI1User2]&0xFFFF != protocol.FlashCmdRead || d.regs[protocol.SPI1User]&protocol.SPI1UserMiso == 0 {
+		return
+	}
+	size := min(d.regs[protocol.SPI1MisoLen]/8+1, protocol.SPI1BufferSize)
+	data, err := d.read(d.regs[protocol.SPI1Addr]&0xFFFFFF, size)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, protocol.SPI1BufferSize)
+	copy(buf, data)
+	for i := 0; i < len(buf); i += 4 {
+		d.regs[protocol.SPI1W0+uint32(i)] = binary.LittleEndian.Uint32(buf[i:])
+	}
+}
+
+// finishWrite completes the write in progress, if any.
+func (d *Device) finishWrite() error {
+	if d.write == nil {
+		return nil
+	}
+	err := d.write.close()
+	d.write = nil
+	return err
+}
+
+func (d *Device) bounds(addr, size uint32) error {
+	if uint64(addr)+uint64(size) > uint64(len(d.flash)) {
+		return fmt.Errorf("0x%X+0x%X is beyond the end of flash", addr, size)
+	}
+	return nil
+}
+
+func (d *Device) read(addr, size uint32) ([]byte, error) {
+	d.flashMu.Lock()
+	defer d.flashMu.Unlock()
+	if err := d.bounds(addr, size); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(d.flash[addr : addr+size]), nil
+}
+
+// erase erases the sectors covering size bytes at addr.
+func (d *Device) erase(addr, size uint32) error {
+	d.flashMu.Lock()
+	defer d.flashMu.Unlock()
+	size = protocol.CalculateEraseSize(int(size))
+	if addr%protocol.FlashSectorSize != 0 {
+		return fmt.Errorf("erase address 0x%X is not sector aligned", addr)
+	}
+	if err := d.bounds(addr, size); err != nil {
+		return err
+	}
+	for i := addr; i < addr+size; i++ {
+		d.flash[i] = 0xFF
+	}
+	return nil
+}
+
+// program writes data at addr. Like NOR flash, writing can only clear
+// bits.
+func (d *Device) program(addr uint32, data []byte) error {
+	d.flashMu.Lock()
+	defer d.flashMu.Unlock()
+	if err := d.bounds(addr, uint32(len(data))); err != nil {
+		return err
+	}
+	for i, b := range data {
+		d.flash[addr+uint32(i)] &= b
+	}
+	return nil
+}
+
+// flashWrite is a FLASH_BEGIN or FLASH_DEFL_BEGIN in progress.
+type flashWrite struct {
+	deflate   bool
+	offset    uint32
+	size      uint32
+	blocks    uint32
+	blockSize uint32
+	seq       uint32
+
+	// Deflate streams are inflated into flash as the blocks arrive
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (w *flashWrite) startInflate(d *Device, offset, size uint32) {
+	r, pw := io.Pipe()
+	w.pipe = pw
+	w.done = make(chan error, 1)
+	go func() {
+		err := inflate(d, r, offset, size)
+		r.CloseWithError(err)
+		w.done <- err
+	}()
+}
+
+func inflate(d *Device, r io.Reader, offset, size uint32) error {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, protocol.FlashSectorSize)
+	written := uint32(0)
+	for {
+		n, err := zr.Read(buf)
+		if n > 0 {
+			if written+uint32(n) > size {
+				return fmt.Errorf("inflated data exceeds %d bytes", size)
+			}
+			if err := d.program(offset+written, buf[:n]); err != nil {
+				return err
+			}
+			written += uint32(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *flashWrite) data(d *Device, payload []byte) error {
+	if w.deflate {
+		_, err := w.pipe.Write(payload)
+		return err
+	}
+	// Uncompressed blocks are padded to the block size
+	block := bytes.Repeat([]byte{0xFF}, int(w.blockSize))
+	copy(block, payload)
+	return d.program(w.offset+w.seq*w.blockSize, block)
+}
+
+func (w *flashWrite) close() error {
+	if !w.deflate {
+		return nil
+	}
+	w.pipe.Close()
+	return <-w.done
+}
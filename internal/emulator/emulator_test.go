@@ -0,0 +1,239 @@
+package emulator
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/reset"
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+)
+
+// call sends a request to d and returns the first response.
+func call(t *testing.T, d *Device, cmd byte, data []byte) *protocol.Response {
+	t.Helper()
+	return send(t, d, protocol.NewRequest(cmd, data))
+}
+
+func send(t *testing.T, d *Device, req *protocol.Request) *protocol.Response {
+	t.Helper()
+	out := d.Handle(req.Encode())
+	frame, _ := slip.ReadFrame(out)
+	if frame == nil {
+		t.Fatalf("%s: no response", protocol.CommandName(req.Command))
+	}
+	resp, err := protocol.DecodeResponse(slip.Decode(frame))
+	if err != nil {
+		t.Fatalf("%s: %v", protocol.CommandName(req.Command), err)
+	}
+	return resp
+}
+
+func TestSync(t *testing.T) {
+	d := New(0x10000)
+	out := d.Handle(protocol.NewRequest(protocol.CmdSync, protocol.SyncData()).Encode())
+	if n := bytes.Count(out, []byte{slip.End}); n != 16 {
+		t.Errorf("SYNC returned %d frame delimiters, want 16 (8 responses)", n)
+	}
+
+	resp := call(t, d, protocol.CmdSync, []byte{1, 2, 3})
+	if resp.IsSuccess() {
+		t.Error("SYNC with a bad payload should fail")
+	}
+}
+
+func TestFlashUncompressed(t *testing.T) {
+	d := New(0x10000)
+	data := []byte("hello, flash")
+
+	if resp := call(t, d, protocol.CmdFlashBegin, protocol.FlashDeflBeginData(uint32(len(data)), 1, 0x400, 0x1000)); !resp.IsSuccess() {
+		t.Fatalf("FLASH_BEGIN failed: %s", resp.ErrorString())
+	}
+	if resp := call(t, d, protocol.CmdFlashData, protocol.FlashDeflDataData(data, 0)); !resp.IsSuccess() {
+		t.Fatalf("FLASH_DATA failed: %s", resp.ErrorString())
+	}
+
+	flash := d.Flash()
+	if !bytes.Equal(flash[0x1000:0x1000+len(data)], data) {
+		t.Errorf("flash = %q, want %q", flash[0x1000:0x1000+len(data)], data)
+	}
+	if flash[0x1000+len(data)] != 0xFF {
+		t.Error("padding after the data should stay erased")
+	}
+
+	resp := call(t, d, protocol.CmdSpiFlashMD5, protocol.SpiFlashMD5Data(0x1000, uint32(len(data))))
+	sum := md5.Sum(data)
+	if string(resp.Data) != hex.EncodeToString(sum[:]) {
+		t.Errorf("SPI_FLASH_MD5 = %q, want %x", resp.Data, sum)
+	}
+}
+
+func TestFlashData_Errors(t *testing.T) {
+	d := New(0x10000)
+	call(t, d, protocol.CmdFlashBegin, protocol.FlashDeflBeginData(0x800, 2, 0x400, 0))
+
+	// Blocks must arrive in sequence
+	if resp := call(t, d, protocol.CmdFlashData, protocol.FlashDeflDataData([]byte{1}, 1)); resp.Error != protocol.ErrInvalidMessage {
+		t.Errorf("out of sequence block: error = 0x%02X, want 0x%02X", resp.Error, protocol.ErrInvalidMessage)
+	}
+
+	req := protocol.NewRequest(protocol.CmdFlashData, protocol.FlashDeflDataData([]byte{1}, 0))
+	req.Checksum ^= 0xFF
+	if resp := send(t, d, req); resp.Error != protocol.ErrInvalidCRC {
+		t.Errorf("bad checksum: error = 0x%02X, want 0x%02X", resp.Error, protocol.ErrInvalidCRC)
+	}
+
+	if resp := call(t, d, protocol.CmdFlashBegin, protocol.FlashDeflBeginData(0x1000, 1, 0x400, 0x10000)); resp.IsSuccess() {
+		t.Error("FLASH_BEGIN beyond the end of flash should fail")
+	}
+	if resp := call(t, d, protocol.CmdSpiFlashMD5, protocol.SpiFlashMD5Data(0xF000, 0x2000)); resp.IsSuccess() {
+		t.Error("SPI_FLASH_MD5 beyond the end of flash should fail")
+	}
+}
+
+func TestFlashEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		reboot   bool
+		holdBoot bool
+		want     string // printed after the response
+		inROM    bool
+	}{
+		{"reboot", true, false, AppBootMessage, false},
+		{"reboot holding boot", true, true, BootMessage, true},
+		{"run", false, false, "", false},
+		{"run holding boot", false, true, "", false},
+	}
+	for _, tt := range tests {
+		d := New(0x10000)
+		d.HoldBoot = tt.holdBoot
+		call(t, d, protocol.CmdFlashBegin, protocol.FlashDeflBeginData(0, 0, 0x400, 0))
+		out := d.Handle(protocol.NewRequest(protocol.CmdFlashEnd, protocol.FlashEndData(tt.reboot)).Encode())
+		if frame, rest := slip.ReadFrame(out); frame == nil || string(rest) != tt.want {
+			t.Errorf("%s: FLASH_END returned %q, want a response and %q", tt.name, out, tt.want)
+		}
+		if d.InBootloader() != tt.inROM {
+			t.Errorf("%s: InBootloader() = %v, want %v", tt.name, d.InBootloader(), tt.inROM)
+		}
+	}
+}
+
+func TestRebootAndReset(t *testing.T) {
+	d := New(0x10000)
+	call(t, d, protocol.CmdFlashEnd, protocol.FlashEndData(true))
+	if d.InBootloader() {
+		t.Fatal("FLASH_END with reboot should leave the bootloader")
+	}
+	if out := d.Handle(protocol.NewRequest(protocol.CmdSync, protocol.SyncData()).Encode()); out != nil {
+		t.Error("the application should not answer ROM commands")
+	}
+
+	if out := d.Reset(true); string(out) != BootMessage {
+		t.Errorf("Reset(true) = %q, want the boot message", out)
+	}
+	if !d.InBootloader() {
+		t.Error("Reset(true) should enter the bootloader")
+	}
+
+	d.HoldBoot = true
+	d.Reset(false)
+	if !d.InBootloader() {
+		t.Error("with HoldBoot every reset should enter the bootloader")
+	}
+}
+
+func TestPort_LineReset(t *testing.T) {
+	d := New(0x10000)
+	p := NewPort(d)
+	d.Reset(false)
+
+	if err := reset.USBJTAGSerial(p); err != nil {
+		t.Fatalf("USBJTAGSerial() error: %v", err)
+	}
+	if !d.InBootloader() {
+		t.Fatal("the USB-Serial/JTAG sequence should enter the bootloader")
+	}
+	buf := make([]byte, 256)
+	if n, _ := p.ReadWithTimeout(buf, 0); string(buf[:n]) != BootMessage {
+		t.Errorf("output after reset = %q, want the boot message", buf[:n])
+	}
+
+	// A pulse on RTS alone restarts the application
+	p.SetRTS(true)
+	p.SetRTS(false)
+	if d.InBootloader() {
+		t.Error("releasing RTS should start the application")
+	}
+}
+
+func TestReadReg(t *testing.T) {
+	d := New(0x10000)
+	d.SetReg(0x60000000, 0xCAFE)
+	if resp := call(t, d, protocol.CmdReadReg, protocol.ReadRegData(0x60000000)); resp.Value != 0xCAFE {
+		t.Errorf("READ_REG = 0x%X, want 0xCAFE", resp.Value)
+	}
+}
+
+func TestWriteReg(t *testing.T) {
+	d := New(0x10000)
+	d.SetReg(0x60000000, 0xFF00)
+	data := protocol.WriteRegData(0x60000000, 0x00AB)
+	binary.LittleEndian.PutUint32(data[8:], 0x00FF) // mask
+	call(t, d, protocol.CmdWriteReg, data)
+	if resp := call(t, d, protocol.CmdReadReg, protocol.ReadRegData(0x60000000)); resp.Value != 0xFFAB {
+		t.Errorf("READ_REG after a masked WRITE_REG = 0x%X, want 0xFFAB", resp.Value)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	d := New(0x10000)
+	write := func(addr, value uint32) {
+		call(t, d, protocol.CmdWriteReg, protocol.WriteRegData(addr, value))
+	}
+
+	// Locked registers ignore writes
+	write(protocol.RTCWDTConfig0, protocol.RTCWDTArm)
+	write(protocol.RTCWDTProtect, 0)
+	if !d.InBootloader() {
+		t.Fatal("the watchdog fired without being unlocked")
+	}
+
+	write(protocol.RTCWDTProtect, protocol.RTCWDTKey)
+	write(protocol.RTCWDTConfig0, protocol.RTCWDTArm)
+	if !d.InBootloader() {
+		t.Fatal("the watchdog fired before its registers were locked")
+	}
+	out := d.Handle(protocol.NewRequest(protocol.CmdWriteReg, protocol.WriteRegData(protocol.RTCWDTProtect, 0)).Encode())
+	if d.InBootloader() || !bytes.HasSuffix(out, []byte(AppBootMessage)) {
+		t.Errorf("armed watchdog should restart the application, got %q", out)
+	}
+}
+
+func TestOpen_PersistsFlash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flash.bin")
+	d, err := Open(path, 0x2000)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	call(t, d, protocol.CmdFlashBegin, protocol.FlashDeflBeginData(4, 1, 0x400, 0))
+	call(t, d, protocol.CmdFlashData, protocol.FlashDeflDataData([]byte{1, 2, 3, 4}, 0))
+	if err := d.Save(); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	d, err = Open(path, 0x2000)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if got := d.Flash()[:4]; !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("reopened flash = %v, want [1 2 3 4]", got)
+	}
+
+	if _, err := Open(path, 0x4000); err == nil {
+		t.Error("Open() with a different size should fail")
+	}
+}
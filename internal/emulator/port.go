@@ -0,0 +1,213 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// Port connects a Device to a Flasher in-process. Requests are handled as
+// they are written; each read returns at most one pending response, the
+// way they arrive over USB.
+type Port struct {
+	dev *Device
+	in  []byte
+	out [][]byte
+
+	dtr, rts bool
+	held     bool // the lines hold the chip in reset
+	boot     bool // the bootloader was requested for the next reset
+}
+
+// NewPort returns a port connected to d.
+func NewPort(d *Device) *Port {
+	return &Port{dev: d}
+}
+
+func (p *Port) Write(data []byte) (int, error) {
+	p.in = append(p.in, data...)
+	var packets [][]byte
+	packets, p.in = splitPackets(p.in)
+	for _, packet := range packets {
+		p.queue(p.dev.Handle(packet))
+	}
+	return len(data), nil
+}
+
+// queue adds device output, split into SLIP frames and the text between
+// them.
+func (p *Port) queue(out []byte) {
+	for len(out) > 0 {
+		frame, remaining := slip.ReadFrame(out)
+		if frame == nil {
+			p.out = append(p.out, out)
+			return
+		}
+		if text := out[:len(out)-len(frame)-len(remaining)]; len(text) > 0 {
+			p.out = append(p.out, text)
+		}
+		p.out = append(p.out, frame)
+		out = remaining
+	}
+}
+
+func (p *Port) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	if len(p.out) == 0 {
+		time.Sleep(timeout)
+		return 0, nil
+	}
+	n := copy(buf, p.out[0])
+	if n < len(p.out[0]) {
+		p.out[0] = p.out[0][n:]
+	} else {
+		p.out = p.out[1:]
+	}
+	return n, nil
+}
+
+func (p *Port) Flush() error {
+	p.out = nil
+	return nil
+}
+
+// ResetToBootloader resets the device with the boot pin held low.
+func (p *Port) ResetToBootloader() error {
+	p.out = nil
+	p.queue(p.dev.Reset(true))
+	return nil
+}
+
+// HardReset resets the device into the application.
+func (p *Port) HardReset() error {
+	p.out = nil
+	p.queue(p.dev.Reset(false))
+	return nil
+}
+
+// SetDTR sets the DTR line; see lines.
+func (p *Port) SetDTR(value bool) error {
+	p.dtr = value
+	p.lines()
+	return nil
+}
+
+// SetRTS sets the RTS line; see lines.
+func (p *Port) SetRTS(value bool) error {
+	p.rts = value
+	p.lines()
+	return nil
+}
+
+// lines resets the device as the ESP32-C3's USB-Serial/JTAG controller
+// does: RTS without DTR holds it in reset, and DTR without RTS requests
+// the bootloader for when it is released. ResetToBootloader and HardReset
+// reset it directly, as the classic circuit does.
+func (p *Port) lines() {
+	held := p.rts && !p.dtr
+	switch {
+	case held:
+		p.held = true
+	case p.dtr && !p.rts:
+		p.boot = true
+	}
+	if p.held && !held {
+		p.held = false
+		p.out = nil
+		p.queue(p.dev.Reset(p.boot))
+		p.boot = false
+	}
+}
+
+// SetBaudRate is accepted and ignored: the emulated line has no speed.
+func (p *Port) SetBaudRate(baudRate int) error {
+	return nil
+}
+
+func (p *Port) PortName() string {
+	return "emulator"
+}
+
+// USBID returns the IDs of the ESP32-C3's USB-Serial/JTAG controller,
+// whose lines the port emulates.
+func (p *Port) USBID() (vid, pid uint16) {
+	return 0x303A, 0x1001
+}
+
+// Close saves the flash contents of a device backed by a file.
+func (p *Port) Close() error {
+	return p.dev.Save()
+}
+
+func init() {
+	transport.Register("emulator", openEmulator)
+}
+
+// openEmulator opens an emulator:// URL: a device with in-memory flash,
+// or emulator:///path/flash.bin for flash kept in a file. The size query
+// parameter sets the flash size in bytes.
+func openEmulator(u *url.URL, baudRate int) (transport.Transport, error) {
+	size := uint64(protocol.DefaultFlashSize)
+	if s := u.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid emulator flash size %q", s)
+		}
+	}
+
+	path := transport.Path(u)
+	if path == "" {
+		return NewPort(New(int(size))), nil
+	}
+	d, err := Open(path, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return NewPort(d), nil
+}
+
+// Serve answers the requests read from rw until reading fails, e.g. on a
+// pseudo-terminal. It returns the read error.
+func (d *Device) Serve(rw io.ReadWriter) error {
+	buf := make([]byte, 4096)
+	var in []byte
+	for {
+		n, err := rw.Read(buf)
+		if err != nil {
+			return err
+		}
+		in = append(in, buf[:n]...)
+
+		var packets [][]byte
+		packets, in = splitPackets(in)
+		for _, packet := range packets {
+			if out := d.Handle(packet); len(out) > 0 {
+				if _, err := rw.Write(out); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// splitPackets returns the decoded packets of the complete SLIP frames in
+// data and the remaining bytes.
+func splitPackets(data []byte) ([][]byte, []byte) {
+	var packets [][]byte
+	for {
+		frame, remaining := slip.ReadFrame(data)
+		if frame == nil {
+			return packets, data
+		}
+		if packet := slip.Decode(frame); len(packet) > 0 {
+			packets = append(packets, packet)
+		}
+		data = remaining
+	}
+}
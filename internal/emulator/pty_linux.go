@@ -0,0 +1,88 @@
+//go:build linux
+
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tiocgptn   = 0x80045430
+	tiocsptlck = 0x40045431
+)
+
+// PTY is a pseudo-terminal pair. Clients open the terminal at Name like a
+// serial port; the emulator reads and writes Master.
+type PTY struct {
+	Master *os.File
+	Name   string
+
+	// The terminal is kept open so that the master does not see a hangup
+	// between clients
+	slave *os.File
+}
+
+// OpenPTY creates a pseudo-terminal in raw mode.
+func OpenPTY() (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(master, tiocsptlck, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pseudo-terminal: %w", err)
+	}
+	var n uint32
+	if err := ioctl(master, tiocgptn, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pseudo-terminal number: %w", err)
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := makeRaw(slave); err != nil {
+		slave.Close()
+		master.Close()
+		return nil, err
+	}
+	return &PTY{Master: master, Name: name, slave: slave}, nil
+}
+
+// Close closes both ends of the pseudo-terminal.
+func (p *PTY) Close() error {
+	p.slave.Close()
+	return p.Master.Close()
+}
+
+// makeRaw disables echo and line editing, as cfmakeraw does.
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(f, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
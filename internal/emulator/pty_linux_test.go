@@ -0,0 +1,41 @@
+//go:build linux
+
+package emulator
+
+import (
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/serial"
+)
+
+func TestServe_PTY(t *testing.T) {
+	pty, err := OpenPTY()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %v", err)
+	}
+	defer pty.Close()
+
+	d := New(0x10000)
+	d.HoldBoot = true
+	go d.Serve(pty.Master)
+
+	port, err := serial.Open(pty.Name, protocol.DefaultBaudRate)
+	if err != nil {
+		t.Fatalf("serial.Open() error: %v", err)
+	}
+	defer port.Close()
+
+	f := flasher.New(port)
+	f.SetFlashSize(0x10000)
+	if err := f.Connect(); err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	if err := f.FlashImageCompressed([]byte("over a pty"), 0x1000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+	if got := string(d.Flash()[0x1000:0x100A]); got != "over a pty" {
+		t.Errorf("flash = %q, want %q", got, "over a pty")
+	}
+}
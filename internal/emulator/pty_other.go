@@ -0,0 +1,24 @@
+//go:build !linux
+
+package emulator
+
+import (
+	"errors"
+	"os"
+)
+
+// PTY is a pseudo-terminal pair. It is only supported on Linux.
+type PTY struct {
+	Master *os.File
+	Name   string
+}
+
+// OpenPTY is not supported on this platform.
+func OpenPTY() (*PTY, error) {
+	return nil, errors.New("pseudo-terminals are only supported on Linux")
+}
+
+// Close is a no-op on this platform.
+func (p *PTY) Close() error {
+	return nil
+}
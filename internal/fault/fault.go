@@ -0,0 +1,330 @@
+// Package fault wraps a transport to inject the errors of a bad link:
+// lost, corrupted, duplicated and delayed bytes and SLIP frames. Faults are
+// drawn from a seeded random source, so a failing pattern can be replayed
+// exactly.
+package fault
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// DefaultMaxDelay is the longest delay injected when Config.MaxDelay is
+// not set.
+const DefaultMaxDelay = 50 * time.Millisecond
+
+// Rates are the probabilities, from 0 to 1, of each kind of fault.
+type Rates struct {
+	Drop      float64
+	Corrupt   float64 // one bit flipped
+	Duplicate float64
+	Delay     float64 // held back by up to Config.MaxDelay
+}
+
+// Direction selects the traffic faults are injected into.
+type Direction int
+
+const (
+	Both         Direction = iota
+	HostToDevice           // requests
+	DeviceToHost           // responses and device output
+)
+
+// Config describes a fault pattern.
+type Config struct {
+	Seed int64
+	// Frame rates apply to each SLIP frame, Byte rates to each byte,
+	// including the text the device prints outside frames.
+	Frame Rates
+	Byte  Rates
+	// MaxDelay bounds each injected delay. It defaults to
+	// DefaultMaxDelay.
+	MaxDelay  time.Duration
+	Direction Direction
+}
+
+// Stats counts the faults injected.
+type Stats struct {
+	Dropped    int
+	Corrupted  int
+	Duplicated int
+	Delayed    int
+}
+
+// segment is data delivered after a delay.
+type segment struct {
+	delay time.Duration
+	data  []byte
+}
+
+// chunk is device output due for reading at a point in time.
+type chunk struct {
+	at   time.Time
+	data []byte
+}
+
+// Port is a transport that injects faults into the traffic of another.
+type Port struct {
+	port transport.Transport
+	cfg  Config
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	stats Stats
+
+	raw   []byte
+	in    []byte // device output not yet split into frames
+	queue []chunk
+	ready []byte
+}
+
+// New wraps port with the faults of cfg.
+func New(port transport.Transport, cfg Config) *Port {
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = DefaultMaxDelay
+	}
+	return &Port{
+		port: port,
+		cfg:  cfg,
+		rng:  rand.New(rand.NewSource(cfg.Seed)),
+		raw:  make([]byte, 4096),
+	}
+}
+
+// Stats returns the faults injected so far.
+func (p *Port) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func (p *Port) hit(rate float64) bool {
+	return rate > 0 && p.rng.Float64() < rate
+}
+
+func (p *Port) delay() time.Duration {
+	return time.Duration(p.rng.Int63n(int64(p.cfg.MaxDelay)) + 1)
+}
+
+// mangle applies faults to a frame, or to text outside frames, and returns
+// what is delivered instead.
+func (p *Port) mangle(data []byte, frame bool) []segment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var wait time.Duration
+	if frame {
+		if p.hit(p.cfg.Frame.Drop) {
+			p.stats.Dropped++
+			return nil
+		}
+		if p.hit(p.cfg.Frame.Corrupt) {
+			p.stats.Corrupted++
+			data = bytes.Clone(data)
+			data[p.rng.Intn(len(data))] ^= 1 << p.rng.Intn(8)
+		}
+		if p.hit(p.cfg.Frame.Delay) {
+			p.stats.Delayed++
+			wait = p.delay()
+		}
+	}
+
+	segments := []segment{{delay: wait}}
+	for _, b := range data {
+		if p.hit(p.cfg.Byte.Drop) {
+			p.stats.Dropped++
+			continue
+		}
+		if p.hit(p.cfg.Byte.Corrupt) {
+			p.stats.Corrupted++
+			b ^= 1 << p.rng.Intn(8)
+		}
+		if p.hit(p.cfg.Byte.Delay) {
+			p.stats.Delayed++
+			segments = append(segments, segment{delay: p.delay()})
+		}
+		last := &segments[len(segments)-1]
+		last.data = append(last.data, b)
+		if p.hit(p.cfg.Byte.Duplicate) {
+			p.stats.Duplicated++
+			last.data = append(last.data, b)
+		}
+	}
+
+	if frame && p.hit(p.cfg.Frame.Duplicate) {
+		p.stats.Duplicated++
+		var copies []segment
+		for _, s := range segments {
+			copies = append(copies, segment{data: s.data})
+		}
+		segments = append(segments, copies...)
+	}
+	return segments
+}
+
+// split applies faults to the frames and text in data. It returns the
+// segments to deliver and the bytes of an incomplete frame, which are
+// held back until the rest arrives.
+func (p *Port) split(data []byte) ([]segment, []byte) {
+	var segments []segment
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, slip.End)
+		if i < 0 {
+			i = len(data)
+		}
+		if i > 0 {
+			segments = append(segments, p.mangle(data[:i], false)...)
+			data = data[i:]
+			continue
+		}
+		frame, remaining := slip.ReadFrame(data)
+		if frame == nil {
+			break
+		}
+		segments = append(segments, p.mangle(frame, true)...)
+		data = remaining
+	}
+	return segments, data
+}
+
+func (p *Port) faulty(dir Direction) bool {
+	return p.cfg.Direction == Both || p.cfg.Direction == dir
+}
+
+// Write applies the faults to data before it reaches the device. Lost
+// bytes are reported as written, as on a real line.
+func (p *Port) Write(data []byte) (int, error) {
+	if !p.faulty(HostToDevice) {
+		return p.port.Write(data)
+	}
+
+	segments, rest := p.split(data)
+	if len(rest) > 0 {
+		// A partial frame is written as it is
+		segments = append(segments, segment{data: rest})
+	}
+	for _, s := range segments {
+		if s.delay > 0 {
+			time.Sleep(s.delay)
+		}
+		if len(s.data) == 0 {
+			continue
+		}
+		if _, err := p.port.Write(s.data); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// receive applies the faults to device output and queues it for reading.
+func (p *Port) receive(data []byte) {
+	if !p.faulty(DeviceToHost) {
+		p.queue = append(p.queue, chunk{at: time.Now(), data: bytes.Clone(data)})
+		return
+	}
+
+	var segments []segment
+	p.in = append(p.in, data...)
+	segments, p.in = p.split(p.in)
+	p.in = bytes.Clone(p.in)
+
+	// Delays hold back everything behind them: a line does not reorder
+	at := time.Now()
+	if len(p.queue) > 0 {
+		at = p.queue[len(p.queue)-1].at
+	}
+	for _, s := range segments {
+		at = later(at, time.Now()).Add(s.delay)
+		if len(s.data) > 0 {
+			p.queue = append(p.queue, chunk{at: at, data: s.data})
+		}
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func (p *Port) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for len(p.ready) == 0 && len(p.queue) > 0 && !p.queue[0].at.After(time.Now()) {
+			p.ready = p.queue[0].data
+			p.queue = p.queue[1:]
+		}
+		if len(p.ready) > 0 {
+			n := copy(buf, p.ready)
+			p.ready = p.ready[n:]
+			return n, nil
+		}
+
+		wait := time.Until(deadline)
+		if len(p.queue) > 0 {
+			wait = min(wait, time.Until(p.queue[0].at))
+		}
+		if wait <= 0 {
+			if time.Now().Before(deadline) {
+				continue
+			}
+			return 0, nil
+		}
+
+		n, err := p.port.ReadWithTimeout(p.raw, wait)
+		if n > 0 {
+			p.receive(p.raw[:n])
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush discards device output, including output held back by a delay.
+func (p *Port) Flush() error {
+	p.in = nil
+	p.queue = nil
+	p.ready = nil
+	return p.port.Flush()
+}
+
+func (p *Port) SetDTR(value bool) error {
+	return p.port.SetDTR(value)
+}
+
+func (p *Port) SetRTS(value bool) error {
+	return p.port.SetRTS(value)
+}
+
+func (p *Port) ResetToBootloader() error {
+	p.Flush()
+	return p.port.ResetToBootloader()
+}
+
+func (p *Port) HardReset() error {
+	return p.port.HardReset()
+}
+
+func (p *Port) SetBaudRate(baudRate int) error {
+	return p.port.SetBaudRate(baudRate)
+}
+
+func (p *Port) PortName() string {
+	return p.port.PortName()
+}
+
+func (p *Port) USBID() (vid, pid uint16) {
+	return transport.USBID(p.port)
+}
+
+func (p *Port) Close() error {
+	return p.port.Close()
+}
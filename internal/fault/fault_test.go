@@ -0,0 +1,198 @@
+package fault
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+	"github.com/bigbag/papyrix-flasher/internal/transport/transporttest"
+)
+
+// loopPort returns what was written to it as device output.
+type loopPort struct {
+	transporttest.Port
+	written []byte
+	out     []byte
+}
+
+func (p *loopPort) Write(data []byte) (int, error) {
+	p.written = append(p.written, data...)
+	return len(data), nil
+}
+
+func (p *loopPort) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	if len(p.out) == 0 {
+		return p.Port.ReadWithTimeout(buf, timeout)
+	}
+	n := copy(buf, p.out)
+	p.out = p.out[n:]
+	return n, nil
+}
+
+func (p *loopPort) Flush() error { p.out = nil; return nil }
+
+// frames returns n distinct SLIP frames.
+func frames(n int) [][]byte {
+	var out [][]byte
+	for i := 0; i < n; i++ {
+		out = append(out, slip.Encode([]byte{1, byte(i), 2, 3, 4, 5, 6, 7}))
+	}
+	return out
+}
+
+// readAll reads until the port stays quiet for timeout.
+func readAll(p *Port, timeout time.Duration) []byte {
+	var out []byte
+	buf := make([]byte, 256)
+	for {
+		n, _ := p.ReadWithTimeout(buf, timeout)
+		if n == 0 {
+			return out
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+func TestPort_NoFaults(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{})
+
+	var want []byte
+	for _, frame := range frames(10) {
+		p.Write(frame)
+		want = append(want, frame...)
+	}
+	if !bytes.Equal(loop.written, want) {
+		t.Errorf("written %x, want %x", loop.written, want)
+	}
+
+	want = append([]byte("boot text"), want...)
+	loop.out = bytes.Clone(want)
+	if got := readAll(p, 10*time.Millisecond); !bytes.Equal(got, want) {
+		t.Errorf("read %x, want %x", got, want)
+	}
+	if s := p.Stats(); s != (Stats{}) {
+		t.Errorf("Stats() = %+v, want none", s)
+	}
+}
+
+func TestPort_DropFrames(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{Seed: 1, Frame: Rates{Drop: 0.5}})
+
+	for _, frame := range frames(100) {
+		if n, err := p.Write(frame); err != nil || n != len(frame) {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+	}
+	dropped := p.Stats().Dropped
+	if dropped < 30 || dropped > 70 {
+		t.Errorf("dropped %d of 100 frames, want about 50", dropped)
+	}
+	if got, want := len(loop.written), (100-dropped)*len(frames(1)[0]); got != want {
+		t.Errorf("wrote %d bytes, want %d", got, want)
+	}
+}
+
+func TestPort_CorruptFrames(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{Seed: 1, Frame: Rates{Corrupt: 1}, Direction: DeviceToHost})
+
+	frame := frames(1)[0]
+	loop.out = bytes.Clone(frame)
+	got := readAll(p, 10*time.Millisecond)
+	if len(got) != len(frame) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(frame))
+	}
+	diff := 0
+	for i := range got {
+		if got[i] != frame[i] {
+			diff++
+		}
+	}
+	if diff != 1 {
+		t.Errorf("%d bytes differ, want 1", diff)
+	}
+
+	// Writes are not in the faulty direction
+	p.Write(frame)
+	if !bytes.Equal(loop.written, frame) {
+		t.Errorf("written %x, want %x", loop.written, frame)
+	}
+}
+
+func TestPort_DuplicateFrames(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{Frame: Rates{Duplicate: 1}})
+
+	frame := frames(1)[0]
+	p.Write(frame)
+	if want := append(bytes.Clone(frame), frame...); !bytes.Equal(loop.written, want) {
+		t.Errorf("written %x, want %x", loop.written, want)
+	}
+}
+
+func TestPort_DelayKeepsOrder(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{Seed: 3, Frame: Rates{Delay: 0.5}, Byte: Rates{Delay: 0.05}, MaxDelay: 20 * time.Millisecond})
+
+	var want []byte
+	for _, frame := range frames(20) {
+		want = append(want, frame...)
+	}
+	loop.out = bytes.Clone(want)
+
+	started := time.Now()
+	got := readAll(p, 50*time.Millisecond)
+	if !bytes.Equal(got, want) {
+		t.Errorf("delayed output differs:\n got %x\nwant %x", got, want)
+	}
+	if p.Stats().Delayed == 0 || time.Since(started) < 20*time.Millisecond {
+		t.Errorf("no delay injected (%+v)", p.Stats())
+	}
+}
+
+func TestPort_ByteFaults(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{Seed: 5, Byte: Rates{Drop: 0.1, Duplicate: 0.1}})
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	p.Write(data)
+	s := p.Stats()
+	if got, want := len(loop.written), len(data)-s.Dropped+s.Duplicated; got != want {
+		t.Errorf("wrote %d bytes, want %d (%+v)", got, want, s)
+	}
+	if s.Dropped == 0 || s.Duplicated == 0 {
+		t.Errorf("Stats() = %+v, want drops and duplicates", s)
+	}
+}
+
+func TestPort_Seeded(t *testing.T) {
+	run := func() []byte {
+		loop := &loopPort{}
+		p := New(loop, Config{Seed: 42, Frame: Rates{Drop: 0.3, Corrupt: 0.3}, Byte: Rates{Corrupt: 0.01}})
+		for _, frame := range frames(50) {
+			p.Write(frame)
+		}
+		return loop.written
+	}
+	if a, b := run(), run(); !bytes.Equal(a, b) {
+		t.Error("the same seed injected different faults")
+	}
+}
+
+func TestPort_FlushDropsDelayed(t *testing.T) {
+	loop := &loopPort{}
+	p := New(loop, Config{Frame: Rates{Delay: 1}, MaxDelay: time.Second})
+
+	loop.out = frames(1)[0]
+	buf := make([]byte, 64)
+	if n, _ := p.ReadWithTimeout(buf, 10*time.Millisecond); n != 0 {
+		t.Fatalf("read %d bytes before the delay passed", n)
+	}
+	p.Flush()
+	if len(p.queue) != 0 {
+		t.Error("Flush() kept delayed output")
+	}
+}
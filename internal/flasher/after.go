@@ -0,0 +1,90 @@
+package flasher
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// After action names: what the device does when the flasher is done.
+const (
+	AfterAuto             = "auto"
+	AfterHardReset        = "hard-reset"
+	AfterWatchdogReset    = "watchdog-reset"
+	AfterStayInBootloader = "stay-in-bootloader"
+	AfterRunWithoutReset  = "run-without-reset"
+)
+
+// AfterNames lists the names Leave accepts.
+var AfterNames = []string{AfterAuto, AfterHardReset, AfterWatchdogReset, AfterStayInBootloader, AfterRunWithoutReset}
+
+// watchdogTimeout is the stage 0 timeout of the watchdog reset, in slow
+// clock cycles: about 15ms.
+const watchdogTimeout = 2000
+
+// CheckAfter returns an error for an unknown after action name.
+func CheckAfter(after string) error {
+	if !slices.Contains(AfterNames, after) {
+		return fmt.Errorf("unknown after action %q (use %s)", after, strings.Join(AfterNames, ", "))
+	}
+	return nil
+}
+
+// Leave ends the session with the after action and returns the action
+// taken. Auto picks the watchdog reset when the port is a USB-Serial/JTAG
+// controller, whose lines cannot start the application, and the hard
+// reset otherwise, including for ports whose USB IDs are unknown.
+func (f *Flasher) Leave(after string) (string, error) {
+	if err := CheckAfter(after); err != nil {
+		return "", err
+	}
+	if after == AfterAuto {
+		after = AfterHardReset
+		if isUSBJTAGSerial(f.port) {
+			after = AfterWatchdogReset
+		}
+	}
+	f.log.Debug("leaving bootloader", "after", after)
+
+	switch after {
+	case AfterHardReset:
+		return after, f.port.HardReset()
+	case AfterWatchdogReset:
+		return after, f.watchdogReset()
+	case AfterRunWithoutReset:
+		// The ROM jumps to the application, leaving the peripherals as
+		// the bootloader set them up. It only accepts FLASH_END during a
+		// write, so start an empty one first, as esptool's run does.
+		// FLASH_BEGIN takes the same payload as FLASH_DEFL_BEGIN.
+		begin := protocol.NewRequest(protocol.CmdFlashBegin, protocol.FlashDeflBeginData(0, 0, protocol.FlashBlockSize, 0))
+		if err := f.sendCommand(begin); err != nil {
+			return after, fmt.Errorf("flash begin failed: %w", err)
+		}
+		req := protocol.NewRequest(protocol.CmdFlashEnd, protocol.FlashEndData(false))
+		return after, f.writeRequest(req)
+	default:
+		return after, nil
+	}
+}
+
+// watchdogReset arms the RTC watchdog with a short timeout. When it fires
+// it resets the whole chip, which then boots its application.
+func (f *Flasher) watchdogReset() error {
+	err := f.writeRegs([]regWrite{
+		{protocol.RTCWDTProtect, protocol.RTCWDTKey},
+		{protocol.RTCWDTConfig1, watchdogTimeout},
+		{protocol.RTCWDTConfig0, protocol.RTCWDTArm},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to arm the watchdog: %w", err)
+	}
+	// The chip may reset before it answers
+	if err := f.WriteReg(protocol.RTCWDTProtect, 0); err != nil {
+		f.log.Debug("no response to locking the watchdog", "err", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
@@ -0,0 +1,64 @@
+package flasher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+)
+
+func TestLeave(t *testing.T) {
+	tests := []struct {
+		name      string
+		before    string
+		after     string
+		want      string
+		inROM     bool // the device stays in the bootloader
+		classicIO bool // the board has the classic reset circuit
+		holdBoot  bool // every reset enters the bootloader
+	}{
+		{"auto over USB-Serial/JTAG", ResetUSBJTAGSerial, AfterAuto, AfterWatchdogReset, false, false, false},
+		{"auto over USB-Serial/JTAG without reset", ResetNone, AfterAuto, AfterWatchdogReset, false, false, false},
+		{"auto over USB-Serial/JTAG after classic reset", ResetClassic, AfterAuto, AfterWatchdogReset, false, false, false},
+		{"auto over classic circuit", ResetClassic, AfterAuto, AfterHardReset, false, true, false},
+		{"watchdog", ResetClassic, AfterWatchdogReset, AfterWatchdogReset, false, true, false},
+		{"run", ResetClassic, AfterRunWithoutReset, AfterRunWithoutReset, false, true, false},
+		// A reboot would enter the bootloader again; running the
+		// application does not reset the chip
+		{"run with boot held", ResetClassic, AfterRunWithoutReset, AfterRunWithoutReset, false, true, true},
+		{"stay", ResetUSBJTAGSerial, AfterStayInBootloader, AfterStayInBootloader, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := emulator.New(testFlashSize)
+			dev.HoldBoot = tt.holdBoot
+			port := emulator.NewPort(dev)
+			f := New(port)
+			if tt.classicIO {
+				f = New(classicBoard{port})
+			}
+			f.syncTimeout = 10 * time.Millisecond
+			strategies, _ := ResetStrategies(tt.before, nil)
+			f.SetReset(strategies)
+			if err := f.Connect(); err != nil {
+				t.Fatalf("Connect() error: %v", err)
+			}
+
+			got, err := f.Leave(tt.after)
+			if err != nil {
+				t.Fatalf("Leave(%q) error: %v", tt.after, err)
+			}
+			if got != tt.want {
+				t.Errorf("Leave(%q) = %q, want %q", tt.after, got, tt.want)
+			}
+			if dev.InBootloader() != tt.inROM {
+				t.Errorf("InBootloader() = %v after %s, want %v", dev.InBootloader(), got, tt.inROM)
+			}
+		})
+	}
+
+	f, _ := connect(t)
+	if _, err := f.Leave("soft-reset"); err == nil {
+		t.Error("Leave(unknown) should fail")
+	}
+}
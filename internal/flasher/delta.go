@@ -0,0 +1,85 @@
+package flasher
+
+import (
+	"crypto/md5"
+	"fmt"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// DeltaChunkSize is the granularity at which delta flashing compares the
+// device contents with the new image.
+const DeltaChunkSize = protocol.FlashSectorSize
+
+// DeltaResult summarises a delta flash.
+type DeltaResult struct {
+	Total   int // bytes in the image
+	Written int // bytes actually transferred
+	Runs    int // compressed sessions opened
+}
+
+// Saved returns the number of bytes that did not need to be written.
+func (r DeltaResult) Saved() int {
+	return r.Total - r.Written
+}
+
+// span is a byte range of an image, relative to its start.
+type span struct {
+	start, end int
+}
+
+// FlashImageDelta writes only the sectors of data that differ from the
+// device. Each chunk of the target range is hashed on the device, and a
+// separate compressed session is opened for every run of differing chunks.
+func (f *Flasher) FlashImageDelta(data []byte, address uint32) (DeltaResult, error) {
+	result := DeltaResult{Total: len(data)}
+	if address%protocol.FlashSectorSize != 0 {
+		return result, fmt.Errorf("delta flashing needs a sector-aligned address, got 0x%X", address)
+	}
+
+	var sums [][16]byte
+	verify := f.track(StageVerify, address, len(data), 0)
+	verify.report(0, 0)
+	for start := 0; start < len(data); start += DeltaChunkSize {
+		end := min(start+DeltaChunkSize, len(data))
+		sum, err := f.FlashMD5(address+uint32(start), uint32(end-start))
+		if err != nil {
+			return result, fmt.Errorf("failed to hash flash at 0x%X: %w", address+uint32(start), err)
+		}
+		sums = append(sums, sum)
+		verify.report(end, 0)
+	}
+
+	for _, run := range changedRuns(data, sums, DeltaChunkSize) {
+		runAddress := address + uint32(run.start)
+		f.log.Info("writing changed sectors",
+			"start", fmt.Sprintf("0x%X", runAddress),
+			"end", fmt.Sprintf("0x%X", address+uint32(run.end)),
+			"size", run.end-run.start)
+		if err := f.FlashImageCompressed(data[run.start:run.end], runAddress, false); err != nil {
+			return result, err
+		}
+		result.Written += run.end - run.start
+		result.Runs++
+	}
+	return result, nil
+}
+
+// changedRuns compares data chunk by chunk with the device digests in sums
+// and returns the merged runs of chunks that differ.
+func changedRuns(data []byte, sums [][16]byte, chunkSize int) []span {
+	var runs []span
+	for i, sum := range sums {
+		start := i * chunkSize
+		end := min(start+chunkSize, len(data))
+		if md5.Sum(data[start:end]) == sum {
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].end == start {
+			runs[n-1].end = end
+		} else {
+			runs = append(runs, span{start, end})
+		}
+	}
+	return runs
+}
@@ -0,0 +1,55 @@
+package flasher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+)
+
+func deviceSums(device []byte, chunkSize int) [][16]byte {
+	var sums [][16]byte
+	for start := 0; start < len(device); start += chunkSize {
+		sums = append(sums, md5.Sum(device[start:min(start+chunkSize, len(device))]))
+	}
+	return sums
+}
+
+func TestChangedRuns(t *testing.T) {
+	const chunk = 16
+	device := bytes.Repeat([]byte{0xAA}, chunk*8+5)
+
+	image := bytes.Clone(device)
+	image[chunk*1] = 0x00   // chunk 1
+	image[chunk*2+3] = 0x00 // chunk 2, merged with 1
+	image[chunk*5] = 0x00   // chunk 5
+	image[len(image)-1] = 0 // short tail chunk
+
+	runs := changedRuns(image, deviceSums(device, chunk), chunk)
+	want := []span{
+		{chunk * 1, chunk * 3},
+		{chunk * 5, chunk * 6},
+		{chunk * 8, chunk*8 + 5},
+	}
+	if len(runs) != len(want) {
+		t.Fatalf("changedRuns() = %v, want %v", runs, want)
+	}
+	for i := range want {
+		if runs[i] != want[i] {
+			t.Errorf("run %d = %v, want %v", i, runs[i], want[i])
+		}
+	}
+}
+
+func TestChangedRuns_Identical(t *testing.T) {
+	data := bytes.Repeat([]byte{0x12, 0x34}, 100)
+	if runs := changedRuns(data, deviceSums(data, 32), 32); len(runs) != 0 {
+		t.Errorf("changedRuns() of identical data = %v, want none", runs)
+	}
+}
+
+func TestDeltaResult_Saved(t *testing.T) {
+	r := DeltaResult{Total: 0x100000, Written: 0x3000, Runs: 2}
+	if r.Saved() != 0xFD000 {
+		t.Errorf("Saved() = 0x%X, want 0xFD000", r.Saved())
+	}
+}
@@ -0,0 +1,54 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// ErrNoResponse is returned when the device does not answer a request in
+// time.
+var ErrNoResponse = errors.New("timeout waiting for response")
+
+// CommandError reports a request the bootloader answered with an error
+// status.
+type CommandError struct {
+	Command byte
+	Status  byte
+	Code    byte // the ROM error code
+}
+
+func (e *CommandError) Error() string {
+	resp := protocol.Response{Status: e.Status, Error: e.Code}
+	return fmt.Sprintf("command %s failed: %s", protocol.CommandName(e.Command), resp.ErrorString())
+}
+
+// SyncError reports that the bootloader never answered SYNC.
+type SyncError struct {
+	Attempts int
+	Err      error // the error of the last attempt
+}
+
+func (e *SyncError) Error() string {
+	return fmt.Sprintf("sync failed after %d attempts", e.Attempts)
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// BlockError reports a flash data block that failed on every attempt.
+type BlockError struct {
+	Seq      int
+	Attempts int
+	Err      error // the error of the last attempt
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("flash defl data block %d failed: %v", e.Seq, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
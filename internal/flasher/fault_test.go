@@ -0,0 +1,112 @@
+package flasher
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+	"github.com/bigbag/papyrix-flasher/internal/fault"
+)
+
+// flashThrough connects through a faulty link to an emulated device and
+// flashes image at 0x10000.
+func flashThrough(t *testing.T, cfg fault.Config, image []byte) (*emulator.Device, *fault.Port, error) {
+	t.Helper()
+	dev := emulator.New(testFlashSize)
+	port := fault.New(emulator.NewPort(dev), cfg)
+	f := New(port)
+	f.timeout = 300 * time.Millisecond
+
+	if err := f.Connect(); err != nil {
+		return dev, port, err
+	}
+	return dev, port, f.FlashImageCompressed(image, 0x10000, false)
+}
+
+func TestFlasher_Faults(t *testing.T) {
+	image := testImage(48*1024, 7)
+
+	tests := []struct {
+		name string
+		cfg  fault.Config
+		// check inspects the error; nil means the flash must complete
+		check func(error) bool
+	}{
+		{
+			name: "lost requests",
+			cfg:  fault.Config{Seed: 1, Frame: fault.Rates{Drop: 0.1}, Direction: fault.HostToDevice},
+		},
+		{
+			name: "corrupted requests",
+			cfg:  fault.Config{Seed: 1, Frame: fault.Rates{Corrupt: 0.1}, Direction: fault.HostToDevice},
+		},
+		{
+			name: "duplicated responses",
+			cfg:  fault.Config{Seed: 1, Frame: fault.Rates{Duplicate: 0.1}, Direction: fault.DeviceToHost},
+		},
+		{
+			name: "delayed frames",
+			cfg:  fault.Config{Seed: 1, Frame: fault.Rates{Delay: 0.2}, Byte: fault.Rates{Delay: 0.001}, MaxDelay: 30 * time.Millisecond},
+		},
+		{
+			// The device wrote the block, so the retry is out of sequence
+			name: "lost responses",
+			cfg:  fault.Config{Seed: 1, Frame: fault.Rates{Drop: 0.05}, Direction: fault.DeviceToHost},
+			check: func(err error) bool {
+				var block *BlockError
+				var cmd *CommandError
+				return errors.As(err, &block) && errors.As(err, &cmd)
+			},
+		},
+		{
+			// Responses carry no checksum: a flipped status bit is an error
+			name: "corrupted response bytes",
+			cfg:  fault.Config{Seed: 1, Byte: fault.Rates{Corrupt: 0.002}, Direction: fault.DeviceToHost},
+			check: func(err error) bool {
+				var cmd *CommandError
+				return errors.As(err, &cmd)
+			},
+		},
+		{
+			name: "duplicated requests",
+			cfg:  fault.Config{Seed: 1, Frame: fault.Rates{Duplicate: 0.1}, Direction: fault.HostToDevice},
+			check: func(err error) bool {
+				var block *BlockError
+				return errors.As(err, &block)
+			},
+		},
+		{
+			name: "dead link",
+			cfg:  fault.Config{Frame: fault.Rates{Drop: 1}, Direction: fault.DeviceToHost},
+			check: func(err error) bool {
+				var sync *SyncError
+				return errors.As(err, &sync) && errors.Is(err, ErrNoResponse)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, port, err := flashThrough(t, tt.cfg, image)
+			t.Logf("faults: %+v, err: %v", port.Stats(), err)
+			if port.Stats() == (fault.Stats{}) {
+				t.Fatal("no faults injected")
+			}
+
+			if tt.check != nil {
+				if err == nil || !tt.check(err) {
+					t.Errorf("error = %v (%T), want the typed error of the pattern", err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("flash failed: %v", err)
+			}
+			if got := dev.Flash()[0x10000 : 0x10000+len(image)]; !bytes.Equal(got, image) {
+				t.Error("flash contents differ from the image")
+			}
+		})
+	}
+}
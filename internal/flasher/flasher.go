@@ -3,19 +3,38 @@ package flasher
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
+	"crypto/md5"
 	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"time"
 
 	"github.com/bigbag/papyrix-flasher/internal/protocol"
-	"github.com/bigbag/papyrix-flasher/internal/serial"
 	"github.com/bigbag/papyrix-flasher/internal/slip"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
 )
 
 // Flasher handles flashing firmware to ESP32 devices.
 type Flasher struct {
-	port *serial.Port
+	port      transport.Transport
+	flashSize uint32
+	log       *slog.Logger
+	progress  ProgressFunc
+	// timeout bounds the wait for the response to a command.
+	timeout time.Duration
+	// syncTimeout bounds the wait for the response to each SYNC.
+	syncTimeout time.Duration
+
+	reset     []ResetStrategy
+	resetUsed string
 }
 
+// LevelTrace is the log level of protocol traffic: every request and
+// response, below slog.LevelDebug.
+const LevelTrace = slog.LevelDebug - 4
+
 // FlashRegion represents a region to flash.
 type FlashRegion struct {
 	Address uint32
@@ -24,20 +43,33 @@ type FlashRegion struct {
 }
 
 // New creates a new Flasher for the given port.
-func New(port *serial.Port) *Flasher {
-	return &Flasher{port: port}
+func New(port transport.Transport) *Flasher {
+	return &Flasher{
+		port:        port,
+		flashSize:   protocol.DefaultFlashSize,
+		log:         slog.Default(),
+		timeout:     5 * time.Second,
+		syncTimeout: 500 * time.Millisecond,
+		reset:       []ResetStrategy{classicReset},
+	}
+}
+
+// SetLogger sets the logger for status messages and, at LevelTrace,
+// protocol traffic.
+func (f *Flasher) SetLogger(logger *slog.Logger) {
+	f.log = logger
+}
+
+// SetFlashSize sets the flash size configured on Connect.
+func (f *Flasher) SetFlashSize(size uint32) {
+	f.flashSize = size
 }
 
 // Connect establishes connection with the bootloader.
 func (f *Flasher) Connect() error {
-	// Reset into bootloader
-	if err := f.port.ResetToBootloader(); err != nil {
-		return fmt.Errorf("failed to reset into bootloader: %w", err)
-	}
-
-	// Sync with bootloader
-	if err := f.sync(); err != nil {
-		return fmt.Errorf("failed to sync with bootloader: %w", err)
+	// Reset into bootloader and sync with it
+	if err := f.enterBootloader(); err != nil {
+		return err
 	}
 
 	// Attach SPI flash
@@ -45,8 +77,9 @@ func (f *Flasher) Connect() error {
 		return fmt.Errorf("failed to attach SPI flash: %w", err)
 	}
 
-	// Set flash parameters (16MB flash)
-	if err := f.spiSetParams(16 * 1024 * 1024); err != nil {
+	// Set flash parameters
+	f.log.Debug("setting flash parameters", "size", f.flashSize)
+	if err := f.spiSetParams(f.flashSize); err != nil {
 		return fmt.Errorf("failed to set flash params: %w", err)
 	}
 
@@ -56,30 +89,38 @@ func (f *Flasher) Connect() error {
 // sync sends the SYNC command to establish communication.
 func (f *Flasher) sync() error {
 	syncReq := protocol.NewRequest(protocol.CmdSync, protocol.SyncData())
-	frame := slip.Encode(syncReq.Encode())
 
+	var lastErr error
 	for attempt := 0; attempt < 10; attempt++ {
 		f.port.Flush()
 
-		if _, err := f.port.Write(frame); err != nil {
+		if err := f.writeRequest(syncReq); err != nil {
+			f.log.Debug("sync write failed", "attempt", attempt+1, "err", err)
+			lastErr = err
 			continue
 		}
 
-		resp, err := f.readResponse(500 * time.Millisecond)
+		resp, err := f.readResponse(f.syncTimeout)
 		if err != nil {
+			f.log.Debug("no sync response", "attempt", attempt+1, "err", err)
+			lastErr = err
 			continue
 		}
 
 		if resp.Command == protocol.CmdSync && resp.IsSuccess() {
+			f.log.Debug("synced", "attempt", attempt+1)
 			// Drain any additional sync responses
 			for i := 0; i < 7; i++ {
 				f.readResponse(100 * time.Millisecond)
 			}
 			return nil
 		}
+		if resp.Command == protocol.CmdSync {
+			lastErr = &CommandError{Command: resp.Command, Status: resp.Status, Code: resp.Error}
+		}
 	}
 
-	return fmt.Errorf("sync failed after 10 attempts")
+	return &SyncError{Attempts: 10, Err: lastErr}
 }
 
 // spiAttach attaches the SPI flash.
@@ -94,6 +135,80 @@ func (f *Flasher) spiSetParams(flashSize uint32) error {
 	return f.sendCommand(req)
 }
 
+// ChipID returns the chip ID reported by GET_SECURITY_INFO.
+func (f *Flasher) ChipID() (uint32, error) {
+	req := protocol.NewRequest(protocol.CmdGetSecurityInfo, nil)
+	resp, err := f.command(req, f.timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := protocol.ParseSecurityInfo(resp.Data)
+	if err != nil {
+		return 0, err
+	}
+	return info.ChipID, nil
+}
+
+// ReadReg reads a 32-bit register or memory word.
+func (f *Flasher) ReadReg(address uint32) (uint32, error) {
+	req := protocol.NewRequest(protocol.CmdReadReg, protocol.ReadRegData(address))
+	resp, err := f.command(req, f.timeout)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Value, nil
+}
+
+// WriteReg writes a 32-bit register or memory word.
+func (f *Flasher) WriteReg(address, value uint32) error {
+	req := protocol.NewRequest(protocol.CmdWriteReg, protocol.WriteRegData(address, value))
+	return f.sendCommand(req)
+}
+
+// MAC returns the factory MAC address from eFuse, e.g. "58:cf:79:01:02:03".
+func (f *Flasher) MAC() (string, error) {
+	word0, err := f.ReadReg(protocol.EfuseMacWord0)
+	if err != nil {
+		return "", err
+	}
+	word1, err := f.ReadReg(protocol.EfuseMacWord1)
+	if err != nil {
+		return "", err
+	}
+	mac := protocol.MACFromEfuse(word0, word1)
+	return net.HardwareAddr(mac[:]).String(), nil
+}
+
+// FlashMD5 returns the MD5 digest of size bytes of flash at address,
+// computed on the device.
+func (f *Flasher) FlashMD5(address, size uint32) ([16]byte, error) {
+	req := protocol.NewRequest(protocol.CmdSpiFlashMD5, protocol.SpiFlashMD5Data(address, size))
+
+	// The ROM hashes roughly 1MB every 8 seconds
+	timeout := time.Duration(size/1024/1024*8+3) * time.Second
+	resp, err := f.command(req, timeout)
+	if err != nil {
+		return [16]byte{}, err
+	}
+	return protocol.ParseFlashMD5(resp.Data)
+}
+
+// RegionMatches reports whether the flash already holds the region's data.
+func (f *Flasher) RegionMatches(region FlashRegion) (bool, error) {
+	if len(region.Data) == 0 {
+		return true, nil
+	}
+	verify := f.track(StageVerify, region.Address, len(region.Data), 0)
+	verify.report(0, 0)
+	sum, err := f.FlashMD5(region.Address, uint32(len(region.Data)))
+	if err != nil {
+		return false, err
+	}
+	verify.report(len(region.Data), 0)
+	return sum == md5.Sum(region.Data), nil
+}
+
 // FlashImageCompressed flashes a binary image using deflate compression.
 func (f *Flasher) FlashImageCompressed(data []byte, address uint32, verify bool) error {
 	// Compress the data using zlib
@@ -110,8 +225,8 @@ func (f *Flasher) FlashImageCompressed(data []byte, address uint32, verify bool)
 	}
 
 	compressedData := compressed.Bytes()
-	compressionRatio := float64(len(data)) / float64(len(compressedData))
-	fmt.Printf("Compressed %d -> %d bytes (%.1fx compression)\n", len(data), len(compressedData), compressionRatio)
+	ratio := float64(len(data)) / float64(len(compressedData))
+	f.log.Info("compressed", "size", len(data), "compressed", len(compressedData), "ratio", math.Round(ratio*10)/10)
 
 	// Calculate blocks for compressed data
 	blockSize := protocol.FlashBlockSize
@@ -126,12 +241,17 @@ func (f *Flasher) FlashImageCompressed(data []byte, address uint32, verify bool)
 
 	// Calculate erase timeout based on uncompressed size
 	eraseTimeout := time.Duration(eraseSize/1024/1024*3+5) * time.Second
+	erase := f.track(StageErase, address, int(eraseSize), 0)
+	erase.report(0, 0)
 	if err := f.sendCommandWithTimeout(beginReq, eraseTimeout); err != nil {
 		return fmt.Errorf("flash defl begin failed: %w", err)
 	}
+	erase.report(int(eraseSize), 0)
 
 	// Send compressed data blocks
 	totalBlocks := int(numBlocks)
+	write := f.track(StageWrite, address, len(data), totalBlocks)
+	write.report(0, 0)
 	for seq := 0; seq < totalBlocks; seq++ {
 		start := seq * blockSize
 		end := start + blockSize
@@ -150,72 +270,81 @@ func (f *Flasher) FlashImageCompressed(data []byte, address uint32, verify bool)
 			if sendErr == nil {
 				break
 			}
+			f.log.Debug("retrying block", "seq", seq, "attempt", attempt+1, "err", sendErr)
 			time.Sleep(100 * time.Millisecond)
 			f.port.Flush()
 		}
 		if sendErr != nil {
-			return fmt.Errorf("flash defl data block %d failed: %w", seq, sendErr)
+			return &BlockError{Seq: seq, Attempts: 3, Err: sendErr}
 		}
+		write.report(len(data)*end/len(compressedData), seq+1)
 	}
 
-	// Send FLASH_DEFL_END - don't wait too long as device might reset
-	endData := protocol.FlashDeflEndData(false)
-	endReq := protocol.NewRequest(protocol.CmdFlashDeflEnd, endData)
-	frame := slip.Encode(endReq.Encode())
-	if _, err := f.port.Write(frame); err != nil {
-		fmt.Printf("Warning: flash end write error (may be normal): %v\n", err)
-	}
-	// Try to read response but don't fail if it times out
-	if _, err := f.readResponse(2 * time.Second); err != nil {
-		fmt.Printf("Warning: flash end response timeout (may be normal): %v\n", err)
-	}
-
+	// No FLASH_DEFL_END: the ROM has written the data once it acknowledges
+	// the last block, and would leave the bootloader on either flag value
 	return nil
 }
 
-// Reboot reboots the device.
+// Reboot restarts the application with the reset that works for the
+// interface; see Leave.
 func (f *Flasher) Reboot() error {
-	endData := protocol.FlashEndData(true)
-	endReq := protocol.NewRequest(protocol.CmdFlashEnd, endData)
-	frame := slip.Encode(endReq.Encode())
-
-	_, err := f.port.Write(frame)
-	if err != nil {
-		return err
-	}
-
-	time.Sleep(100 * time.Millisecond)
-	return f.port.HardReset()
+	_, err := f.Leave(AfterAuto)
+	return err
 }
 
 // sendCommand sends a command and waits for successful response.
 func (f *Flasher) sendCommand(req *protocol.Request) error {
-	return f.sendCommandWithTimeout(req, 5*time.Second)
+	return f.sendCommandWithTimeout(req, f.timeout)
 }
 
 // sendCommandWithTimeout sends a command with a specific timeout.
 func (f *Flasher) sendCommandWithTimeout(req *protocol.Request, timeout time.Duration) error {
-	frame := slip.Encode(req.Encode())
+	_, err := f.command(req, timeout)
+	return err
+}
 
-	if _, err := f.port.Write(frame); err != nil {
-		return err
+// command sends a command and returns the successful response.
+func (f *Flasher) command(req *protocol.Request, timeout time.Duration) (*protocol.Response, error) {
+	if err := f.writeRequest(req); err != nil {
+		return nil, err
 	}
 
-	resp, err := f.readResponse(timeout)
-	if err != nil {
-		return err
-	}
+	// Skip responses left over from earlier requests, e.g. duplicated by
+	// a bad link or answered after we gave up on them
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := f.readResponse(time.Until(deadline))
+		if err != nil {
+			f.log.Log(context.Background(), LevelTrace, "no response", "cmd", protocol.CommandName(req.Command), "err", err)
+			return nil, err
+		}
+		if resp.Command != req.Command {
+			f.log.Log(context.Background(), LevelTrace, "unexpected response", "cmd", protocol.CommandName(resp.Command))
+			continue
+		}
 
-	if !resp.IsSuccess() {
-		return fmt.Errorf("command 0x%02X failed: %s", req.Command, resp.ErrorString())
+		if !resp.IsSuccess() {
+			return nil, &CommandError{Command: req.Command, Status: resp.Status, Code: resp.Error}
+		}
+		return resp, nil
 	}
+}
 
-	return nil
+// writeRequest sends a request to the bootloader.
+func (f *Flasher) writeRequest(req *protocol.Request) error {
+	f.log.Log(context.Background(), LevelTrace, "request",
+		"cmd", protocol.CommandName(req.Command),
+		"len", len(req.Data),
+		"checksum", fmt.Sprintf("0x%02X", req.Checksum))
+
+	_, err := f.port.Write(slip.Encode(req.Encode()))
+	return err
 }
 
 // readResponse reads and decodes a response from the bootloader.
 func (f *Flasher) readResponse(timeout time.Duration) (*protocol.Response, error) {
-	deadline := time.Now().Add(timeout)
+	started := time.Now()
+	deadline := started.Add(timeout)
 	var buffer []byte
 
 	for time.Now().Before(deadline) {
@@ -234,10 +363,23 @@ func (f *Flasher) readResponse(timeout time.Duration) (*protocol.Response, error
 			buffer = remaining
 			data := slip.Decode(frame)
 			if len(data) >= 10 {
-				return protocol.DecodeResponse(data)
+				resp, err := protocol.DecodeResponse(data)
+				if err != nil {
+					// A garbled frame; the device may still answer
+					f.log.Log(context.Background(), LevelTrace, "invalid response", "len", len(data), "err", err)
+					continue
+				}
+				f.log.Log(context.Background(), LevelTrace, "response",
+					"cmd", protocol.CommandName(resp.Command),
+					"len", len(resp.Data),
+					"value", fmt.Sprintf("0x%08X", resp.Value),
+					"status", resp.Status,
+					"error", resp.Error,
+					"elapsed", time.Since(started).Round(time.Microsecond))
+				return resp, nil
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("timeout waiting for response")
+	return nil, ErrNoResponse
 }
@@ -0,0 +1,202 @@
+package flasher
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+)
+
+const testFlashSize = 4 * 1024 * 1024
+
+// connect returns a flasher connected to an emulated device.
+func connect(t *testing.T) (*Flasher, *emulator.Device) {
+	t.Helper()
+	dev := emulator.New(testFlashSize)
+	f := New(emulator.NewPort(dev))
+	if err := f.Connect(); err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	return f, dev
+}
+
+// testImage returns size bytes of partly compressible data.
+func testImage(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data[:size/2])
+	return data
+}
+
+func TestFlasher_DeviceInfo(t *testing.T) {
+	f, _ := connect(t)
+
+	id, err := f.ChipID()
+	if err != nil {
+		t.Fatalf("ChipID() error: %v", err)
+	}
+	if id != protocol.ChipIDESP32C3 {
+		t.Errorf("ChipID() = 0x%X, want 0x%X", id, protocol.ChipIDESP32C3)
+	}
+
+	mac, err := f.MAC()
+	if err != nil {
+		t.Fatalf("MAC() error: %v", err)
+	}
+	if mac != "58:cf:79:00:00:01" {
+		t.Errorf("MAC() = %q, want 58:cf:79:00:00:01", mac)
+	}
+}
+
+func TestFlasher_FlashImageCompressed(t *testing.T) {
+	f, dev := connect(t)
+	image := testImage(100*1024+123, 1)
+
+	if err := f.FlashImageCompressed(image, 0x10000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+	if got := dev.Flash()[0x10000 : 0x10000+len(image)]; !bytes.Equal(got, image) {
+		t.Error("flash contents differ from the image")
+	}
+
+	match, err := f.RegionMatches(FlashRegion{Address: 0x10000, Data: image})
+	if err != nil {
+		t.Fatalf("RegionMatches() error: %v", err)
+	}
+	if !match {
+		t.Error("RegionMatches() = false after flashing")
+	}
+
+	image[5] ^= 0xFF
+	if match, _ := f.RegionMatches(FlashRegion{Address: 0x10000, Data: image}); match {
+		t.Error("RegionMatches() = true for a changed image")
+	}
+}
+
+// capturePort is an emulated port that keeps the requests written to it.
+type capturePort struct {
+	*emulator.Port
+	requests []*protocol.Request
+}
+
+func (p *capturePort) Write(data []byte) (int, error) {
+	if frame, _ := slip.ReadFrame(data); frame != nil {
+		if req, err := protocol.DecodeRequest(slip.Decode(frame)); err == nil {
+			p.requests = append(p.requests, req)
+		}
+	}
+	return p.Port.Write(data)
+}
+
+func TestFlasher_FlashImageCompressed_Checksum(t *testing.T) {
+	port := &capturePort{Port: emulator.NewPort(emulator.New(testFlashSize))}
+	f := New(port)
+	if err := f.Connect(); err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	if err := f.FlashImageCompressed(testImage(4*protocol.FlashBlockSize, 2), 0x10000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+
+	// The ROM checks data blocks against 0xEF XORed with the payload
+	// after the 16-byte header
+	blocks := 0
+	for _, req := range port.requests {
+		if req.Command != protocol.CmdFlashDeflData {
+			continue
+		}
+		want := uint32(0xEF)
+		for _, b := range req.Data[16:] {
+			want ^= uint32(b)
+		}
+		if req.Checksum != want {
+			t.Errorf("block %d: checksum = 0x%02X, want 0x%02X", blocks, req.Checksum, want)
+		}
+		blocks++
+	}
+	if blocks < 2 {
+		t.Errorf("sent %d FLASH_DEFL_DATA blocks, want several", blocks)
+	}
+}
+
+func TestFlasher_FlashImageDelta(t *testing.T) {
+	f, dev := connect(t)
+	image := testImage(16*DeltaChunkSize, 2)
+	if err := f.FlashImageCompressed(image, 0x20000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+
+	image[3*DeltaChunkSize+1] ^= 0xFF
+	image[10*DeltaChunkSize] ^= 0xFF
+	result, err := f.FlashImageDelta(image, 0x20000)
+	if err != nil {
+		t.Fatalf("FlashImageDelta() error: %v", err)
+	}
+	if result.Runs != 2 || result.Written != 2*DeltaChunkSize {
+		t.Errorf("FlashImageDelta() = %+v, want 2 runs of one chunk", result)
+	}
+	if got := dev.Flash()[0x20000 : 0x20000+len(image)]; !bytes.Equal(got, image) {
+		t.Error("flash contents differ from the image")
+	}
+}
+
+func TestFlasher_SegmentedResume(t *testing.T) {
+	f, dev := connect(t)
+	image := testImage(SegmentSize+3*protocol.FlashSectorSize, 3)
+
+	// Only the first segment made it before the link dropped
+	if err := f.FlashImageCompressed(image[:SegmentSize], 0x100000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+	from, err := f.ResumePoint(image, 0x100000, SegmentSize)
+	if err != nil {
+		t.Fatalf("ResumePoint() error: %v", err)
+	}
+	if from != SegmentSize {
+		t.Errorf("ResumePoint() = 0x%X, want 0x%X", from, SegmentSize)
+	}
+
+	var verified []int
+	if err := f.FlashImageSegmented(image, 0x100000, from, func(n int) { verified = append(verified, n) }); err != nil {
+		t.Fatalf("FlashImageSegmented() error: %v", err)
+	}
+	if len(verified) != 1 || verified[0] != len(image) {
+		t.Errorf("verified = %v, want [%d]", verified, len(image))
+	}
+	if got := dev.Flash()[0x100000 : 0x100000+len(image)]; !bytes.Equal(got, image) {
+		t.Error("flash contents differ from the image")
+	}
+}
+
+func TestFlasher_ReadFlash(t *testing.T) {
+	f, dev := connect(t)
+	image := testImage(1000, 4)
+	if err := f.FlashImageCompressed(image, 0x10000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+	user, _ := f.ReadReg(protocol.SPI1User)
+
+	// Unaligned, with a short last chunk
+	got, err := f.ReadFlash(0x10000+3, 701)
+	if err != nil {
+		t.Fatalf("ReadFlash() error: %v", err)
+	}
+	if want := dev.Flash()[0x10000+3 : 0x10000+3+701]; !bytes.Equal(got, want) {
+		t.Error("ReadFlash() data differs from the flash contents")
+	}
+	if after, _ := f.ReadReg(protocol.SPI1User); after != user {
+		t.Errorf("SPI1 USER register = 0x%X after ReadFlash, want 0x%X", after, user)
+	}
+}
+
+func TestFlasher_Reboot(t *testing.T) {
+	f, dev := connect(t)
+	if err := f.Reboot(); err != nil {
+		t.Fatalf("Reboot() error: %v", err)
+	}
+	if dev.InBootloader() {
+		t.Error("device still in the bootloader after Reboot()")
+	}
+}
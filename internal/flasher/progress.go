@@ -0,0 +1,99 @@
+package flasher
+
+import "time"
+
+// Stage identifies the phase of a flash operation.
+type Stage int
+
+const (
+	StageErase Stage = iota
+	StageWrite
+	StageVerify
+	StageRead
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageErase:
+		return "Erasing"
+	case StageWrite:
+		return "Writing"
+	case StageVerify:
+		return "Verifying"
+	case StageRead:
+		return "Reading"
+	default:
+		return "Working"
+	}
+}
+
+// Progress reports the state of a flash operation. Byte counts refer to
+// the uncompressed image; while writing, Done is estimated from the share
+// of compressed blocks sent.
+type Progress struct {
+	Stage   Stage
+	Address uint32
+	Done    int
+	Total   int
+	Block   int // blocks sent, while writing
+	Blocks  int
+	Elapsed time.Duration
+	Rate    float64       // bytes per second
+	ETA     time.Duration // zero when unknown
+}
+
+// Finished reports whether the stage is complete.
+func (p Progress) Finished() bool {
+	return p.Done >= p.Total
+}
+
+// Fraction returns the completed share of the stage, from 0 to 1.
+func (p Progress) Fraction() float64 {
+	if p.Total <= 0 {
+		return 1
+	}
+	return min(float64(p.Done)/float64(p.Total), 1)
+}
+
+// ProgressFunc receives progress updates. It is called from the goroutine
+// running the flash operation.
+type ProgressFunc func(Progress)
+
+// SetProgress sets the function that receives progress updates.
+func (f *Flasher) SetProgress(fn ProgressFunc) {
+	f.progress = fn
+}
+
+// tracker computes rate and ETA for one stage.
+type tracker struct {
+	fn      ProgressFunc
+	stage   Stage
+	address uint32
+	total   int
+	blocks  int
+	started time.Time
+}
+
+func (f *Flasher) track(stage Stage, address uint32, total, blocks int) *tracker {
+	return &tracker{fn: f.progress, stage: stage, address: address, total: total, blocks: blocks, started: time.Now()}
+}
+
+func (t *tracker) report(done, block int) {
+	if t.fn == nil {
+		return
+	}
+	p := Progress{
+		Stage:   t.stage,
+		Address: t.address,
+		Done:    min(done, t.total),
+		Total:   t.total,
+		Block:   block,
+		Blocks:  t.blocks,
+		Elapsed: time.Since(t.started),
+	}
+	if secs := p.Elapsed.Seconds(); secs > 0 && p.Done > 0 {
+		p.Rate = float64(p.Done) / secs
+		p.ETA = time.Duration(float64(p.Total-p.Done) / p.Rate * float64(time.Second))
+	}
+	t.fn(p)
+}
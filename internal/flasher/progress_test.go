@@ -0,0 +1,63 @@
+package flasher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker_Report(t *testing.T) {
+	var got []Progress
+	f := &Flasher{}
+	f.SetProgress(func(p Progress) { got = append(got, p) })
+
+	tr := f.track(StageWrite, 0x10000, 4000, 4)
+	tr.started = time.Now().Add(-2 * time.Second)
+	tr.report(0, 0)
+	tr.report(1000, 1)
+	tr.report(5000, 4) // clamped to the total
+
+	if len(got) != 3 {
+		t.Fatalf("got %d reports, want 3", len(got))
+	}
+
+	first := got[0]
+	if first.Rate != 0 || first.ETA != 0 || first.Fraction() != 0 {
+		t.Errorf("first report = %+v, want no rate or ETA", first)
+	}
+
+	mid := got[1]
+	if mid.Stage != StageWrite || mid.Address != 0x10000 || mid.Block != 1 || mid.Blocks != 4 {
+		t.Errorf("mid report = %+v", mid)
+	}
+	if mid.Rate < 400 || mid.Rate > 500 {
+		t.Errorf("mid Rate = %.0f, want about 500 bytes/s", mid.Rate)
+	}
+	if mid.ETA < 5*time.Second || mid.ETA > 7*time.Second {
+		t.Errorf("mid ETA = %s, want about 6s", mid.ETA)
+	}
+	if mid.Finished() {
+		t.Error("mid report Finished() = true")
+	}
+
+	last := got[2]
+	if last.Done != 4000 || !last.Finished() || last.Fraction() != 1 {
+		t.Errorf("last report = %+v, want finished", last)
+	}
+}
+
+func TestTracker_NoCallback(t *testing.T) {
+	f := &Flasher{}
+	f.track(StageErase, 0, 100, 0).report(50, 0) // must not panic
+}
+
+func TestStage_String(t *testing.T) {
+	for stage, want := range map[Stage]string{
+		StageErase:  "Erasing",
+		StageWrite:  "Writing",
+		StageVerify: "Verifying",
+	} {
+		if got := stage.String(); got != want {
+			t.Errorf("Stage(%d).String() = %q, want %q", stage, got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// spiPolls bounds how often a SPI command is checked for completion.
+const spiPolls = 10
+
+// ReadFlash reads size bytes of flash at address. The ROM bootloader has
+// no read command, so each 64 bytes are read with a SPI READ command run
+// on the SPI1 controller, as esptool runs SPI flash commands. It takes
+// about twenty round trips per 64 bytes: fine for a partition, slow for a
+// whole flash.
+func (f *Flasher) ReadFlash(address, size uint32) ([]byte, error) {
+	user, err := f.ReadReg(protocol.SPI1User)
+	if err != nil {
+		return nil, err
+	}
+	user2, err := f.ReadReg(protocol.SPI1User2)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := f.readFlash(address, size)
+
+	// Leave the controller as the ROM set it up
+	if restoreErr := f.writeRegs([]regWrite{{protocol.SPI1User, user}, {protocol.SPI1User2, user2}}); err == nil {
+		err = restoreErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type regWrite struct {
+	reg, value uint32
+}
+
+func (f *Flasher) writeRegs(writes []regWrite) error {
+	for _, w := range writes {
+		if err := f.WriteReg(w.reg, w.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Flasher) readFlash(address, size uint32) ([]byte, error) {
+	// An 8-bit READ command with a 24-bit address
+	err := f.writeRegs([]regWrite{
+		{protocol.SPI1User, protocol.SPI1UserCommand | protocol.SPI1UserAddr | protocol.SPI1UserMiso},
+		{protocol.SPI1User1, 23 << protocol.SPI1AddrLenShift},
+		{protocol.SPI1User2, 7<<protocol.SPI1CmdLenShift | protocol.FlashCmdRead},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	read := f.track(StageRead, address, int(size), 0)
+	read.report(0, 0)
+	data := make([]byte, 0, size)
+	chunkLen := uint32(0)
+	for done := uint32(0); done < size; done += protocol.SPI1BufferSize {
+		n := min(size-done, protocol.SPI1BufferSize)
+		if n != chunkLen {
+			if err := f.WriteReg(protocol.SPI1MisoLen, n*8-1); err != nil {
+				return nil, err
+			}
+			chunkLen = n
+		}
+		if err := f.writeRegs([]regWrite{{protocol.SPI1Addr, address + done}, {protocol.SPI1Cmd, protocol.SPI1CmdUsr}}); err != nil {
+			return nil, err
+		}
+		if err := f.waitSPI(); err != nil {
+			return nil, fmt.Errorf("failed to read flash at 0x%X: %w", address+done, err)
+		}
+
+		var word [4]byte
+		for off := uint32(0); off < n; off += 4 {
+			value, err := f.ReadReg(protocol.SPI1W0 + off)
+			if err != nil {
+				return nil, err
+			}
+			binary.LittleEndian.PutUint32(word[:], value)
+			data = append(data, word[:min(4, n-off)]...)
+		}
+		read.report(len(data), 0)
+	}
+	return data, nil
+}
+
+// waitSPI waits for the SPI1 user command to complete.
+func (f *Flasher) waitSPI() error {
+	for i := 0; i < spiPolls; i++ {
+		cmd, err := f.ReadReg(protocol.SPI1Cmd)
+		if err != nil {
+			return err
+		}
+		if cmd&protocol.SPI1CmdUsr == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("SPI command did not complete")
+}
@@ -0,0 +1,84 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+	"github.com/bigbag/papyrix-flasher/internal/trace"
+)
+
+// session builds the trace of a conversation with the ROM bootloader.
+type session []trace.Event
+
+func (s *session) control(op string) {
+	*s = append(*s, trace.Event{Dir: trace.Control, Data: []byte(op)})
+}
+
+func (s *session) request(cmd byte, data []byte) {
+	req := protocol.NewRequest(cmd, data)
+	*s = append(*s, trace.Event{Dir: trace.Write, Data: slip.Encode(req.Encode())})
+}
+
+func (s *session) response(cmd byte, value uint32, data []byte, status, code byte) {
+	resp := &protocol.Response{Command: cmd, Value: value, Data: data, Status: status, Error: code}
+	*s = append(*s, trace.Event{Dir: trace.Read, Data: slip.Encode(resp.Encode())})
+}
+
+func (s *session) connect() {
+	s.control(trace.OpReset)
+	s.control(trace.OpFlush)
+	s.request(protocol.CmdSync, protocol.SyncData())
+	for range 8 {
+		s.response(protocol.CmdSync, 0, nil, 0, 0)
+	}
+	s.request(protocol.CmdSpiAttach, protocol.SpiAttachData())
+	s.response(protocol.CmdSpiAttach, 0, nil, 0, 0)
+	s.request(protocol.CmdSpiSetParams, protocol.SpiSetParamsData(protocol.DefaultFlashSize))
+	s.response(protocol.CmdSpiSetParams, 0, nil, 0, 0)
+}
+
+func TestReplay_ConnectAndChipID(t *testing.T) {
+	var s session
+	s.connect()
+	s.request(protocol.CmdGetSecurityInfo, nil)
+	info := make([]byte, 12)
+	binary.LittleEndian.PutUint32(info, protocol.ChipIDESP32C3)
+	s.response(protocol.CmdGetSecurityInfo, 0, info, 0, 0)
+
+	replay := trace.NewReplay(s)
+	f := New(replay)
+	if err := f.Connect(); err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	id, err := f.ChipID()
+	if err != nil {
+		t.Fatalf("ChipID() error: %v", err)
+	}
+	if id != protocol.ChipIDESP32C3 {
+		t.Errorf("ChipID() = 0x%X, want 0x%X", id, protocol.ChipIDESP32C3)
+	}
+	if !replay.Done() {
+		t.Error("session not fully replayed")
+	}
+}
+
+func TestReplay_CommandFailure(t *testing.T) {
+	var s session
+	s.control(trace.OpReset)
+	s.control(trace.OpFlush)
+	s.request(protocol.CmdSync, protocol.SyncData())
+	s.response(protocol.CmdSync, 0, nil, 0, 0)
+	s.request(protocol.CmdSpiAttach, protocol.SpiAttachData())
+	s.response(protocol.CmdSpiAttach, 0, nil, 1, 0x05)
+
+	err := New(trace.NewReplay(s)).Connect()
+	if err == nil {
+		t.Fatal("Connect() should fail")
+	}
+	if !strings.Contains(err.Error(), "SPI_ATTACH") || !strings.Contains(err.Error(), "error=0x05") {
+		t.Errorf("Connect() error = %q", err)
+	}
+}
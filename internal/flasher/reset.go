@@ -0,0 +1,150 @@
+package flasher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bigbag/papyrix-flasher/internal/reset"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// Reset strategy names
+const (
+	ResetAuto          = "auto"
+	ResetClassic       = "classic"
+	ResetUSBJTAGSerial = "usb-jtag-serial"
+	ResetNone          = "no-reset"
+	ResetManual        = "manual"
+)
+
+// USB IDs of the ESP32-C3's USB-Serial/JTAG controller.
+const (
+	usbJTAGSerialVID = 0x303A
+	usbJTAGSerialPID = 0x1001
+)
+
+// isUSBJTAGSerial reports whether port is a USB-Serial/JTAG controller.
+func isUSBJTAGSerial(port transport.Transport) bool {
+	vid, pid := transport.USBID(port)
+	return vid == usbJTAGSerialVID && pid == usbJTAGSerialPID
+}
+
+// ResetNames lists the names ResetStrategies accepts.
+var ResetNames = []string{ResetAuto, ResetClassic, ResetUSBJTAGSerial, ResetNone, ResetManual}
+
+// ResetStrategy is a way to put a device into its ROM bootloader.
+type ResetStrategy struct {
+	Name  string
+	Reset func(port transport.Transport) error
+}
+
+var (
+	classicReset = ResetStrategy{ResetClassic, func(port transport.Transport) error {
+		return port.ResetToBootloader()
+	}}
+	usbJTAGSerialReset = ResetStrategy{ResetUSBJTAGSerial, func(port transport.Transport) error {
+		if err := reset.USBJTAGSerial(port); err != nil {
+			return err
+		}
+		return port.Flush()
+	}}
+	noReset = ResetStrategy{ResetNone, func(port transport.Transport) error {
+		return port.Flush()
+	}}
+)
+
+// ResetStrategies returns the strategies for a reset name, to be tried in
+// order. Auto tries the USB-Serial/JTAG controller of the Xteink X4 first,
+// then the classic DTR/RTS circuit, then asks the user if prompt is set.
+// The manual strategy calls prompt, which returns once the user has put
+// the device into its bootloader.
+func ResetStrategies(name string, prompt func()) ([]ResetStrategy, error) {
+	manual := ResetStrategy{ResetManual, func(port transport.Transport) error {
+		prompt()
+		return port.Flush()
+	}}
+
+	switch name {
+	case ResetAuto:
+		strategies := []ResetStrategy{usbJTAGSerialReset, classicReset}
+		if prompt != nil {
+			strategies = append(strategies, manual)
+		}
+		return strategies, nil
+	case ResetClassic:
+		return []ResetStrategy{classicReset}, nil
+	case ResetUSBJTAGSerial:
+		return []ResetStrategy{usbJTAGSerialReset}, nil
+	case ResetNone:
+		return []ResetStrategy{noReset}, nil
+	case ResetManual:
+		if prompt == nil {
+			return nil, fmt.Errorf("manual reset needs an interactive console")
+		}
+		return []ResetStrategy{manual}, nil
+	default:
+		return nil, fmt.Errorf("unknown reset %q (use %s)", name, strings.Join(ResetNames, ", "))
+	}
+}
+
+// BootloaderReset returns the reset of a reset name, for when nothing
+// syncs with the bootloader to tell whether a strategy worked, as in the
+// serial monitor. Auto picks the USB-Serial/JTAG reset for that
+// controller and the classic reset for other ports.
+func BootloaderReset(name string, prompt func()) (func(port transport.Transport) error, error) {
+	strategies, err := ResetStrategies(name, prompt)
+	if err != nil {
+		return nil, err
+	}
+	if name != ResetAuto {
+		return strategies[0].Reset, nil
+	}
+	return func(port transport.Transport) error {
+		if isUSBJTAGSerial(port) {
+			return usbJTAGSerialReset.Reset(port)
+		}
+		return classicReset.Reset(port)
+	}, nil
+}
+
+// SetReset sets the strategies Connect tries, in order, until the
+// bootloader answers. The default is the classic reset.
+func (f *Flasher) SetReset(strategies []ResetStrategy) {
+	f.reset = strategies
+}
+
+// ResetUsed returns the name of the strategy that reached the bootloader
+// on Connect.
+func (f *Flasher) ResetUsed() string {
+	return f.resetUsed
+}
+
+// enterBootloader resets the device with each strategy in turn and syncs
+// with its bootloader.
+func (f *Flasher) enterBootloader() error {
+	var lastErr error
+	for i, s := range f.reset {
+		if i > 0 {
+			f.log.Info("no response, trying the next reset", "reset", f.reset[i-1].Name, "next", s.Name)
+		}
+		f.log.Debug("resetting into bootloader", "port", f.port.PortName(), "reset", s.Name)
+		if err := s.Reset(f.port); err != nil {
+			lastErr = fmt.Errorf("failed to reset into bootloader: %w", err)
+			continue
+		}
+		if err := f.sync(); err != nil {
+			lastErr = fmt.Errorf("failed to sync with bootloader: %w", err)
+			continue
+		}
+		f.resetUsed = s.Name
+		return nil
+	}
+	if len(f.reset) > 1 {
+		names := make([]string, len(f.reset))
+		for i, s := range f.reset {
+			names[i] = s.Name
+		}
+		return fmt.Errorf("%w (tried %s reset)", lastErr, strings.Join(names, ", "))
+	}
+	return lastErr
+}
@@ -0,0 +1,161 @@
+package flasher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// classicBoard is an emulated board with the classic reset circuit behind
+// a CP2102 USB-UART bridge: the lines alone do not reset it.
+type classicBoard struct {
+	*emulator.Port
+}
+
+func (classicBoard) SetDTR(value bool) error  { return nil }
+func (classicBoard) SetRTS(value bool) error  { return nil }
+func (classicBoard) USBID() (vid, pid uint16) { return 0x10C4, 0xEA60 }
+
+func strategyNames(strategies []ResetStrategy) string {
+	names := make([]string, len(strategies))
+	for i, s := range strategies {
+		names[i] = s.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestResetStrategies(t *testing.T) {
+	prompt := func() {}
+	tests := []struct {
+		name   string
+		prompt func()
+		want   string
+	}{
+		{ResetAuto, nil, "usb-jtag-serial,classic"},
+		{ResetAuto, prompt, "usb-jtag-serial,classic,manual"},
+		{ResetClassic, nil, "classic"},
+		{ResetUSBJTAGSerial, nil, "usb-jtag-serial"},
+		{ResetNone, nil, "no-reset"},
+		{ResetManual, prompt, "manual"},
+	}
+	for _, tt := range tests {
+		strategies, err := ResetStrategies(tt.name, tt.prompt)
+		if err != nil {
+			t.Fatalf("ResetStrategies(%q) error: %v", tt.name, err)
+		}
+		if got := strategyNames(strategies); got != tt.want {
+			t.Errorf("ResetStrategies(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := ResetStrategies(ResetManual, nil); err == nil {
+		t.Error("ResetStrategies(manual) without a prompt should fail")
+	}
+	if _, err := ResetStrategies("default-reset", nil); err == nil || !strings.Contains(err.Error(), "usb-jtag-serial") {
+		t.Errorf("ResetStrategies(unknown) error = %v, want the list of names", err)
+	}
+}
+
+func TestConnect_ResetStrategies(t *testing.T) {
+	prompted := false
+	tests := []struct {
+		name    string
+		before  string
+		classic bool // the board has the classic circuit
+		want    string
+	}{
+		{"X4", ResetAuto, false, ResetUSBJTAGSerial},
+		{"dev board", ResetAuto, true, ResetClassic},
+		{"manual", ResetManual, true, ResetManual},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := emulator.New(testFlashSize)
+			dev.Reset(false)
+			port := emulator.NewPort(dev)
+			prompt := func() {
+				prompted = true
+				dev.Reset(true)
+			}
+			strategies, err := ResetStrategies(tt.before, prompt)
+			if err != nil {
+				t.Fatalf("ResetStrategies() error: %v", err)
+			}
+
+			var f *Flasher
+			if tt.classic {
+				f = New(classicBoard{port})
+			} else {
+				f = New(port)
+			}
+			f.syncTimeout = 10 * time.Millisecond
+			f.SetReset(strategies)
+			if err := f.Connect(); err != nil {
+				t.Fatalf("Connect() error: %v", err)
+			}
+			if f.ResetUsed() != tt.want {
+				t.Errorf("ResetUsed() = %q, want %q", f.ResetUsed(), tt.want)
+			}
+		})
+	}
+	if !prompted {
+		t.Error("manual reset did not prompt")
+	}
+}
+
+func TestConnect_NoReset(t *testing.T) {
+	dev := emulator.New(testFlashSize)
+	dev.Reset(false)
+	strategies, _ := ResetStrategies(ResetAuto, nil)
+	f := New(classicBoard{emulator.NewPort(dev)})
+	f.syncTimeout = 10 * time.Millisecond
+	f.SetReset([]ResetStrategy{strategies[0], noReset})
+
+	err := f.Connect()
+	if err == nil {
+		t.Fatal("Connect() should fail when no reset reaches the bootloader")
+	}
+	var sync *SyncError
+	if !errors.As(err, &sync) || !strings.Contains(err.Error(), "tried usb-jtag-serial, no-reset reset") {
+		t.Errorf("Connect() error = %v", err)
+	}
+}
+
+// jtagBoard is an emulated X4 whose port ignores ResetToBootloader: only
+// the USB-Serial/JTAG line sequence resets it.
+type jtagBoard struct {
+	*emulator.Port
+}
+
+func (jtagBoard) ResetToBootloader() error { return nil }
+
+func TestBootloaderReset(t *testing.T) {
+	reset, err := BootloaderReset(ResetAuto, nil)
+	if err != nil {
+		t.Fatalf("BootloaderReset() error: %v", err)
+	}
+	for _, tt := range []struct {
+		name  string
+		board func(*emulator.Port) transport.Transport
+	}{
+		{"USB-Serial/JTAG", func(p *emulator.Port) transport.Transport { return jtagBoard{p} }},
+		{"classic circuit", func(p *emulator.Port) transport.Transport { return classicBoard{p} }},
+	} {
+		dev := emulator.New(testFlashSize)
+		dev.Reset(false)
+		if err := reset(tt.board(emulator.NewPort(dev))); err != nil {
+			t.Fatalf("%s: reset error: %v", tt.name, err)
+		}
+		if !dev.InBootloader() {
+			t.Errorf("%s: auto reset did not enter the bootloader", tt.name)
+		}
+	}
+
+	if _, err := BootloaderReset("soft", nil); err == nil {
+		t.Error("BootloaderReset(unknown) should fail")
+	}
+}
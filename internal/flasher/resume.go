@@ -0,0 +1,76 @@
+package flasher
+
+import (
+	"crypto/md5"
+	"fmt"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// SegmentSize is the amount of data written per compressed session by
+// FlashImageSegmented. An interrupted flash loses at most one segment.
+const SegmentSize = 0x40000
+
+// FlashImageSegmented writes data[from:] at address as a series of
+// compressed sessions of SegmentSize bytes. After each session the written
+// range is checked by MD5 and verified is called with the number of bytes
+// of data, from its start, now known to be on the device.
+func (f *Flasher) FlashImageSegmented(data []byte, address uint32, from int, verified func(n int)) error {
+	for start := from; start < len(data); start += SegmentSize {
+		end := min(start+SegmentSize, len(data))
+		segment := data[start:end]
+
+		if err := f.FlashImageCompressed(segment, address+uint32(start), false); err != nil {
+			return err
+		}
+
+		verify := f.track(StageVerify, address+uint32(start), len(segment), 0)
+		verify.report(0, 0)
+		sum, err := f.FlashMD5(address+uint32(start), uint32(len(segment)))
+		if err != nil {
+			return fmt.Errorf("failed to verify 0x%X: %w", address+uint32(start), err)
+		}
+		verify.report(len(segment), 0)
+		if sum != md5.Sum(segment) {
+			return fmt.Errorf("verification failed at 0x%X: flash contents differ", address+uint32(start))
+		}
+		if verified != nil {
+			verified(end)
+		}
+	}
+	return nil
+}
+
+// ResumePoint returns the sector-aligned offset into data from which an
+// interrupted flash should continue. The prefix recorded as verified is
+// checked by MD5 first; the sectors that follow are then compared one by
+// one, since the device may have written more before the link dropped.
+func (f *Flasher) ResumePoint(data []byte, address uint32, verified int) (int, error) {
+	verified -= verified % protocol.FlashSectorSize
+	if verified > len(data) {
+		verified = 0
+	}
+
+	if verified > 0 {
+		sum, err := f.FlashMD5(address, uint32(verified))
+		if err != nil {
+			return 0, err
+		}
+		if sum != md5.Sum(data[:verified]) {
+			verified = 0
+		}
+	}
+
+	for verified < len(data) {
+		end := min(verified+protocol.FlashSectorSize, len(data))
+		sum, err := f.FlashMD5(address+uint32(verified), uint32(end-verified))
+		if err != nil {
+			return 0, err
+		}
+		if sum != md5.Sum(data[verified:end]) {
+			break
+		}
+		verified = end
+	}
+	return verified, nil
+}
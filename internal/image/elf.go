@@ -0,0 +1,213 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// Flash-mapped address ranges of the ESP32-C3. The MMU maps flash into
+// them in 64KB pages, so a segment there must start at the same offset
+// within a page in the image as in memory.
+const (
+	iromStart = 0x42000000
+	iromEnd   = 0x42800000
+	dromStart = 0x3C000000
+	dromEnd   = 0x3C800000
+
+	flashPageSize = 0x10000
+)
+
+const (
+	maxSegments   = 16   // the bootloader loads at most 16 segments
+	checksumSeed  = 0xEF // XOR checksum seed
+	wpPinDisabled = 0xEE
+	noMaxRevision = 0xFFFF
+
+	// ESP-IDF bootloaders do not map the last page of a flash segment
+	// that ends less than this many bytes into it
+	minPageTail = 0x24
+)
+
+// Default flash settings of an image built from an ELF file: those of the
+// Xteink X4.
+var defaultSettings = FlashSettings{Mode: "dio", Freq: "80m", Size: "16MB"}
+
+// IsELF reports whether data is an ELF file.
+func IsELF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(elf.ELFMAG))
+}
+
+type loadSegment struct {
+	addr uint32
+	data []byte
+}
+
+func (s loadSegment) flash() bool {
+	return isFlashAddr(s.addr)
+}
+
+func isFlashAddr(addr uint32) bool {
+	return (addr >= iromStart && addr < iromEnd) || (addr >= dromStart && addr < dromEnd)
+}
+
+// FromELF converts an ESP32-C3 application ELF file to an image that can
+// be flashed at the firmware address, as esptool's elf2image does. Empty
+// settings fields take the Xteink X4 defaults.
+//
+// Each loadable segment becomes an image segment. Flash-mapped segments
+// are aligned to their address within a 64KB page by placing parts of the
+// RAM segments, or padding segments, before them. The image ends with the
+// XOR checksum and a SHA-256 digest.
+func FromELF(data []byte, s FlashSettings) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not an ELF file: %w", err)
+	}
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_RISCV {
+		return nil, fmt.Errorf("ELF file is for %v %v, want a 32-bit RISC-V application", f.Class, f.Machine)
+	}
+	if f.Type != elf.ET_EXEC {
+		return nil, fmt.Errorf("ELF file type is %v, want %v", f.Type, elf.ET_EXEC)
+	}
+
+	flash, ram, err := loadSegments(f)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, HeaderSize+ExtHeaderSize)
+	out[0] = Magic
+	binary.LittleEndian.PutUint32(out[4:], uint32(f.Entry))
+	ext := out[HeaderSize:]
+	ext[0] = wpPinDisabled
+	binary.LittleEndian.PutUint16(ext[4:], protocol.ChipIDESP32C3)
+	binary.LittleEndian.PutUint16(ext[9:], noMaxRevision)
+	ext[15] = 1 // SHA-256 appended
+
+	count := 0
+	checksum := byte(checksumSeed)
+	add := func(addr uint32, data []byte) {
+		out = binary.LittleEndian.AppendUint32(out, addr)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+		out = append(out, data...)
+		for _, b := range data {
+			checksum ^= b
+		}
+		count++
+	}
+
+	for len(flash) > 0 {
+		seg := flash[0]
+		pad := alignmentPadding(len(out), seg.addr)
+		switch {
+		case pad < 0:
+			if tail := (len(out) + SegmentHeaderSize + len(seg.data)) % flashPageSize; tail < minPageTail {
+				seg.data = append(seg.data, make([]byte, minPageTail-tail)...)
+			}
+			add(seg.addr, seg.data)
+			flash = flash[1:]
+		case len(ram) > 0 && pad > SegmentHeaderSize:
+			// Fill the gap with the start of a RAM segment
+			n := min(pad, len(ram[0].data))
+			add(ram[0].addr, ram[0].data[:n])
+			ram[0].addr += uint32(n)
+			if ram[0].data = ram[0].data[n:]; len(ram[0].data) == 0 {
+				ram = ram[1:]
+			}
+		default:
+			add(0, make([]byte, pad))
+		}
+	}
+	for _, seg := range ram {
+		add(seg.addr, seg.data)
+	}
+	if count > maxSegments {
+		return nil, fmt.Errorf("image needs %d segments, the bootloader loads at most %d", count, maxSegments)
+	}
+	out[1] = byte(count)
+
+	// The checksum is the last byte of a 16-byte block
+	out = append(out, make([]byte, 15-len(out)%16)...)
+	out = append(out, checksum)
+	sum := sha256.Sum256(out)
+	out = append(out, sum[:]...)
+
+	s.Mode = orDefault(s.Mode, defaultSettings.Mode)
+	s.Freq = orDefault(s.Freq, defaultSettings.Freq)
+	s.Size = orDefault(s.Size, defaultSettings.Size)
+	return ApplyFlashSettings(out, s)
+}
+
+// loadSegments returns the loadable segments of an ELF file sorted by
+// address, with adjacent ones merged and each padded to 4 bytes.
+func loadSegments(f *elf.File) (flash, ram []loadSegment, err error) {
+	var segs []loadSegment
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Filesz == 0 {
+			continue
+		}
+		data, err := io.ReadAll(p.Open())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read segment at 0x%08X: %w", p.Vaddr, err)
+		}
+		segs = append(segs, loadSegment{uint32(p.Vaddr), data})
+	}
+	if len(segs) == 0 {
+		return nil, nil, fmt.Errorf("ELF file has no loadable segments")
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].addr < segs[j].addr })
+
+	merged := segs[:1]
+	for _, s := range segs[1:] {
+		last := &merged[len(merged)-1]
+		if last.addr+uint32(len(last.data)) == s.addr && last.flash() == s.flash() {
+			last.data = append(last.data, s.data...)
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	for _, s := range merged {
+		s.data = append(s.data, make([]byte, -len(s.data)&3)...)
+		if s.flash() {
+			flash = append(flash, s)
+		} else {
+			ram = append(ram, s)
+		}
+	}
+
+	for i := 1; i < len(flash); i++ {
+		if flash[i].addr/flashPageSize == flash[i-1].addr/flashPageSize {
+			return nil, nil, fmt.Errorf("segments at 0x%08X and 0x%08X share a 64KB flash page; merge them in the linker script",
+				flash[i-1].addr, flash[i].addr)
+		}
+	}
+	return flash, ram, nil
+}
+
+// alignmentPadding returns the size of the segment to write at offset so
+// that the data of a flash segment at addr, after its header, starts at
+// the same offset within a flash page as addr. It returns -1 if the
+// segment can be written at offset.
+func alignmentPadding(offset int, addr uint32) int {
+	want := int(addr % flashPageSize)
+	if (offset+SegmentHeaderSize)%flashPageSize == want {
+		return -1
+	}
+	// The padding segment has a header too
+	return ((want-offset-2*SegmentHeaderSize)%flashPageSize + flashPageSize) % flashPageSize
+}
+
+func orDefault(s, def string) string {
+	if s == "" || s == "keep" || s == "detect" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// buildELF returns a RISC-V executable with a PT_LOAD segment for each
+// entry of segs.
+func buildELF(entry uint32, segs []loadSegment) []byte {
+	var buf bytes.Buffer
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     entry,
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     uint16(len(segs)),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&buf, binary.LittleEndian, header)
+
+	off := uint32(52 + 32*len(segs))
+	for _, s := range segs {
+		binary.Write(&buf, binary.LittleEndian, elf.Prog32{
+			Type: uint32(elf.PT_LOAD), Off: off, Vaddr: s.addr, Paddr: s.addr,
+			Filesz: uint32(len(s.data)), Memsz: uint32(len(s.data)), Align: 4,
+		})
+		off += uint32(len(s.data))
+	}
+	for _, s := range segs {
+		buf.Write(s.data)
+	}
+	return buf.Bytes()
+}
+
+func fill(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+type imageSegment struct {
+	offset int // of the data in the image
+	addr   uint32
+	size   int
+}
+
+// parseSegments returns the segments of an image and verifies its checksum.
+func parseSegments(t *testing.T, img []byte) []imageSegment {
+	t.Helper()
+	var segs []imageSegment
+	pos := HeaderSize + ExtHeaderSize
+	checksum := byte(checksumSeed)
+	for i := 0; i < int(img[1]); i++ {
+		addr := binary.LittleEndian.Uint32(img[pos:])
+		size := int(binary.LittleEndian.Uint32(img[pos+4:]))
+		pos += SegmentHeaderSize
+		segs = append(segs, imageSegment{pos, addr, size})
+		for _, b := range img[pos : pos+size] {
+			checksum ^= b
+		}
+		pos += size
+	}
+	n, err := contentLength(img)
+	if err != nil {
+		t.Fatalf("contentLength() error: %v", err)
+	}
+	if img[n-1] != checksum {
+		t.Errorf("checksum = 0x%02X, want 0x%02X", img[n-1], checksum)
+	}
+	return segs
+}
+
+func TestFromELF(t *testing.T) {
+	app := buildELF(0x40380080, []loadSegment{
+		{0x42010020, fill(0x300, 0x11)}, // code
+		{0x3C000020, fill(0x102, 0x22)}, // read-only data, not 4-byte aligned
+		{0x3FC80000, fill(0x40, 0x33)},  // data
+		{0x40380000, fill(0x200, 0x44)}, // code in RAM
+		{0x40380200, fill(0x80, 0x55)},  // adjacent to the previous one
+	})
+
+	img, err := FromELF(app, FlashSettings{Freq: "40m"})
+	if err != nil {
+		t.Fatalf("FromELF() error: %v", err)
+	}
+
+	if img[0] != Magic {
+		t.Fatalf("magic = 0x%02X", img[0])
+	}
+	if entry := binary.LittleEndian.Uint32(img[4:]); entry != 0x40380080 {
+		t.Errorf("entry = 0x%08X, want 0x40380080", entry)
+	}
+	if chip := binary.LittleEndian.Uint16(img[HeaderSize+4:]); chip != 5 {
+		t.Errorf("chip ID = %d, want 5", chip)
+	}
+	settings, err := ReadFlashSettings(img)
+	if err != nil {
+		t.Fatalf("ReadFlashSettings() error: %v", err)
+	}
+	if want := (FlashSettings{Mode: "dio", Freq: "40m", Size: "16MB"}); settings != want {
+		t.Errorf("flash settings = %+v, want %+v", settings, want)
+	}
+
+	// RAM segments may be split to fill the gaps before flash segments
+	flash := map[uint32]int{}
+	ramBytes := 0
+	for _, seg := range parseSegments(t, img) {
+		switch {
+		case isFlashAddr(seg.addr):
+			if seg.offset%flashPageSize != int(seg.addr%flashPageSize) {
+				t.Errorf("segment 0x%08X at image offset 0x%X is not page aligned", seg.addr, seg.offset)
+			}
+			flash[seg.addr] = seg.size
+		case seg.addr != 0: // not padding
+			ramBytes += seg.size
+		}
+	}
+	if flash[0x3C000020] != 0x104 || flash[0x42010020] < 0x300 || len(flash) != 2 {
+		t.Errorf("flash segments = %x", flash)
+	}
+	if ramBytes != 0x40+0x280 {
+		t.Errorf("RAM segments hold %d bytes, want %d", ramBytes, 0x40+0x280)
+	}
+
+	n := len(img) - sha256.Size
+	if sum := sha256.Sum256(img[:n]); !bytes.Equal(sum[:], img[n:]) {
+		t.Error("appended SHA-256 does not match the image")
+	}
+}
+
+func TestFromELF_Errors(t *testing.T) {
+	ram := buildELF(0, []loadSegment{{0x3FC80000, fill(16, 1)}})
+	tests := []struct {
+		name     string
+		data     []byte
+		settings FlashSettings
+		want     string
+	}{
+		{"not ELF", []byte("firmware"), FlashSettings{}, "not an ELF file"},
+		{"no segments", buildELF(0, nil), FlashSettings{}, "no loadable segments"},
+		{"shared page", buildELF(0, []loadSegment{
+			{0x42000020, fill(16, 1)},
+			{0x42008000, fill(16, 2)},
+		}), FlashSettings{}, "share a 64KB flash page"},
+		{"bad flash mode", ram, FlashSettings{Mode: "fast"}, "unknown flash mode"},
+	}
+	for _, tt := range tests {
+		_, err := FromELF(tt.data, tt.settings)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: FromELF() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestIsELF(t *testing.T) {
+	if !IsELF(buildELF(0, nil)) {
+		t.Error("IsELF(ELF file) = false")
+	}
+	if IsELF([]byte{Magic, 0, 0, 0}) {
+		t.Error("IsELF(image) = true")
+	}
+}
@@ -0,0 +1,152 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Image header layout
+const (
+	HeaderSize        = 8
+	ExtHeaderSize     = 16
+	SegmentHeaderSize = 8
+
+	hashAppendedOffset = HeaderSize + 15
+)
+
+// FlashSettings are the SPI flash settings stored in an image header.
+// Empty fields (or "keep") leave the existing header value unchanged, as
+// does a size of "detect", which esptool resolves on the device.
+type FlashSettings struct {
+	Mode string // qio, qout, dio, dout
+	Freq string // 80m, 40m, 26m, 20m
+	Size string // 1MB, 2MB, 4MB, 8MB, 16MB, ...
+}
+
+var flashModes = []string{"qio", "qout", "dio", "dout"}
+
+var flashFreqs = map[string]byte{
+	"80m": 0xF,
+	"40m": 0x0,
+	"26m": 0x1,
+	"20m": 0x2,
+}
+
+var flashSizes = map[string]byte{
+	"1MB":   0x0,
+	"2MB":   0x1,
+	"4MB":   0x2,
+	"8MB":   0x3,
+	"16MB":  0x4,
+	"32MB":  0x5,
+	"64MB":  0x6,
+	"128MB": 0x7,
+}
+
+// FlashSizeBytes returns the size in bytes for a flash size name such as "16MB".
+func FlashSizeBytes(size string) (uint32, error) {
+	code, ok := flashSizes[strings.ToUpper(size)]
+	if !ok {
+		return 0, fmt.Errorf("unknown flash size %q", size)
+	}
+	return (1 << code) * 1024 * 1024, nil
+}
+
+// ReadFlashSettings returns the flash settings from an image header.
+func ReadFlashSettings(data []byte) (FlashSettings, error) {
+	if len(data) < HeaderSize || data[0] != Magic {
+		return FlashSettings{}, fmt.Errorf("not an ESP image")
+	}
+
+	var s FlashSettings
+	if int(data[2]) < len(flashModes) {
+		s.Mode = flashModes[data[2]]
+	}
+	for name, code := range flashFreqs {
+		if data[3]&0x0F == code {
+			s.Freq = name
+		}
+	}
+	for name, code := range flashSizes {
+		if data[3]>>4 == code {
+			s.Size = name
+		}
+	}
+	return s, nil
+}
+
+// ApplyFlashSettings returns a copy of an image with its header flash
+// settings replaced. If the image has an appended SHA-256 digest it is
+// recomputed, as esptool does when writing a bootloader.
+func ApplyFlashSettings(data []byte, s FlashSettings) ([]byte, error) {
+	if len(data) < HeaderSize+ExtHeaderSize || data[0] != Magic {
+		return nil, fmt.Errorf("not an ESP image")
+	}
+
+	out := append([]byte(nil), data...)
+
+	if s.Mode != "" && s.Mode != "keep" {
+		mode := -1
+		for i, m := range flashModes {
+			if m == strings.ToLower(s.Mode) {
+				mode = i
+			}
+		}
+		if mode < 0 {
+			return nil, fmt.Errorf("unknown flash mode %q", s.Mode)
+		}
+		out[2] = byte(mode)
+	}
+
+	if s.Freq != "" && s.Freq != "keep" {
+		code, ok := flashFreqs[strings.ToLower(s.Freq)]
+		if !ok {
+			return nil, fmt.Errorf("unknown flash frequency %q", s.Freq)
+		}
+		out[3] = out[3]&0xF0 | code
+	}
+
+	if s.Size != "" && s.Size != "keep" && s.Size != "detect" {
+		code, ok := flashSizes[strings.ToUpper(s.Size)]
+		if !ok {
+			return nil, fmt.Errorf("unknown flash size %q", s.Size)
+		}
+		out[3] = out[3]&0x0F | code<<4
+	}
+
+	if out[hashAppendedOffset] == 1 {
+		n, err := contentLength(out)
+		if err != nil {
+			return nil, err
+		}
+		if n+sha256.Size <= len(out) {
+			sum := sha256.Sum256(out[:n])
+			copy(out[n:], sum[:])
+		}
+	}
+
+	return out, nil
+}
+
+// contentLength returns the length of an image up to and including the
+// checksum byte, i.e. the data covered by the appended SHA-256 digest.
+func contentLength(data []byte) (int, error) {
+	pos := HeaderSize + ExtHeaderSize
+	segments := int(data[1])
+	for i := 0; i < segments; i++ {
+		if pos+SegmentHeaderSize > len(data) {
+			return 0, fmt.Errorf("segment %d header beyond end of image", i)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		pos += SegmentHeaderSize + size
+		if pos > len(data) {
+			return 0, fmt.Errorf("segment %d data beyond end of image", i)
+		}
+	}
+
+	// Padding up to the 16-byte aligned checksum byte
+	pos += 15 - pos%16
+	return pos + 1, nil
+}
@@ -0,0 +1,81 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+)
+
+func TestReadFlashSettings_EmbeddedBootloader(t *testing.T) {
+	settings, err := ReadFlashSettings(embedded.Bootloader())
+	if err != nil {
+		t.Fatalf("ReadFlashSettings() error = %v", err)
+	}
+	expected := FlashSettings{Mode: "dio", Freq: "80m", Size: "16MB"}
+	if settings != expected {
+		t.Errorf("ReadFlashSettings() = %+v, want %+v", settings, expected)
+	}
+}
+
+func TestApplyFlashSettings(t *testing.T) {
+	original := embedded.Bootloader()
+
+	patched, err := ApplyFlashSettings(original, FlashSettings{Mode: "qio", Freq: "40m", Size: "4MB"})
+	if err != nil {
+		t.Fatalf("ApplyFlashSettings() error = %v", err)
+	}
+
+	if patched[2] != 0x00 || patched[3] != 0x20 {
+		t.Errorf("header bytes = 0x%02X 0x%02X, want 0x00 0x20", patched[2], patched[3])
+	}
+	if original[2] != 0x02 {
+		t.Error("ApplyFlashSettings() modified its input")
+	}
+
+	// The appended digest must cover the patched header.
+	n := len(patched) - sha256.Size
+	sum := sha256.Sum256(patched[:n])
+	if !bytes.Equal(sum[:], patched[n:]) {
+		t.Error("appended SHA-256 was not updated")
+	}
+}
+
+func TestApplyFlashSettings_Keep(t *testing.T) {
+	original := embedded.Bootloader()
+	patched, err := ApplyFlashSettings(original, FlashSettings{Mode: "keep", Size: "16MB"})
+	if err != nil {
+		t.Fatalf("ApplyFlashSettings() error = %v", err)
+	}
+	if !bytes.Equal(patched, original) {
+		t.Error("keeping the existing settings must not change the image")
+	}
+}
+
+func TestApplyFlashSettings_Errors(t *testing.T) {
+	if _, err := ApplyFlashSettings([]byte{0x00, 0x01}, FlashSettings{}); err == nil {
+		t.Error("ApplyFlashSettings() of non-image expected error")
+	}
+	for _, s := range []FlashSettings{{Mode: "sio"}, {Freq: "120m"}, {Size: "3MB"}} {
+		if _, err := ApplyFlashSettings(embedded.Bootloader(), s); err == nil {
+			t.Errorf("ApplyFlashSettings(%+v) expected error", s)
+		}
+	}
+}
+
+func TestFlashSizeBytes(t *testing.T) {
+	tests := map[string]uint32{
+		"1MB":  0x100000,
+		"4MB":  0x400000,
+		"16mb": 0x1000000,
+	}
+	for name, want := range tests {
+		if got, err := FlashSizeBytes(name); err != nil || got != want {
+			t.Errorf("FlashSizeBytes(%q) = 0x%X, %v; want 0x%X", name, got, err, want)
+		}
+	}
+	if _, err := FlashSizeBytes("5MB"); err == nil {
+		t.Error("FlashSizeBytes(5MB) expected error")
+	}
+}
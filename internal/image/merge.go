@@ -0,0 +1,73 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Part is a binary placed at a flash offset.
+type Part struct {
+	Name   string
+	Offset uint32
+	Data   []byte
+}
+
+// Manifest describes the components of a merged image.
+type Manifest struct {
+	Size   int            `json:"size"`
+	SHA256 string         `json:"sha256"`
+	Parts  []ManifestPart `json:"parts"`
+}
+
+// ManifestPart records where a component was placed in a merged image.
+type ManifestPart struct {
+	Name   string `json:"name"`
+	Offset uint32 `json:"offset"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Merge combines parts into a single image starting at flash offset 0.
+// Gaps between parts are filled with 0xFF (erased flash). If size is
+// non-zero the image is padded to exactly size bytes.
+func Merge(parts []Part, size uint32) ([]byte, *Manifest, error) {
+	sorted := append([]Part(nil), parts...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	var end uint32
+	for i, p := range sorted {
+		if i > 0 && p.Offset < end {
+			return nil, nil, fmt.Errorf("%s at 0x%X overlaps %s", p.Name, p.Offset, sorted[i-1].Name)
+		}
+		end = p.Offset + uint32(len(p.Data))
+	}
+	if size != 0 && end > size {
+		return nil, nil, fmt.Errorf("image needs 0x%X bytes, larger than flash size 0x%X", end, size)
+	}
+	if size == 0 {
+		size = end
+	}
+
+	image := bytes.Repeat([]byte{0xFF}, int(size))
+	manifest := &Manifest{Size: int(size)}
+	for _, p := range sorted {
+		copy(image[p.Offset:], p.Data)
+		manifest.Parts = append(manifest.Parts, ManifestPart{
+			Name:   p.Name,
+			Offset: p.Offset,
+			Size:   len(p.Data),
+			SHA256: sha256Hex(p.Data),
+		})
+	}
+	manifest.SHA256 = sha256Hex(image)
+
+	return image, manifest, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
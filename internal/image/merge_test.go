@@ -0,0 +1,76 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMerge_PadsGaps(t *testing.T) {
+	parts := []Part{
+		{Name: "firmware", Offset: 0x10, Data: []byte{3, 3}},
+		{Name: "bootloader", Offset: 0x0, Data: []byte{1, 1, 1}},
+		{Name: "partitions", Offset: 0x8, Data: []byte{2}},
+	}
+
+	image, manifest, err := Merge(parts, 0)
+	if err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+
+	expected := []byte{
+		1, 1, 1, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		2, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		3, 3,
+	}
+	if !bytes.Equal(image, expected) {
+		t.Errorf("Merge() = % X, want % X", image, expected)
+	}
+
+	if manifest.Size != len(expected) {
+		t.Errorf("manifest size = %d, want %d", manifest.Size, len(expected))
+	}
+	sum := sha256.Sum256(expected)
+	if manifest.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("manifest sha256 = %s", manifest.SHA256)
+	}
+
+	names := []string{"bootloader", "partitions", "firmware"}
+	offsets := []uint32{0x0, 0x8, 0x10}
+	for i, p := range manifest.Parts {
+		if p.Name != names[i] || p.Offset != offsets[i] {
+			t.Errorf("manifest part %d = %s@0x%X, want %s@0x%X", i, p.Name, p.Offset, names[i], offsets[i])
+		}
+	}
+}
+
+func TestMerge_FillSize(t *testing.T) {
+	image, _, err := Merge([]Part{{Name: "a", Offset: 0, Data: []byte{0}}}, 16)
+	if err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if len(image) != 16 {
+		t.Errorf("Merge() length = %d, want 16", len(image))
+	}
+	for _, b := range image[1:] {
+		if b != 0xFF {
+			t.Fatalf("padding byte = 0x%02X, want 0xFF", b)
+		}
+	}
+}
+
+func TestMerge_Errors(t *testing.T) {
+	overlap := []Part{
+		{Name: "a", Offset: 0, Data: make([]byte, 8)},
+		{Name: "b", Offset: 4, Data: make([]byte, 8)},
+	}
+	if _, _, err := Merge(overlap, 0); err == nil {
+		t.Error("Merge() with overlapping parts expected error")
+	}
+
+	tooBig := []Part{{Name: "a", Offset: 8, Data: make([]byte, 16)}}
+	if _, _, err := Merge(tooBig, 16); err == nil {
+		t.Error("Merge() exceeding fill size expected error")
+	}
+}
@@ -0,0 +1,105 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/bigbag/papyrix-flasher/internal/partition"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+// Magic is the first byte of an ESP application or bootloader image.
+const Magic = 0xE9
+
+// MinSkipGap is the shortest run of erased (0xFF) flash that Split leaves
+// out of the written regions.
+const MinSkipGap = 0x10000
+
+// IsMerged reports whether data looks like a merged factory image: a
+// bootloader at offset 0 and a partition table at the partitions address.
+func IsMerged(data []byte) bool {
+	if len(data) <= protocol.PartitionsAddress || data[0] != Magic {
+		return false
+	}
+	return partition.IsTable(data[protocol.PartitionsAddress:])
+}
+
+// Split breaks a merged image that starts at flash offset 0 into the
+// regions that contain data. Sector-aligned runs of 0xFF at least minGap
+// bytes long are skipped, so the flash there keeps its previous contents;
+// shorter runs are written (and therefore erased) as part of the
+// surrounding region. Regions are named after the partition they start in.
+func Split(data []byte, minGap int) []Part {
+	const sector = protocol.FlashSectorSize
+	gapSectors := max(1, minGap/sector)
+
+	var table partition.Table
+	if len(data) > protocol.PartitionsAddress {
+		table, _ = partition.Parse(data[protocol.PartitionsAddress:])
+	}
+
+	numSectors := (len(data) + sector - 1) / sector
+	empty := make([]bool, numSectors)
+	for i := range empty {
+		empty[i] = isErased(data[i*sector : min((i+1)*sector, len(data))])
+	}
+
+	var parts []Part
+	start := -1
+	for i := 0; i < numSectors; {
+		if !empty[i] {
+			if start < 0 {
+				start = i
+			}
+			i++
+			continue
+		}
+
+		run := 0
+		for i+run < numSectors && empty[i+run] {
+			run++
+		}
+		if start >= 0 && (run >= gapSectors || i+run == numSectors) {
+			parts = append(parts, newSplitPart(data, start*sector, i*sector, table))
+			start = -1
+		}
+		i += run
+	}
+	if start >= 0 {
+		parts = append(parts, newSplitPart(data, start*sector, len(data), table))
+	}
+
+	return parts
+}
+
+func newSplitPart(data []byte, start, end int, table partition.Table) Part {
+	end = min(end, len(data))
+	offset := uint32(start)
+	return Part{
+		Name:   regionName(offset, table),
+		Offset: offset,
+		Data:   data[start:end],
+	}
+}
+
+// regionName names a region of a merged image after its location.
+func regionName(offset uint32, table partition.Table) string {
+	switch {
+	case offset < protocol.PartitionsAddress:
+		return "bootloader"
+	case offset < protocol.PartitionsAddress+partition.TableSize:
+		return "partitions"
+	}
+	if p, ok := table.At(offset); ok {
+		return p.Label
+	}
+	return fmt.Sprintf("data@0x%X", offset)
+}
+
+func isErased(data []byte) bool {
+	for _, b := range data {
+		if b != 0xFF {
+			return false
+		}
+	}
+	return true
+}
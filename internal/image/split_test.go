@@ -0,0 +1,78 @@
+package image
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+)
+
+func mergedImage(t *testing.T, firmware []byte, size uint32) []byte {
+	t.Helper()
+	image, _, err := Merge([]Part{
+		{Name: "bootloader", Offset: protocol.BootloaderAddress, Data: embedded.Bootloader()},
+		{Name: "partitions", Offset: protocol.PartitionsAddress, Data: embedded.Partitions()},
+		{Name: "firmware", Offset: protocol.FirmwareAddress, Data: firmware},
+	}, size)
+	if err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	return image
+}
+
+func TestIsMerged(t *testing.T) {
+	firmware := bytes.Repeat([]byte{0xE9, 0x01}, 100)
+
+	if !IsMerged(mergedImage(t, firmware, 0)) {
+		t.Error("IsMerged(merged image) = false, want true")
+	}
+	if IsMerged(firmware) {
+		t.Error("IsMerged(firmware) = true, want false")
+	}
+	if IsMerged(make([]byte, 0x10000)) {
+		t.Error("IsMerged(zeros) = true, want false")
+	}
+}
+
+func TestSplit_SkipsLongGaps(t *testing.T) {
+	firmware := bytes.Repeat([]byte{0x42}, 0x5000)
+	firmware = append(firmware, bytes.Repeat([]byte{0xFF}, 0x20000)...)
+	firmware = append(firmware, bytes.Repeat([]byte{0x43}, 0x100)...)
+	merged := mergedImage(t, firmware, 4*1024*1024)
+
+	parts := Split(merged, MinSkipGap)
+
+	expected := []struct {
+		name   string
+		offset uint32
+		size   int
+	}{
+		// Bootloader and partition table are separated by a short gap, and
+		// the table runs into nvs/otadata and the firmware: one region.
+		{"bootloader", 0x0, 0x15000},
+		{"app0", 0x35000, 0x1000},
+	}
+
+	if len(parts) != len(expected) {
+		t.Fatalf("Split() returned %d parts, want %d: %+v", len(parts), len(expected), parts)
+	}
+	for i, e := range expected {
+		p := parts[i]
+		if p.Name != e.name || p.Offset != e.offset || len(p.Data) != e.size {
+			t.Errorf("part %d = %s@0x%X (0x%X bytes), want %s@0x%X (0x%X bytes)",
+				i, p.Name, p.Offset, len(p.Data), e.name, e.offset, e.size)
+		}
+		if !bytes.Equal(p.Data, merged[p.Offset:int(p.Offset)+len(p.Data)]) {
+			t.Errorf("part %d data does not match the merged image", i)
+		}
+	}
+}
+
+func TestSplit_TrailingPartialSector(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x01}, 0x1000), 0x02, 0x03)
+	parts := Split(data, MinSkipGap)
+	if len(parts) != 1 || len(parts[0].Data) != len(data) {
+		t.Fatalf("Split() = %+v, want one part covering all data", parts)
+	}
+}
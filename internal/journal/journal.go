@@ -0,0 +1,103 @@
+package journal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Journal records how much of an image has been written to a device and
+// verified, so an interrupted flash can be resumed. There is one journal
+// per device and image.
+type Journal struct {
+	Device   string    `json:"device"`
+	Image    string    `json:"image"` // SHA-256 of the image
+	Address  uint32    `json:"address"`
+	Size     int       `json:"size"`
+	Verified int       `json:"verified"` // bytes from the start of the image
+	Updated  time.Time `json:"updated"`
+
+	path string
+}
+
+// DefaultDir returns the directory where journals are kept.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "papyrix-flasher", "journal"), nil
+}
+
+// Open returns the journal for writing data at address on device, loading
+// the recorded progress if a journal exists.
+func Open(dir, device string, address uint32, data []byte) (*Journal, error) {
+	sum := sha256.Sum256(data)
+	image := hex.EncodeToString(sum[:])
+	name := fmt.Sprintf("%s-%x-%s.json", strings.ReplaceAll(device, ":", ""), address, image[:16])
+
+	j := &Journal{
+		Device:  device,
+		Image:   image,
+		Address: address,
+		Size:    len(data),
+		path:    filepath.Join(dir, name),
+	}
+
+	raw, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved Journal
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %w", j.path, err)
+	}
+	if saved.Device == j.Device && saved.Image == j.Image && saved.Address == j.Address {
+		j.Verified = min(saved.Verified, j.Size)
+		j.Updated = saved.Updated
+	}
+	return j, nil
+}
+
+// Path returns the journal file path.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Record stores the number of verified bytes.
+func (j *Journal) Record(verified int) error {
+	j.Verified = verified
+	j.Updated = time.Now()
+
+	raw, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, append(raw, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// Remove deletes the journal once the image has been written completely.
+func (j *Journal) Remove() error {
+	err := os.Remove(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package journal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+const device = "58:cf:79:01:02:03"
+
+func TestJournal_RecordAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	image := bytes.Repeat([]byte{0xA5}, 0x3000)
+
+	j, err := Open(dir, device, 0x10000, image)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if j.Verified != 0 {
+		t.Errorf("new journal Verified = %d, want 0", j.Verified)
+	}
+
+	if err := j.Record(0x2000); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	reopened, err := Open(dir, device, 0x10000, image)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if reopened.Verified != 0x2000 {
+		t.Errorf("reopened Verified = 0x%X, want 0x2000", reopened.Verified)
+	}
+	if reopened.Updated.IsZero() {
+		t.Error("reopened journal has no update time")
+	}
+
+	if err := reopened.Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := os.Stat(reopened.Path()); !os.IsNotExist(err) {
+		t.Error("Remove() left the journal file behind")
+	}
+	if err := reopened.Remove(); err != nil {
+		t.Errorf("second Remove() error = %v", err)
+	}
+}
+
+func TestJournal_KeyedByDeviceAndImage(t *testing.T) {
+	dir := t.TempDir()
+	image := []byte("firmware v1")
+
+	j, _ := Open(dir, device, 0x10000, image)
+	if err := j.Record(len(image)); err != nil {
+		t.Fatal(err)
+	}
+
+	others := []struct {
+		name    string
+		device  string
+		address uint32
+		image   []byte
+	}{
+		{"other device", "58:cf:79:0a:0b:0c", 0x10000, image},
+		{"other image", device, 0x10000, []byte("firmware v2")},
+		{"other address", device, 0x20000, image},
+	}
+	for _, o := range others {
+		other, err := Open(dir, o.device, o.address, o.image)
+		if err != nil {
+			t.Fatalf("%s: Open() error = %v", o.name, err)
+		}
+		if other.Verified != 0 {
+			t.Errorf("%s: Verified = %d, want 0", o.name, other.Verified)
+		}
+	}
+}
+
+func TestJournal_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	image := []byte("firmware")
+
+	j, _ := Open(dir, device, 0, image)
+	os.WriteFile(j.Path(), []byte("not json"), 0o644)
+
+	if _, err := Open(dir, device, 0, image); err == nil {
+		t.Error("Open() of corrupt journal expected error")
+	}
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/bigbag/papyrix-flasher/internal/symbols"
+)
+
+// Resolver finds the source of a code address, e.g. a *symbols.Table.
+type Resolver interface {
+	Lookup(addr uint64) (symbols.Location, bool)
+}
+
+var (
+	// crashStart matches the lines that start a crash report: a panic,
+	// its RISC-V register dump, an abort or a backtrace
+	crashStart = regexp.MustCompile(`Guru Meditation Error|register dump:|abort\(\) was called|assert failed|Stack smashing|Backtrace:`)
+	// crashEnd matches the lines that end a crash report. The stack dump
+	// that may follow the registers is data, not a list of calls.
+	crashEnd = regexp.MustCompile(`Stack memory:|Rebooting\.\.\.|ESP-ROM:`)
+	// address matches a 32-bit address
+	address = regexp.MustCompile(`\b0x[0-9a-fA-F]{8}\b`)
+)
+
+// maxLine bounds the part of a line kept to look for addresses.
+const maxLine = 1024
+
+// scan follows the device output a line at a time and prints the source
+// of the code addresses in crash reports.
+func (m *Monitor) scan(data []byte) {
+	if len(m.line)+len(data) <= maxLine {
+		m.line = append(m.line, data...)
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		return
+	}
+	line := m.line
+	m.line = m.line[:0]
+
+	if crashStart.Match(line) {
+		m.crash = true
+	}
+	if !m.crash {
+		return
+	}
+	if crashEnd.Match(line) {
+		m.crash = false
+		return
+	}
+
+	seen := map[uint64]bool{}
+	for _, match := range address.FindAll(line, -1) {
+		addr, err := strconv.ParseUint(string(match[2:]), 16, 32)
+		if err != nil || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if loc, ok := m.Symbols.Lookup(addr); ok {
+			m.annotate("--- 0x%08x: %s\n", addr, loc)
+		}
+	}
+}
+
+// annotate prints a line of the monitor after device output, to Out and
+// the log.
+func (m *Monitor) annotate(format string, args ...any) {
+	text := []byte(fmt.Sprintf(format, args...))
+	m.out.Write(text)
+	if m.log != nil {
+		m.log.Write(text)
+	}
+}
@@ -0,0 +1,253 @@
+// Package monitor streams a device's serial console to the terminal and
+// handles the hotkeys that reset or reflash the device.
+//
+// Keys typed in the monitor are sent to the device, except for Ctrl+] and
+// Ctrl+C, which exit, and Ctrl+T, which starts a command:
+//
+//	Ctrl+T R  reset the device
+//	Ctrl+T B  reset into the bootloader
+//	Ctrl+T F  flash again
+//	Ctrl+T S  toggle timestamps
+//	Ctrl+T H  show the keys
+//	Ctrl+T X  exit
+//	Ctrl+T Ctrl+T  send Ctrl+T to the device
+//
+// With the symbols of the firmware, the code addresses of crash reports
+// are decoded to functions and source lines.
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// Keys
+const (
+	MenuKey  = 0x14 // Ctrl+T
+	ExitKey  = 0x1D // Ctrl+]
+	InterKey = 0x03 // Ctrl+C, also exits
+)
+
+// Help describes the hotkeys.
+const Help = "Ctrl+] or Ctrl+C exit | Ctrl+T then: R reset, B bootloader, F flash, S timestamps, H help, X exit"
+
+// Action tells the caller why Run returned.
+type Action int
+
+const (
+	Exit  Action = iota
+	Flash        // the user asked to flash the device again
+)
+
+const (
+	// readTimeout bounds how long a key waits for the port to be read.
+	readTimeout = 50 * time.Millisecond
+	// reopenTimeout is how long a port that went away, e.g. a USB device
+	// re-enumerating after reset, has to come back.
+	reopenTimeout  = 10 * time.Second
+	reopenInterval = 500 * time.Millisecond
+)
+
+// Monitor streams the output of a device.
+type Monitor struct {
+	// Port is the open console port. Run replaces it when the port has
+	// to be reopened.
+	Port transport.Transport
+	// Out receives the device output and the monitor's messages.
+	Out io.Writer
+	// Log, if set, receives a copy of the device output.
+	Log io.Writer
+	// Timestamps prefixes each line with the time it started.
+	Timestamps bool
+	// Reopen opens the port again after it fails. Without it, a read
+	// error ends Run.
+	Reopen func() (transport.Transport, error)
+	// Symbols, if set, resolves the code addresses of crash reports.
+	Symbols Resolver
+	// BootReset, if set, resets the device on a port into its bootloader
+	// for Ctrl+T B. Without it, Port.ResetToBootloader is used.
+	BootReset func(port transport.Transport) error
+
+	now   func() time.Time
+	out   *stamper
+	log   *stamper
+	menu  bool
+	line  []byte // the line being received, for Symbols
+	crash bool   // in a crash report
+}
+
+// Run streams the device output until the user exits or asks to flash,
+// handling the keys received on keys. A nil keys channel is never read,
+// e.g. when input is not a terminal.
+func (m *Monitor) Run(keys <-chan byte) (Action, error) {
+	if m.now == nil {
+		m.now = time.Now
+	}
+	m.out = &stamper{w: m.Out, now: m.now, on: m.Timestamps, start: true}
+	if m.Log != nil {
+		m.log = &stamper{w: m.Log, now: m.now, on: m.Timestamps, start: true}
+	}
+
+	buf := make([]byte, 1024)
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			if action, done, err := m.key(k); done || err != nil {
+				return action, err
+			}
+			continue
+		default:
+		}
+
+		n, err := m.Port.ReadWithTimeout(buf, readTimeout)
+		if n > 0 {
+			m.write(buf[:n])
+		}
+		if err != nil {
+			if err := m.reopen(err); err != nil {
+				return Exit, err
+			}
+		}
+	}
+}
+
+// write sends device output to Out and the log. With Symbols, it goes a
+// line at a time so that decoded addresses follow their line.
+func (m *Monitor) write(data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if m.Symbols != nil {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				n = i + 1
+			}
+		}
+		m.out.Write(data[:n])
+		if m.log != nil {
+			m.log.Write(data[:n])
+		}
+		if m.Symbols != nil {
+			m.scan(data[:n])
+		}
+		data = data[n:]
+	}
+}
+
+// status prints a message of the monitor on a line of its own.
+func (m *Monitor) status(format string, args ...any) {
+	if !m.out.start {
+		fmt.Fprintln(m.Out)
+		m.out.start = true
+	}
+	fmt.Fprintf(m.Out, "--- "+format+" ---\n", args...)
+}
+
+// key handles a key typed by the user. It reports whether Run should
+// return, with the action.
+func (m *Monitor) key(k byte) (Action, bool, error) {
+	if !m.menu {
+		switch k {
+		case ExitKey, InterKey:
+			return Exit, true, nil
+		case MenuKey:
+			m.menu = true
+			return Exit, false, nil
+		}
+		_, err := m.Port.Write([]byte{k})
+		return Exit, false, err
+	}
+
+	m.menu = false
+	switch k {
+	case 'r', 'R', 0x12: // Ctrl+R
+		m.status("Resetting device")
+		if err := m.Port.HardReset(); err != nil {
+			m.status("Reset failed: %v", err)
+		}
+	case 'b', 'B', 0x02: // Ctrl+B
+		m.status("Resetting into bootloader; Ctrl+T F to flash, Ctrl+T R to run")
+		reset := transport.Transport.ResetToBootloader
+		if m.BootReset != nil {
+			reset = m.BootReset
+		}
+		if err := reset(m.Port); err != nil {
+			m.status("Reset failed: %v", err)
+		}
+	case 'f', 'F', 0x06: // Ctrl+F
+		return Flash, true, nil
+	case 's', 'S', 0x13: // Ctrl+S
+		m.Timestamps = !m.Timestamps
+		m.out.on = m.Timestamps
+		if m.log != nil {
+			m.log.on = m.Timestamps
+		}
+		if m.Timestamps {
+			m.status("Timestamps on")
+		} else {
+			m.status("Timestamps off")
+		}
+	case 'x', 'X', 0x18, ExitKey: // Ctrl+X
+		return Exit, true, nil
+	case MenuKey:
+		_, err := m.Port.Write([]byte{k})
+		return Exit, false, err
+	default:
+		m.status("%s", Help)
+	}
+	return Exit, false, nil
+}
+
+// reopen waits for a failed port to come back.
+func (m *Monitor) reopen(cause error) error {
+	if m.Reopen == nil {
+		return fmt.Errorf("failed to read from port: %w", cause)
+	}
+	m.status("Port closed (%v); waiting for it to come back", cause)
+	m.Port.Close()
+
+	deadline := time.Now().Add(reopenTimeout)
+	for {
+		port, err := m.Reopen()
+		if err == nil {
+			m.Port = port
+			m.status("Reconnected")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("port did not come back: %w", err)
+		}
+		time.Sleep(reopenInterval)
+	}
+}
+
+// stamper writes output, prefixing each line with the time when enabled.
+type stamper struct {
+	w     io.Writer
+	now   func() time.Time
+	on    bool
+	start bool // at the start of a line
+}
+
+func (s *stamper) Write(data []byte) (int, error) {
+	var out []byte
+	for _, b := range data {
+		if s.start && s.on && b != '\r' && b != '\n' {
+			out = append(out, s.now().Format("[15:04:05.000] ")...)
+		}
+		if b != '\r' {
+			s.start = b == '\n'
+		}
+		out = append(out, b)
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,208 @@
+package monitor
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/symbols"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+	"github.com/bigbag/papyrix-flasher/internal/transport/transporttest"
+)
+
+var errGone = errors.New("device gone")
+
+// fakePort plays back device output. Once it runs out, it calls drained
+// and then fails with err, or stays quiet if err is nil.
+type fakePort struct {
+	transporttest.Port
+	out     []string
+	err     error
+	drained func()
+
+	written    []byte
+	hardResets int
+	bootResets int
+	closed     bool
+}
+
+func (p *fakePort) Write(data []byte) (int, error) {
+	p.written = append(p.written, data...)
+	return len(data), nil
+}
+
+func (p *fakePort) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	if len(p.out) > 0 {
+		n := copy(buf, p.out[0])
+		p.out = p.out[1:]
+		return n, nil
+	}
+	if p.drained != nil {
+		p.drained()
+		p.drained = nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.Port.ReadWithTimeout(buf, timeout)
+}
+
+func (p *fakePort) ResetToBootloader() error { p.bootResets++; return nil }
+func (p *fakePort) HardReset() error         { p.hardResets++; return nil }
+func (p *fakePort) Close() error             { p.closed = true; return nil }
+
+func TestRun_Output(t *testing.T) {
+	port := &fakePort{out: []string{"ESP-ROM:esp32c3\r\nboot: ", "ok\r\n", "\r\nready\n"}, err: errGone}
+	var out, log bytes.Buffer
+	m := &Monitor{Port: port, Out: &out, Log: &log}
+
+	_, err := m.Run(nil)
+	if !errors.Is(err, errGone) {
+		t.Errorf("Run() error = %v, want %v", err, errGone)
+	}
+	want := "ESP-ROM:esp32c3\r\nboot: ok\r\n\r\nready\n"
+	if !strings.HasPrefix(out.String(), want) {
+		t.Errorf("output = %q, want %q first", out.String(), want)
+	}
+	if log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+}
+
+func TestRun_Timestamps(t *testing.T) {
+	port := &fakePort{out: []string{"first\r\nsec", "ond\n\nthird"}, err: errGone}
+	var out, log bytes.Buffer
+	m := &Monitor{Port: port, Out: &out, Log: &log, Timestamps: true}
+	m.now = func() time.Time { return time.Date(2024, 1, 2, 13, 4, 5, 6e6, time.UTC) }
+
+	m.Run(nil)
+	want := "[13:04:05.006] first\r\n[13:04:05.006] second\n\n[13:04:05.006] third"
+	if log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+}
+
+func TestRun_Keys(t *testing.T) {
+	port := &fakePort{}
+	var out bytes.Buffer
+	m := &Monitor{Port: port, Out: &out}
+
+	keys := make(chan byte, 16)
+	for _, k := range []byte{'a', MenuKey, 'r', MenuKey, 'B', MenuKey, MenuKey, MenuKey, 's', MenuKey, 'f'} {
+		keys <- k
+	}
+
+	action, err := m.Run(keys)
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if action != Flash {
+		t.Errorf("action = %v, want Flash", action)
+	}
+	if want := []byte{'a', MenuKey}; !bytes.Equal(port.written, want) {
+		t.Errorf("sent %q to the device, want %q", port.written, want)
+	}
+	if port.hardResets != 1 || port.bootResets != 1 {
+		t.Errorf("resets: %d hard, %d into bootloader; want 1 each", port.hardResets, port.bootResets)
+	}
+	if !m.Timestamps {
+		t.Error("Ctrl+T S did not turn timestamps on")
+	}
+	if !strings.Contains(out.String(), "--- Resetting device ---") {
+		t.Errorf("output %q does not report the reset", out.String())
+	}
+}
+
+func TestRun_BootReset(t *testing.T) {
+	port := &fakePort{}
+	var reset transport.Transport
+	m := &Monitor{Port: port, Out: &bytes.Buffer{}, BootReset: func(p transport.Transport) error {
+		reset = p
+		return nil
+	}}
+
+	keys := make(chan byte, 4)
+	for _, k := range []byte{MenuKey, 'b', ExitKey} {
+		keys <- k
+	}
+	if _, err := m.Run(keys); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if reset != port || port.bootResets != 0 {
+		t.Errorf("Ctrl+T B should reset the port with BootReset, not ResetToBootloader")
+	}
+}
+
+func TestRun_ExitKey(t *testing.T) {
+	keys := make(chan byte, 1)
+	keys <- ExitKey
+	action, err := (&Monitor{Port: &fakePort{}, Out: &bytes.Buffer{}}).Run(keys)
+	if action != Exit || err != nil {
+		t.Errorf("Run() = %v, %v; want Exit", action, err)
+	}
+}
+
+func TestRun_Reopen(t *testing.T) {
+	first := &fakePort{out: []string{"before reset\n"}, err: errGone}
+	keys := make(chan byte, 1)
+	second := &fakePort{out: []string{"after reset\n"}, drained: func() { keys <- ExitKey }}
+
+	var out bytes.Buffer
+	m := &Monitor{
+		Port:   first,
+		Out:    &out,
+		Reopen: func() (transport.Transport, error) { return second, nil },
+	}
+	if _, err := m.Run(keys); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if !first.closed {
+		t.Error("the failed port was not closed")
+	}
+	if m.Port != second {
+		t.Error("Port is not the reopened port")
+	}
+	for _, want := range []string{"before reset\n", "--- Reconnected ---\n", "after reset\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q does not contain %q", out.String(), want)
+		}
+	}
+}
+
+// fakeSymbols resolves the addresses in its map.
+type fakeSymbols map[uint64]symbols.Location
+
+func (s fakeSymbols) Lookup(addr uint64) (symbols.Location, bool) {
+	loc, ok := s[addr]
+	return loc, ok
+}
+
+func TestRun_Crash(t *testing.T) {
+	port := &fakePort{out: []string{
+		"I (312) app: buffer at 0x42001000\r\n",
+		"Guru Meditation Error: Core  0 panic'ed (Load access fault). Exception was unhandled.\r\n\r\nCore  0 register dump:\r\nMEPC    : 0x42001",
+		"000  RA      : 0x42002000  SP      : 0x3fc8f1f0\r\n",
+		"Backtrace: 0x42001000:0x3fc8f1f0 0x42001000:0x3fc8f210\r\n",
+		"Stack memory:\r\n3fc8f1f0: 0x42002000\r\n",
+	}, err: errGone}
+	var out, log bytes.Buffer
+	m := &Monitor{Port: port, Out: &out, Log: &log, Symbols: fakeSymbols{
+		0x42001000: {Function: "app_main", File: "main/main.c", Line: 42},
+		0x42002000: {Function: "main_task"},
+	}}
+
+	m.Run(nil)
+	want := "I (312) app: buffer at 0x42001000\r\n" +
+		"Guru Meditation Error: Core  0 panic'ed (Load access fault). Exception was unhandled.\r\n\r\nCore  0 register dump:\r\n" +
+		"MEPC    : 0x42001000  RA      : 0x42002000  SP      : 0x3fc8f1f0\r\n" +
+		"--- 0x42001000: app_main at main/main.c:42\n" +
+		"--- 0x42002000: main_task\n" +
+		"Backtrace: 0x42001000:0x3fc8f1f0 0x42001000:0x3fc8f210\r\n" +
+		"--- 0x42001000: app_main at main/main.c:42\n" +
+		"Stack memory:\r\n3fc8f1f0: 0x42002000\r\n"
+	if log.String() != want {
+		t.Errorf("log =\n%s\nwant\n%s", log.String(), want)
+	}
+}
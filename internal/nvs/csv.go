@@ -0,0 +1,183 @@
+package nvs
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseCSV reads entries from a CSV file in the format used by ESP-IDF's
+// nvs_partition_gen.py:
+//
+//	key,type,encoding,value
+//	settings,namespace,,
+//	wifi_ssid,data,string,MyNetwork
+//	font,file,binary,fonts/default.bin
+//
+// Supported encodings are u8, i8, u16, i16, u32, i32, u64, i64, string,
+// hex2bin, base64 and binary (file entries only). File paths are resolved
+// relative to the current directory, as in ESP-IDF.
+func ParseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %w", err)
+	}
+
+	var entries []Entry
+	namespace := ""
+	for i, rec := range records {
+		line := i + 1
+		for len(rec) < 4 {
+			rec = append(rec, "")
+		}
+		key := strings.TrimSpace(rec[0])
+		kind := strings.TrimSpace(rec[1])
+		encoding := strings.TrimSpace(rec[2])
+		value := rec[3]
+
+		if i == 0 && key == "key" && kind == "type" {
+			continue
+		}
+
+		switch kind {
+		case "namespace":
+			namespace = key
+			continue
+		case "data", "file":
+		default:
+			return nil, fmt.Errorf("line %d: unknown entry type %q", line, kind)
+		}
+
+		if namespace == "" {
+			return nil, fmt.Errorf("line %d: key %q defined before any namespace", line, key)
+		}
+
+		if kind == "file" {
+			contents, err := os.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			value = string(contents)
+			if encoding == "hex2bin" || encoding == "base64" {
+				value = strings.TrimSpace(value)
+			}
+		} else if encoding == "binary" {
+			return nil, fmt.Errorf("line %d: binary encoding is only valid for file entries", line)
+		}
+
+		typ, data, err := encodeValue(encoding, value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key %q: %w", line, key, err)
+		}
+		entries = append(entries, Entry{Namespace: namespace, Key: key, Type: typ, Data: data})
+	}
+
+	return entries, nil
+}
+
+// encodeValue converts a CSV value into an entry type and payload.
+func encodeValue(encoding, value string) (Type, []byte, error) {
+	var typ Type
+	switch encoding {
+	case "u8":
+		typ = TypeU8
+	case "i8":
+		typ = TypeI8
+	case "u16":
+		typ = TypeU16
+	case "i16":
+		typ = TypeI16
+	case "u32":
+		typ = TypeU32
+	case "i32":
+		typ = TypeI32
+	case "u64":
+		typ = TypeU64
+	case "i64":
+		typ = TypeI64
+	case "string":
+		return TypeString, []byte(value), nil
+	case "hex2bin":
+		data, err := hex.DecodeString(value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid hex value: %w", err)
+		}
+		return TypeBlob, data, nil
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid base64 value: %w", err)
+		}
+		return TypeBlob, data, nil
+	case "binary":
+		return TypeBlob, []byte(value), nil
+	default:
+		return 0, nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+
+	bits := typ.size() * 8
+	var buf [8]byte
+	value = strings.TrimSpace(value)
+	if typ.signed() {
+		v, err := strconv.ParseInt(value, 0, bits)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid %s value: %w", encoding, err)
+		}
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	} else {
+		v, err := strconv.ParseUint(value, 0, bits)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid %s value: %w", encoding, err)
+		}
+		binary.LittleEndian.PutUint64(buf[:], v)
+	}
+	return typ, buf[:typ.size()], nil
+}
+
+// WriteCSV writes entries in the nvs_partition_gen CSV format, so the
+// output of Parse can be fed back into ParseCSV. Blobs use hex2bin.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"key", "type", "encoding", "value"}); err != nil {
+		return err
+	}
+
+	namespace := ""
+	for i, e := range entries {
+		if i == 0 || e.Namespace != namespace {
+			namespace = e.Namespace
+			if err := writer.Write([]string{namespace, "namespace", "", ""}); err != nil {
+				return err
+			}
+		}
+
+		var encoding, value string
+		switch v := e.Value().(type) {
+		case uint64:
+			encoding, value = e.Type.String(), strconv.FormatUint(v, 10)
+		case int64:
+			encoding, value = e.Type.String(), strconv.FormatInt(v, 10)
+		case string:
+			encoding, value = "string", v
+		case []byte:
+			encoding, value = "hex2bin", hex.EncodeToString(v)
+		}
+		if err := writer.Write([]string{e.Key, "data", encoding, value}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,251 @@
+package nvs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// page is a partition page being filled by the generator.
+type page struct {
+	buf     []byte
+	entries int
+}
+
+func newPage(seq uint32) *page {
+	p := &page{buf: bytes.Repeat([]byte{0xFF}, PageSize)}
+	binary.LittleEndian.PutUint32(p.buf[0:4], PageStateActive)
+	binary.LittleEndian.PutUint32(p.buf[4:8], seq)
+	p.buf[8] = pageVersion2
+	p.updateHeaderCRC()
+	return p
+}
+
+func (p *page) setState(state uint32) {
+	binary.LittleEndian.PutUint32(p.buf[0:4], state)
+}
+
+func (p *page) updateHeaderCRC() {
+	binary.LittleEndian.PutUint32(p.buf[28:32], crc(p.buf[4:28]))
+}
+
+// free returns the number of unused entry slots on the page.
+func (p *page) free() int {
+	return EntriesPerPage - p.entries
+}
+
+// markWritten flags an entry slot as written in the page bitmap.
+func (p *page) markWritten(index int) {
+	bit := index * 2
+	p.buf[bitmapOffset+bit/8] &^= 1 << (bit % 8)
+}
+
+// generator lays out entries across pages the way nvs_partition_gen does.
+type generator struct {
+	pages    []*page
+	maxPages int
+}
+
+// Generate builds an NVS partition image of the given size from entries.
+// Entries are grouped by namespace in the order they first appear. As with
+// the ESP-IDF generator, the last page of the partition is kept empty so the
+// NVS library has room to relocate pages.
+func Generate(entries []Entry, size int) ([]byte, error) {
+	if size%PageSize != 0 {
+		return nil, fmt.Errorf("partition size 0x%X is not a multiple of 0x%X", size, PageSize)
+	}
+	if size < MinSize {
+		return nil, fmt.Errorf("partition size 0x%X is below the minimum of 0x%X", size, MinSize)
+	}
+
+	g := &generator{maxPages: size/PageSize - 1}
+	if err := g.addPage(); err != nil {
+		return nil, err
+	}
+
+	namespaces := make(map[string]byte)
+	for _, e := range entries {
+		if err := checkKey(e.Key); err != nil {
+			return nil, err
+		}
+
+		ns, ok := namespaces[e.Namespace]
+		if !ok {
+			if err := checkKey(e.Namespace); err != nil {
+				return nil, fmt.Errorf("namespace: %w", err)
+			}
+			if len(namespaces) == 0xFE {
+				return nil, fmt.Errorf("too many namespaces")
+			}
+			ns = byte(len(namespaces) + 1)
+			namespaces[e.Namespace] = ns
+			if err := g.writePrimitive(0, TypeU8, e.Namespace, []byte{ns}); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		switch {
+		case e.Type.size() > 0:
+			if len(e.Data) != e.Type.size() {
+				return nil, fmt.Errorf("key %q: %s value must be %d bytes, got %d", e.Key, e.Type, e.Type.size(), len(e.Data))
+			}
+			err = g.writePrimitive(ns, e.Type, e.Key, e.Data)
+		case e.Type == TypeString:
+			err = g.writeString(ns, e.Key, e.Data)
+		case e.Type == TypeBlob || e.Type == TypeBlobData:
+			err = g.writeBlob(ns, e.Key, e.Data)
+		default:
+			err = fmt.Errorf("key %q: unsupported type %s", e.Key, e.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	image := make([]byte, 0, size)
+	for _, p := range g.pages {
+		image = append(image, p.buf...)
+	}
+	for len(image) < size {
+		image = append(image, bytes.Repeat([]byte{0xFF}, PageSize)...)
+	}
+	return image, nil
+}
+
+func checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	if len(key) > MaxKeyLen {
+		return fmt.Errorf("key %q is longer than %d characters", key, MaxKeyLen)
+	}
+	return nil
+}
+
+// current returns the page entries are currently written to.
+func (g *generator) current() *page {
+	return g.pages[len(g.pages)-1]
+}
+
+// addPage marks the current page full and starts a new one.
+func (g *generator) addPage() error {
+	if len(g.pages) >= g.maxPages {
+		return fmt.Errorf("not enough space: data needs more than %d pages", g.maxPages)
+	}
+	if len(g.pages) > 0 {
+		prev := g.current()
+		prev.setState(PageStateFull)
+	}
+	g.pages = append(g.pages, newPage(uint32(len(g.pages))))
+	return nil
+}
+
+// reserve makes sure the current page has room for span entries.
+func (g *generator) reserve(span int) error {
+	if g.current().free() < span {
+		return g.addPage()
+	}
+	return nil
+}
+
+// writeEntry writes an item header followed by span-1 entries of payload.
+func (g *generator) writeEntry(ns byte, typ Type, key string, chunk byte, data [8]byte, payload []byte) {
+	span := 1 + (len(payload)+EntrySize-1)/EntrySize
+	p := g.current()
+
+	entry := bytes.Repeat([]byte{0xFF}, span*EntrySize)
+	entry[0] = ns
+	entry[1] = byte(typ)
+	entry[2] = byte(span)
+	entry[3] = chunk
+	clear(entry[8:24])
+	copy(entry[8:24], key)
+	copy(entry[24:32], data[:])
+	binary.LittleEndian.PutUint32(entry[4:8], crc(entry[0:4], entry[8:32]))
+	copy(entry[EntrySize:], payload)
+
+	off := entryOffset + p.entries*EntrySize
+	copy(p.buf[off:], entry)
+	for i := 0; i < span; i++ {
+		p.markWritten(p.entries + i)
+	}
+	p.entries += span
+}
+
+func (g *generator) writePrimitive(ns byte, typ Type, key string, value []byte) error {
+	if err := g.reserve(1); err != nil {
+		return err
+	}
+	var data [8]byte
+	for i := range data {
+		data[i] = 0xFF
+	}
+	copy(data[:], value)
+	g.writeEntry(ns, typ, key, chunkIndexAny, data, nil)
+	return nil
+}
+
+// varData builds the data field shared by string and blob data entries.
+func varData(payload []byte) [8]byte {
+	var data [8]byte
+	binary.LittleEndian.PutUint16(data[0:2], uint16(len(payload)))
+	binary.LittleEndian.PutUint16(data[2:4], 0xFFFF)
+	binary.LittleEndian.PutUint32(data[4:8], crc(payload))
+	return data
+}
+
+func (g *generator) writeString(ns byte, key string, value []byte) error {
+	payload := append(append([]byte{}, value...), 0)
+	if len(payload) > MaxStringLen {
+		return fmt.Errorf("key %q: string is longer than %d bytes", key, MaxStringLen-1)
+	}
+
+	// Strings are never split across pages.
+	span := 1 + (len(payload)+EntrySize-1)/EntrySize
+	if err := g.reserve(span); err != nil {
+		return err
+	}
+	g.writeEntry(ns, TypeString, key, chunkIndexAny, varData(payload), payload)
+	return nil
+}
+
+func (g *generator) writeBlob(ns byte, key string, value []byte) error {
+	if len(value) > MaxBlobLen {
+		return fmt.Errorf("key %q: blob is longer than %d bytes", key, MaxBlobLen)
+	}
+
+	// Blob data is split into chunks that fill the remaining space of each
+	// page, followed by an index entry describing the chunks.
+	chunks := 0
+	remaining := value
+	for {
+		if g.current().free() < 2 {
+			if err := g.addPage(); err != nil {
+				return err
+			}
+		}
+		n := min(len(remaining), (g.current().free()-1)*EntrySize)
+		chunk := remaining[:n]
+		g.writeEntry(ns, TypeBlobData, key, byte(chunks), varData(chunk), chunk)
+		chunks++
+		remaining = remaining[n:]
+		if len(remaining) == 0 {
+			break
+		}
+		if err := g.addPage(); err != nil {
+			return err
+		}
+	}
+
+	if err := g.reserve(1); err != nil {
+		return err
+	}
+	var data [8]byte
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(value)))
+	data[4] = byte(chunks)
+	data[5] = 0
+	binary.LittleEndian.PutUint16(data[6:8], 0xFFFF)
+	g.writeEntry(ns, TypeBlobIdx, key, chunkIndexAny, data, nil)
+	return nil
+}
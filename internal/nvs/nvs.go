@@ -0,0 +1,152 @@
+package nvs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Page layout (NVS format version 2, as written by ESP-IDF)
+const (
+	PageSize       = 0x1000
+	EntrySize      = 32
+	EntriesPerPage = 126
+	MinSize        = 3 * PageSize
+
+	bitmapOffset = 32
+	entryOffset  = 64
+
+	pageVersion2 = 0xFE
+)
+
+// Page states
+const (
+	PageStateEmpty   = 0xFFFFFFFF
+	PageStateActive  = 0xFFFFFFFE
+	PageStateFull    = 0xFFFFFFFC
+	PageStateFreeing = 0xFFFFFFF8
+	PageStateCorrupt = 0xFFFFFFF0
+)
+
+// Entry states stored in the page bitmap (2 bits per entry)
+const (
+	entryStateEmpty   = 0x3
+	entryStateWritten = 0x2
+	entryStateErased  = 0x0
+)
+
+// Limits from the ESP-IDF NVS implementation
+const (
+	MaxKeyLen    = 15
+	MaxStringLen = 4000
+	MaxBlobLen   = 508000
+
+	chunkIndexAny = 0xFF
+)
+
+// Type is an NVS item type.
+type Type byte
+
+// NVS item types
+const (
+	TypeU8       Type = 0x01
+	TypeI8       Type = 0x11
+	TypeU16      Type = 0x02
+	TypeI16      Type = 0x12
+	TypeU32      Type = 0x04
+	TypeI32      Type = 0x14
+	TypeU64      Type = 0x08
+	TypeI64      Type = 0x18
+	TypeString   Type = 0x21
+	TypeBlob     Type = 0x41
+	TypeBlobData Type = 0x42
+	TypeBlobIdx  Type = 0x48
+)
+
+// String returns the CSV encoding name for the type.
+func (t Type) String() string {
+	switch t {
+	case TypeU8:
+		return "u8"
+	case TypeI8:
+		return "i8"
+	case TypeU16:
+		return "u16"
+	case TypeI16:
+		return "i16"
+	case TypeU32:
+		return "u32"
+	case TypeI32:
+		return "i32"
+	case TypeU64:
+		return "u64"
+	case TypeI64:
+		return "i64"
+	case TypeString:
+		return "string"
+	case TypeBlob, TypeBlobData, TypeBlobIdx:
+		return "blob"
+	default:
+		return fmt.Sprintf("type(0x%02X)", byte(t))
+	}
+}
+
+// size returns the width in bytes of a primitive type, or 0 for variable-length types.
+func (t Type) size() int {
+	switch t {
+	case TypeU8, TypeI8:
+		return 1
+	case TypeU16, TypeI16:
+		return 2
+	case TypeU32, TypeI32:
+		return 4
+	case TypeU64, TypeI64:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// signed reports whether a primitive type is signed.
+func (t Type) signed() bool {
+	return t&0x10 != 0
+}
+
+// Entry is a single key/value pair stored in an NVS partition.
+type Entry struct {
+	Namespace string
+	Key       string
+	Type      Type
+	// Data holds the little-endian value for integer types, the string
+	// without its NUL terminator, or the raw blob contents.
+	Data []byte
+}
+
+// Value returns the entry value as a Go value: uint64 or int64 for integers,
+// string for strings and []byte for blobs.
+func (e Entry) Value() any {
+	switch {
+	case e.Type == TypeString:
+		return string(e.Data)
+	case e.Type.size() > 0:
+		var buf [8]byte
+		copy(buf[:], e.Data)
+		v := binary.LittleEndian.Uint64(buf[:])
+		if !e.Type.signed() {
+			return v
+		}
+		shift := uint(64 - 8*e.Type.size())
+		return int64(v<<shift) >> shift
+	default:
+		return e.Data
+	}
+}
+
+// crc computes the CRC32 used throughout the NVS format.
+func crc(data ...[]byte) uint32 {
+	sum := uint32(0xFFFFFFFF)
+	for _, d := range data {
+		sum = crc32.Update(sum, crc32.IEEETable, d)
+	}
+	return sum
+}
@@ -0,0 +1,221 @@
+package nvs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCSV_AllEncodings(t *testing.T) {
+	dir := t.TempDir()
+	blobPath := filepath.Join(dir, "font.bin")
+	if err := os.WriteFile(blobPath, []byte{0x00, 0x01, 0xFF}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := "key,type,encoding,value\n" +
+		"# comment line\n" +
+		"settings,namespace,,\n" +
+		"a,data,u8,255\n" +
+		"b,data,i8,-1\n" +
+		"c,data,u16,0x1234\n" +
+		"d,data,i16,-300\n" +
+		"e,data,u32,4000000000\n" +
+		"f,data,i32,-2\n" +
+		"g,data,u64,18446744073709551615\n" +
+		"h,data,i64,-9000000000\n" +
+		"ssid,data,string,\"Net, with comma\"\n" +
+		"key,data,hex2bin,DEADBEEF\n" +
+		"b64,data,base64,AQID\n" +
+		"font,file,binary," + blobPath + "\n"
+
+	entries, err := ParseCSV(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseCSV() error = %v", err)
+	}
+
+	want := []struct {
+		key   string
+		typ   Type
+		value any
+	}{
+		{"a", TypeU8, uint64(255)},
+		{"b", TypeI8, int64(-1)},
+		{"c", TypeU16, uint64(0x1234)},
+		{"d", TypeI16, int64(-300)},
+		{"e", TypeU32, uint64(4000000000)},
+		{"f", TypeI32, int64(-2)},
+		{"g", TypeU64, uint64(18446744073709551615)},
+		{"h", TypeI64, int64(-9000000000)},
+		{"ssid", TypeString, "Net, with comma"},
+		{"key", TypeBlob, []byte{0xDE, 0xAD, 0xBE, 0xEF}},
+		{"b64", TypeBlob, []byte{0x01, 0x02, 0x03}},
+		{"font", TypeBlob, []byte{0x00, 0x01, 0xFF}},
+	}
+
+	if len(entries) != len(want) {
+		t.Fatalf("ParseCSV() returned %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Namespace != "settings" || e.Key != w.key || e.Type != w.typ {
+			t.Errorf("entry %d = %s/%s (%s), want settings/%s (%s)", i, e.Namespace, e.Key, e.Type, w.key, w.typ)
+		}
+		if !reflect.DeepEqual(e.Value(), w.value) {
+			t.Errorf("entry %q value = %v, want %v", w.key, e.Value(), w.value)
+		}
+	}
+}
+
+func TestParseCSV_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"no namespace", "a,data,u8,1\n"},
+		{"unknown type", "ns,namespace,,\na,blob,u8,1\n"},
+		{"unknown encoding", "ns,namespace,,\na,data,float,1\n"},
+		{"out of range", "ns,namespace,,\na,data,u8,256\n"},
+		{"bad hex", "ns,namespace,,\na,data,hex2bin,XYZ\n"},
+		{"binary data", "ns,namespace,,\na,data,binary,abc\n"},
+	}
+
+	for _, tc := range tests {
+		if _, err := ParseCSV(strings.NewReader(tc.input)); err == nil {
+			t.Errorf("%s: ParseCSV() expected error", tc.name)
+		}
+	}
+}
+
+func TestGenerate_RoundTrip(t *testing.T) {
+	large := make([]byte, 10000)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	entries := []Entry{
+		{Namespace: "wifi", Key: "ssid", Type: TypeString, Data: []byte("papyrix")},
+		{Namespace: "wifi", Key: "channel", Type: TypeU8, Data: []byte{6}},
+		{Namespace: "reader", Key: "font", Type: TypeBlob, Data: large},
+		{Namespace: "reader", Key: "offset", Type: TypeI32, Data: []byte{0xFE, 0xFF, 0xFF, 0xFF}},
+		{Namespace: "reader", Key: "empty", Type: TypeString, Data: []byte{}},
+	}
+
+	image, err := Generate(entries, 0x6000)
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if len(image) != 0x6000 {
+		t.Fatalf("Generate() size = 0x%X, want 0x6000", len(image))
+	}
+
+	got, err := Parse(image)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("Parse(Generate()) = %+v, want %+v", got, entries)
+	}
+}
+
+func TestGenerate_PageLayout(t *testing.T) {
+	entries := []Entry{{Namespace: "ns", Key: "v", Type: TypeU16, Data: []byte{0x34, 0x12}}}
+	image, err := Generate(entries, MinSize)
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	if state := binary.LittleEndian.Uint32(image[0:4]); state != PageStateActive {
+		t.Errorf("page 0 state = 0x%08X, want active", state)
+	}
+	if image[8] != pageVersion2 {
+		t.Errorf("page 0 version = 0x%02X, want 0x%02X", image[8], pageVersion2)
+	}
+	if got, want := binary.LittleEndian.Uint32(image[28:32]), crc(image[4:28]); got != want {
+		t.Errorf("page header CRC = 0x%08X, want 0x%08X", got, want)
+	}
+	// Two entries written: namespace definition and the value.
+	if image[bitmapOffset] != 0xFA {
+		t.Errorf("entry bitmap = 0x%02X, want 0xFA", image[bitmapOffset])
+	}
+
+	value := image[entryOffset+EntrySize:]
+	if value[0] != 1 || Type(value[1]) != TypeU16 || value[2] != 1 || value[3] != chunkIndexAny {
+		t.Errorf("value entry header = % X", value[0:4])
+	}
+	if !bytes.Equal(value[24:32], []byte{0x34, 0x12, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("value entry data = % X", value[24:32])
+	}
+
+	for _, b := range image[PageSize:] {
+		if b != 0xFF {
+			t.Fatal("unused pages must be erased")
+		}
+	}
+}
+
+func TestGenerate_MultiPageBlob(t *testing.T) {
+	blob := bytes.Repeat([]byte{0xA5}, 6000)
+	image, err := Generate([]Entry{{Namespace: "ns", Key: "blob", Type: TypeBlob, Data: blob}}, 0x5000)
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	if state := binary.LittleEndian.Uint32(image[0:4]); state != PageStateFull {
+		t.Errorf("page 0 state = 0x%08X, want full", state)
+	}
+	if state := binary.LittleEndian.Uint32(image[PageSize : PageSize+4]); state != PageStateActive {
+		t.Errorf("page 1 state = 0x%08X, want active", state)
+	}
+
+	entries, err := Parse(image)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(entries) != 1 || !bytes.Equal(entries[0].Data, blob) {
+		t.Errorf("Parse() did not reassemble the blob")
+	}
+}
+
+func TestGenerate_Errors(t *testing.T) {
+	ok := []Entry{{Namespace: "ns", Key: "k", Type: TypeU8, Data: []byte{1}}}
+
+	if _, err := Generate(ok, 0x2000); err == nil {
+		t.Error("Generate() with size below minimum expected error")
+	}
+	if _, err := Generate(ok, 0x3100); err == nil {
+		t.Error("Generate() with unaligned size expected error")
+	}
+	if _, err := Generate([]Entry{{Namespace: "ns", Key: "a_very_long_key_name", Type: TypeU8, Data: []byte{1}}}, MinSize); err == nil {
+		t.Error("Generate() with long key expected error")
+	}
+	big := []Entry{{Namespace: "ns", Key: "k", Type: TypeBlob, Data: make([]byte, 3*PageSize)}}
+	if _, err := Generate(big, MinSize); err == nil {
+		t.Error("Generate() with too much data expected error")
+	}
+}
+
+func TestWriteCSV_RoundTrip(t *testing.T) {
+	entries := []Entry{
+		{Namespace: "a", Key: "n", Type: TypeI16, Data: []byte{0x00, 0x80}},
+		{Namespace: "b", Key: "s", Type: TypeString, Data: []byte("hello")},
+		{Namespace: "b", Key: "x", Type: TypeBlob, Data: []byte{1, 2, 3}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, entries); err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+
+	got, err := ParseCSV(&buf)
+	if err != nil {
+		t.Fatalf("ParseCSV() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("ParseCSV(WriteCSV()) = %+v, want %+v", got, entries)
+	}
+}
@@ -0,0 +1,170 @@
+package nvs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// blobKey identifies the chunks belonging to one blob.
+type blobKey struct {
+	ns  byte
+	key string
+}
+
+// item is a decoded entry before namespace names are resolved.
+type item struct {
+	ns   byte
+	typ  Type
+	key  string
+	data []byte
+}
+
+// Parse decodes the entries stored in an NVS partition image.
+// Namespace definitions are resolved and not returned as entries; blobs are
+// reassembled from their chunks. Entries are returned in write order.
+func Parse(image []byte) ([]Entry, error) {
+	if len(image)%PageSize != 0 {
+		return nil, fmt.Errorf("image size 0x%X is not a multiple of 0x%X", len(image), PageSize)
+	}
+
+	type pageRef struct {
+		seq uint32
+		buf []byte
+	}
+	var pages []pageRef
+	for off := 0; off < len(image); off += PageSize {
+		buf := image[off : off+PageSize]
+		state := binary.LittleEndian.Uint32(buf[0:4])
+		if state == PageStateEmpty || state == PageStateCorrupt {
+			continue
+		}
+		if got, want := binary.LittleEndian.Uint32(buf[28:32]), crc(buf[4:28]); got != want {
+			return nil, fmt.Errorf("page at 0x%X: header CRC mismatch", off)
+		}
+		if buf[8] != pageVersion2 {
+			return nil, fmt.Errorf("page at 0x%X: unsupported format version 0x%02X", off, buf[8])
+		}
+		pages = append(pages, pageRef{seq: binary.LittleEndian.Uint32(buf[4:8]), buf: buf})
+	}
+	sort.SliceStable(pages, func(i, j int) bool { return pages[i].seq < pages[j].seq })
+
+	var items []item
+	chunks := make(map[blobKey]map[byte][]byte)
+	namespaces := make(map[byte]string)
+
+	for _, p := range pages {
+		for i := 0; i < EntriesPerPage; {
+			if entryState(p.buf, i) != entryStateWritten {
+				i++
+				continue
+			}
+
+			off := entryOffset + i*EntrySize
+			entry := p.buf[off : off+EntrySize]
+			if got, want := binary.LittleEndian.Uint32(entry[4:8]), crc(entry[0:4], entry[8:32]); got != want {
+				return nil, fmt.Errorf("page %d entry %d: CRC mismatch", p.seq, i)
+			}
+
+			span := int(entry[2])
+			if span < 1 || i+span > EntriesPerPage {
+				return nil, fmt.Errorf("page %d entry %d: invalid span %d", p.seq, i, span)
+			}
+
+			ns := entry[0]
+			typ := Type(entry[1])
+			key := cString(entry[8:24])
+			data := entry[24:32]
+
+			switch {
+			case typ.size() > 0:
+				value := append([]byte{}, data[:typ.size()]...)
+				if ns == 0 && typ == TypeU8 {
+					namespaces[value[0]] = key
+				} else {
+					items = append(items, item{ns: ns, typ: typ, key: key, data: value})
+				}
+			case typ == TypeString || typ == TypeBlobData || typ == TypeBlob:
+				size := int(binary.LittleEndian.Uint16(data[0:2]))
+				start := off + EntrySize
+				if size > (span-1)*EntrySize {
+					return nil, fmt.Errorf("page %d entry %d: data size %d exceeds span", p.seq, i, size)
+				}
+				payload := p.buf[start : start+size]
+				if binary.LittleEndian.Uint32(data[4:8]) != crc(payload) {
+					return nil, fmt.Errorf("page %d entry %d: data CRC mismatch", p.seq, i)
+				}
+				switch typ {
+				case TypeString:
+					if size > 0 && payload[size-1] == 0 {
+						payload = payload[:size-1]
+					}
+					items = append(items, item{ns: ns, typ: typ, key: key, data: append([]byte{}, payload...)})
+				case TypeBlob:
+					items = append(items, item{ns: ns, typ: TypeBlob, key: key, data: append([]byte{}, payload...)})
+				default:
+					bk := blobKey{ns: ns, key: key}
+					if chunks[bk] == nil {
+						chunks[bk] = make(map[byte][]byte)
+					}
+					chunks[bk][entry[3]] = append([]byte{}, payload...)
+				}
+			case typ == TypeBlobIdx:
+				items = append(items, item{ns: ns, typ: typ, key: key, data: append([]byte{}, data...)})
+			default:
+				return nil, fmt.Errorf("page %d entry %d: unknown type 0x%02X", p.seq, i, byte(typ))
+			}
+
+			i += span
+		}
+	}
+
+	entries := make([]Entry, 0, len(items))
+	for _, it := range items {
+		name, ok := namespaces[it.ns]
+		if !ok {
+			return nil, fmt.Errorf("key %q: undefined namespace index %d", it.key, it.ns)
+		}
+
+		e := Entry{Namespace: name, Key: it.key, Type: it.typ, Data: it.data}
+		if it.typ == TypeBlobIdx {
+			size := int(binary.LittleEndian.Uint32(it.data[0:4]))
+			count := int(it.data[4])
+			start := int(it.data[5])
+			parts := chunks[blobKey{ns: it.ns, key: it.key}]
+
+			var blob []byte
+			for c := start; c < start+count; c++ {
+				part, ok := parts[byte(c)]
+				if !ok {
+					return nil, fmt.Errorf("key %q: missing blob chunk %d", it.key, c)
+				}
+				blob = append(blob, part...)
+			}
+			if len(blob) != size {
+				return nil, fmt.Errorf("key %q: blob size %d, index says %d", it.key, len(blob), size)
+			}
+			e.Type = TypeBlob
+			e.Data = blob
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// entryState returns the 2-bit state of an entry slot from the page bitmap.
+func entryState(page []byte, index int) byte {
+	bit := index * 2
+	return (page[bitmapOffset+bit/8] >> (bit % 8)) & 0x3
+}
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,107 @@
+package partition
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+)
+
+// Partition table layout
+const (
+	TableSize = 0xC00
+	EntrySize = 32
+
+	Magic    = 0x50AA
+	MD5Magic = 0xEBEB
+)
+
+// Partition types
+const (
+	TypeApp  = 0x00
+	TypeData = 0x01
+)
+
+// Data partition subtypes
+const (
+	SubTypeOTA      = 0x00
+	SubTypePhy      = 0x01
+	SubTypeNVS      = 0x02
+	SubTypeCoreDump = 0x03
+	SubTypeNVSKeys  = 0x04
+	SubTypeEfuse    = 0x05
+	SubTypeFAT      = 0x81
+	SubTypeSPIFFS   = 0x82
+	SubTypeLittleFS = 0x83
+)
+
+// Entry is a single partition table entry.
+type Entry struct {
+	Label   string
+	Type    byte
+	SubType byte
+	Offset  uint32
+	Size    uint32
+	Flags   uint32
+}
+
+// Table is a parsed partition table.
+type Table []Entry
+
+// IsTable reports whether data starts with a partition table entry.
+func IsTable(data []byte) bool {
+	return len(data) >= EntrySize && binary.LittleEndian.Uint16(data[0:2]) == Magic
+}
+
+// Parse decodes a partition table. If the table carries an MD5 entry the
+// checksum is verified.
+func Parse(data []byte) (Table, error) {
+	if !IsTable(data) {
+		return nil, fmt.Errorf("no partition table found")
+	}
+
+	var table Table
+	for off := 0; off+EntrySize <= len(data) && off < TableSize; off += EntrySize {
+		entry := data[off : off+EntrySize]
+		switch binary.LittleEndian.Uint16(entry[0:2]) {
+		case Magic:
+			table = append(table, Entry{
+				Type:    entry[2],
+				SubType: entry[3],
+				Offset:  binary.LittleEndian.Uint32(entry[4:8]),
+				Size:    binary.LittleEndian.Uint32(entry[8:12]),
+				Label:   string(bytes.TrimRight(entry[12:28], "\x00")),
+				Flags:   binary.LittleEndian.Uint32(entry[28:32]),
+			})
+		case MD5Magic:
+			sum := md5.Sum(data[:off])
+			if !bytes.Equal(sum[:], entry[16:32]) {
+				return nil, fmt.Errorf("partition table MD5 mismatch")
+			}
+		default:
+			return table, nil
+		}
+	}
+
+	return table, nil
+}
+
+// Find returns the first partition with the given type and subtype.
+func (t Table) Find(typ, subType byte) (*Entry, bool) {
+	for i := range t {
+		if t[i].Type == typ && t[i].SubType == subType {
+			return &t[i], true
+		}
+	}
+	return nil, false
+}
+
+// At returns the partition containing the given flash offset.
+func (t Table) At(offset uint32) (*Entry, bool) {
+	for i := range t {
+		if offset >= t[i].Offset && offset < t[i].Offset+t[i].Size {
+			return &t[i], true
+		}
+	}
+	return nil, false
+}
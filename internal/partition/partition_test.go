@@ -0,0 +1,73 @@
+package partition
+
+import (
+	"testing"
+
+	"github.com/bigbag/papyrix-flasher/embedded"
+)
+
+func TestParse_EmbeddedTable(t *testing.T) {
+	table, err := Parse(embedded.Partitions())
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	expected := []Entry{
+		{Label: "nvs", Type: TypeData, SubType: SubTypeNVS, Offset: 0x9000, Size: 0x5000},
+		{Label: "otadata", Type: TypeData, SubType: SubTypeOTA, Offset: 0xE000, Size: 0x2000},
+		{Label: "app0", Type: TypeApp, SubType: 0x10, Offset: 0x10000, Size: 0x640000},
+		{Label: "app1", Type: TypeApp, SubType: 0x11, Offset: 0x650000, Size: 0x640000},
+		{Label: "spiffs", Type: TypeData, SubType: SubTypeSPIFFS, Offset: 0xC90000, Size: 0x360000},
+		{Label: "coredump", Type: TypeData, SubType: SubTypeCoreDump, Offset: 0xFF0000, Size: 0x10000},
+	}
+
+	if len(table) != len(expected) {
+		t.Fatalf("Parse() returned %d entries, want %d", len(table), len(expected))
+	}
+	for i, e := range expected {
+		if table[i] != e {
+			t.Errorf("entry %d = %+v, want %+v", i, table[i], e)
+		}
+	}
+}
+
+func TestParse_MD5Mismatch(t *testing.T) {
+	data := append([]byte(nil), embedded.Partitions()...)
+	data[4] ^= 0xFF // corrupt the first entry's offset
+
+	if _, err := Parse(data); err == nil {
+		t.Error("Parse() with corrupted table expected MD5 error")
+	}
+}
+
+func TestParse_NotATable(t *testing.T) {
+	if _, err := Parse(make([]byte, TableSize)); err == nil {
+		t.Error("Parse() of zeroed data expected error")
+	}
+	if IsTable([]byte{0xAA}) {
+		t.Error("IsTable() of short data = true, want false")
+	}
+}
+
+func TestTable_FindAndAt(t *testing.T) {
+	table, err := Parse(embedded.Partitions())
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	coredump, ok := table.Find(TypeData, SubTypeCoreDump)
+	if !ok || coredump.Offset != 0xFF0000 {
+		t.Errorf("Find(coredump) = %+v, %v", coredump, ok)
+	}
+	if _, ok := table.Find(TypeData, SubTypeFAT); ok {
+		t.Error("Find(fat) found a partition that does not exist")
+	}
+
+	app, ok := table.At(0x20000)
+	if !ok || app.Label != "app0" {
+		t.Errorf("At(0x20000) = %+v, %v", app, ok)
+	}
+	if _, ok := table.At(0x1000); ok {
+		t.Error("At(0x1000) found a partition inside the bootloader area")
+	}
+}
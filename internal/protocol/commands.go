@@ -1,17 +1,70 @@
 package protocol
 
+import "fmt"
+
 // ESP32 ROM bootloader commands
 const (
+	CmdFlashBegin      = 0x02
+	CmdFlashData       = 0x03
 	CmdFlashEnd        = 0x04
+	CmdMemBegin        = 0x05
+	CmdMemEnd          = 0x06
+	CmdMemData         = 0x07
 	CmdSync            = 0x08
+	CmdWriteReg        = 0x09
+	CmdReadReg         = 0x0A
 	CmdSpiSetParams    = 0x0B
 	CmdSpiAttach       = 0x0D
+	CmdChangeBaudrate  = 0x0F
 	CmdFlashDeflBegin  = 0x10
 	CmdFlashDeflData   = 0x11
 	CmdFlashDeflEnd    = 0x12
+	CmdSpiFlashMD5     = 0x13
 	CmdGetSecurityInfo = 0x14
 )
 
+// CommandName returns the ROM command name, e.g. "FLASH_DEFL_DATA".
+func CommandName(cmd byte) string {
+	switch cmd {
+	case CmdFlashBegin:
+		return "FLASH_BEGIN"
+	case CmdFlashData:
+		return "FLASH_DATA"
+	case CmdFlashEnd:
+		return "FLASH_END"
+	case CmdMemBegin:
+		return "MEM_BEGIN"
+	case CmdMemEnd:
+		return "MEM_END"
+	case CmdMemData:
+		return "MEM_DATA"
+	case CmdSync:
+		return "SYNC"
+	case CmdWriteReg:
+		return "WRITE_REG"
+	case CmdReadReg:
+		return "READ_REG"
+	case CmdSpiSetParams:
+		return "SPI_SET_PARAMS"
+	case CmdSpiAttach:
+		return "SPI_ATTACH"
+	case CmdChangeBaudrate:
+		return "CHANGE_BAUDRATE"
+	case CmdFlashDeflBegin:
+		return "FLASH_DEFL_BEGIN"
+	case CmdFlashDeflData:
+		return "FLASH_DEFL_DATA"
+	case CmdFlashDeflEnd:
+		return "FLASH_DEFL_END"
+	case CmdSpiFlashMD5:
+		return "SPI_FLASH_MD5"
+	case CmdGetSecurityInfo:
+		return "GET_SECURITY_INFO"
+	default:
+		return fmt.Sprintf("CMD_0x%02X", cmd)
+	}
+}
+
 // Direction byte values
 const (
 	DirRequest  = 0x00
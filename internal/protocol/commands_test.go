@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
+	"strings"
 	"testing"
 )
 
@@ -31,6 +34,23 @@ func TestChipName_Unknown(t *testing.T) {
 	}
 }
 
+func TestCommandName(t *testing.T) {
+	tests := map[byte]string{
+		CmdSync:          "SYNC",
+		CmdFlashDeflData: "FLASH_DEFL_DATA",
+		CmdSpiFlashMD5:   "SPI_FLASH_MD5",
+		CmdReadReg:       "READ_REG",
+		CmdWriteReg:      "WRITE_REG",
+		CmdFlashData:     "FLASH_DATA",
+		0x7F:             "CMD_0x7F",
+	}
+	for cmd, want := range tests {
+		if got := CommandName(cmd); got != want {
+			t.Errorf("CommandName(0x%02X) = %q, want %q", cmd, got, want)
+		}
+	}
+}
+
 func TestErrorMessage_AllCodes(t *testing.T) {
 	tests := []struct {
 		code     byte
@@ -322,6 +342,62 @@ func TestCalculateEraseSize_Unaligned(t *testing.T) {
 	}
 }
 
+func TestReadRegData(t *testing.T) {
+	data := ReadRegData(EfuseMacWord0)
+	if len(data) != 4 || binary.LittleEndian.Uint32(data) != EfuseMacWord0 {
+		t.Errorf("ReadRegData() = % X, want 0x%X", data, EfuseMacWord0)
+	}
+}
+
+func TestMACFromEfuse(t *testing.T) {
+	mac := MACFromEfuse(0x56789ABC, 0x00001234)
+	want := [6]byte{0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC}
+	if mac != want {
+		t.Errorf("MACFromEfuse() = % X, want % X", mac, want)
+	}
+}
+
+func TestSpiFlashMD5Data(t *testing.T) {
+	data := SpiFlashMD5Data(0x10000, 0x2000)
+
+	if len(data) != 16 {
+		t.Fatalf("SpiFlashMD5Data() length = %d, want 16", len(data))
+	}
+	if addr := binary.LittleEndian.Uint32(data[0:4]); addr != 0x10000 {
+		t.Errorf("SpiFlashMD5Data address = 0x%X, want 0x10000", addr)
+	}
+	if size := binary.LittleEndian.Uint32(data[4:8]); size != 0x2000 {
+		t.Errorf("SpiFlashMD5Data size = 0x%X, want 0x2000", size)
+	}
+	for i := 8; i < 16; i++ {
+		if data[i] != 0 {
+			t.Errorf("SpiFlashMD5Data[%d] = 0x%02X, want 0x00", i, data[i])
+		}
+	}
+}
+
+func TestParseFlashMD5(t *testing.T) {
+	want := md5.Sum([]byte("papyrix"))
+
+	// ROM: 32 hex characters
+	sum, err := ParseFlashMD5([]byte(hex.EncodeToString(want[:])))
+	if err != nil || sum != want {
+		t.Errorf("ParseFlashMD5(hex) = %x, %v; want %x", sum, err, want)
+	}
+
+	// Stub: 16 raw bytes
+	sum, err = ParseFlashMD5(want[:])
+	if err != nil || sum != want {
+		t.Errorf("ParseFlashMD5(raw) = %x, %v; want %x", sum, err, want)
+	}
+
+	for _, data := range [][]byte{nil, {0x01, 0x02}, []byte(strings.Repeat("zz", 16))} {
+		if _, err := ParseFlashMD5(data); err == nil {
+			t.Errorf("ParseFlashMD5(%q) expected error", data)
+		}
+	}
+}
+
 func TestParseSecurityInfo_Valid(t *testing.T) {
 	data := make([]byte, 4)
 	binary.LittleEndian.PutUint32(data, ChipIDESP32C3)
@@ -373,22 +449,26 @@ func TestConstants(t *testing.T) {
 	commands := map[byte]string{
 		CmdFlashEnd:        "CmdFlashEnd",
 		CmdSync:            "CmdSync",
+		CmdReadReg:         "CmdReadReg",
 		CmdSpiSetParams:    "CmdSpiSetParams",
 		CmdSpiAttach:       "CmdSpiAttach",
 		CmdFlashDeflBegin:  "CmdFlashDeflBegin",
 		CmdFlashDeflData:   "CmdFlashDeflData",
 		CmdFlashDeflEnd:    "CmdFlashDeflEnd",
+		CmdSpiFlashMD5:     "CmdSpiFlashMD5",
 		CmdGetSecurityInfo: "CmdGetSecurityInfo",
 	}
 
 	expected := map[byte]byte{
 		0x04: CmdFlashEnd,
 		0x08: CmdSync,
+		0x0A: CmdReadReg,
 		0x0B: CmdSpiSetParams,
 		0x0D: CmdSpiAttach,
 		0x10: CmdFlashDeflBegin,
 		0x11: CmdFlashDeflData,
 		0x12: CmdFlashDeflEnd,
+		0x13: CmdSpiFlashMD5,
 		0x14: CmdGetSecurityInfo,
 	}
 
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Fields describes the decoded payload of a request, e.g.
+// "size=1024 seq=3 data=1024" for FLASH_DEFL_DATA. Payloads that are too
+// short for their command are described by their length only.
+func (r *Request) Fields() string {
+	words := func(names ...string) string {
+		if len(r.Data) < 4*len(names) {
+			return fmt.Sprintf("len=%d (short)", len(r.Data))
+		}
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = fmt.Sprintf("%s=%s", name, formatWord(name, binary.LittleEndian.Uint32(r.Data[4*i:])))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	switch r.Command {
+	case CmdSync, CmdGetSecurityInfo:
+		return ""
+	case CmdFlashBegin, CmdMemBegin:
+		return words("size", "blocks", "block_size", "offset")
+	case CmdFlashDeflBegin:
+		return words("erase_size", "blocks", "block_size", "offset")
+	case CmdFlashData, CmdMemData, CmdFlashDeflData:
+		fields := words("size", "seq")
+		if len(r.Data) >= dataHeaderSize {
+			fields += fmt.Sprintf(" data=%d", len(r.Data)-dataHeaderSize)
+		}
+		return fields
+	case CmdFlashEnd, CmdFlashDeflEnd:
+		if len(r.Data) < 4 {
+			return words("flag")
+		}
+		if binary.LittleEndian.Uint32(r.Data) == 0 {
+			return "reboot"
+		}
+		return "run application"
+	case CmdMemEnd:
+		return words("stay", "entry")
+	case CmdWriteReg:
+		return words("addr", "value", "mask", "delay_us")
+	case CmdReadReg:
+		return words("addr")
+	case CmdSpiSetParams:
+		return words("id", "total_size", "block_size", "sector_size", "page_size", "status_mask")
+	case CmdSpiAttach:
+		return words("config")
+	case CmdChangeBaudrate:
+		return words("baud", "old_baud")
+	case CmdSpiFlashMD5:
+		return words("addr", "size")
+	default:
+		return fmt.Sprintf("len=%d", len(r.Data))
+	}
+}
+
+// Fields describes the result carried by a successful response, e.g. the
+// register value of READ_REG or the digest of SPI_FLASH_MD5.
+func (r *Response) Fields() string {
+	switch r.Command {
+	case CmdReadReg:
+		return fmt.Sprintf("value=0x%08X", r.Value)
+	case CmdSpiFlashMD5:
+		sum, err := ParseFlashMD5(r.Data)
+		if err != nil {
+			return fmt.Sprintf("len=%d", len(r.Data))
+		}
+		return "md5=" + hex.EncodeToString(sum[:])
+	case CmdGetSecurityInfo:
+		info, err := ParseSecurityInfo(r.Data)
+		if err != nil {
+			return fmt.Sprintf("len=%d", len(r.Data))
+		}
+		return fmt.Sprintf("chip=%s (0x%X)", ChipName(info.ChipID), info.ChipID)
+	}
+	if len(r.Data) > 0 {
+		return fmt.Sprintf("len=%d", len(r.Data))
+	}
+	return ""
+}
+
+// formatWord formats addresses and masks in hex and counts in decimal.
+func formatWord(name string, v uint32) string {
+	switch name {
+	case "offset", "addr", "entry", "value", "mask", "status_mask", "id", "config":
+		return fmt.Sprintf("0x%X", v)
+	default:
+		return fmt.Sprintf("%d", v)
+	}
+}
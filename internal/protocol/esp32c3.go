@@ -9,3 +9,67 @@ const (
 
 // Default baud rate
 const DefaultBaudRate = 921600
+
+// Default flash size of the Xteink X4 (16MB)
+const DefaultFlashSize = 16 * 1024 * 1024
+
+// eFuse registers holding the factory MAC address
+const (
+	EfuseMacWord0 = 0x60008844
+	EfuseMacWord1 = 0x60008848
+)
+
+// SPI1 flash controller registers. The ROM has no command to read flash,
+// so the flasher runs SPI flash commands through them with WRITE_REG and
+// READ_REG.
+const (
+	SPI1Cmd     = 0x60002000
+	SPI1Addr    = 0x60002004
+	SPI1User    = 0x60002018
+	SPI1User1   = 0x6000201C
+	SPI1User2   = 0x60002020
+	SPI1MisoLen = 0x60002028
+	SPI1W0      = 0x60002058 // W0 to W15 hold 64 bytes of data
+)
+
+// SPI1 register fields
+const (
+	SPI1CmdUsr       = 1 << 18 // SPI1Cmd: start the user command; clear when done
+	SPI1UserCommand  = 1 << 31 // SPI1User: send a command
+	SPI1UserAddr     = 1 << 30 // SPI1User: send an address
+	SPI1UserMiso     = 1 << 28 // SPI1User: read data
+	SPI1AddrLenShift = 26      // SPI1User1: address bits - 1
+	SPI1CmdLenShift  = 28      // SPI1User2: command bits - 1
+	SPI1BufferSize   = 64
+)
+
+// SPI flash commands
+const FlashCmdRead = 0x03
+
+// RTC watchdog registers. The USB-Serial/JTAG controller cannot reset the
+// chip into its application, so the flasher arms the watchdog instead.
+// The configuration registers ignore writes until RTCWDTKey is written to
+// RTCWDTProtect.
+const (
+	RTCWDTConfig0 = 0x60008090
+	RTCWDTConfig1 = 0x60008094 // stage 0 timeout, in slow clock cycles
+	RTCWDTProtect = 0x600080A8
+	RTCWDTKey     = 0x50D83AA1
+)
+
+// RTCWDTConfig0 fields
+const (
+	RTCWDTEnable = 1 << 31
+	// RTCWDTArm enables the watchdog with stage 0 resetting the chip and
+	// the flash boot protection on, as esptool arms it
+	RTCWDTArm = RTCWDTEnable | 5<<28 | 1<<8 | 2
+)
+
+// MACFromEfuse assembles the factory MAC address from the two eFuse words.
+// The first word holds the low four bytes, the second the high two.
+func MACFromEfuse(word0, word1 uint32) [6]byte {
+	return [6]byte{
+		byte(word1 >> 8), byte(word1),
+		byte(word0 >> 24), byte(word0 >> 16), byte(word0 >> 8), byte(word0),
+	}
+}
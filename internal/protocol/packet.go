@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 )
 
@@ -31,15 +32,46 @@ func NewRequest(cmd byte, data []byte) *Request {
 	return r
 }
 
-// calculateChecksum computes the checksum for the request data.
+// calculateChecksum computes the checksum for the request data: 0xEF
+// XORed with each byte. For data commands the ROM checks it over the
+// payload only, not the size, seq and reserved words in front of it, as
+// esptool's checksum(data) computes it; other commands carry it but the
+// ROM ignores it.
 func (r *Request) calculateChecksum() uint32 {
+	data := r.Data
+	if IsDataCommand(r.Command) && len(data) >= dataHeaderSize {
+		data = data[dataHeaderSize:]
+	}
 	var checksum byte = 0xEF
-	for _, b := range r.Data {
+	for _, b := range data {
 		checksum ^= b
 	}
 	return uint32(checksum)
 }
 
+// dataHeaderSize is the size of the header (size, seq and two reserved
+// words) in front of the payload of data commands.
+const dataHeaderSize = 16
+
+// IsDataCommand reports whether cmd carries a block of data. The ROM
+// verifies the checksum of data commands only, over the payload after
+// their 16-byte header.
+func IsDataCommand(cmd byte) bool {
+	return cmd == CmdFlashData || cmd == CmdMemData || cmd == CmdFlashDeflData
+}
+
+// ChecksumValid reports whether the checksum of a decoded request is the
+// one the ROM expects. It is always true for commands whose checksum the
+// ROM ignores.
+func (r *Request) ChecksumValid() bool {
+	return !IsDataCommand(r.Command) || r.Checksum == r.calculateChecksum()
+}
+
+// ExpectedChecksum returns the checksum the ROM expects for the request.
+func (r *Request) ExpectedChecksum() uint32 {
+	return r.calculateChecksum()
+}
+
 // Encode serializes the request to bytes (before SLIP encoding).
 func (r *Request) Encode() []byte {
 	size := uint16(len(r.Data))
@@ -54,6 +86,29 @@ func (r *Request) Encode() []byte {
 	return packet
 }
 
+// DecodeRequest parses a request from raw bytes (after SLIP decoding).
+// The checksum is kept as sent; see ChecksumValid.
+func DecodeRequest(data []byte) (*Request, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("request too short: %d bytes", len(data))
+	}
+
+	if data[0] != DirRequest {
+		return nil, fmt.Errorf("invalid direction byte: 0x%02X", data[0])
+	}
+
+	dataSize := int(binary.LittleEndian.Uint16(data[2:4]))
+	if dataSize != len(data)-8 {
+		return nil, fmt.Errorf("data size mismatch: expected %d, have %d", dataSize, len(data)-8)
+	}
+
+	return &Request{
+		Command:  data[1],
+		Checksum: binary.LittleEndian.Uint32(data[4:8]),
+		Data:     data[8:],
+	}, nil
+}
+
 // DecodeResponse parses a response from raw bytes (after SLIP decoding).
 func DecodeResponse(data []byte) (*Response, error) {
 	if len(data) < 10 {
@@ -86,6 +141,18 @@ func DecodeResponse(data []byte) (*Response, error) {
 	return resp, nil
 }
 
+// Encode serializes the response to bytes (before SLIP encoding), with the
+// status and error bytes after the data.
+func (r *Response) Encode() []byte {
+	packet := make([]byte, 8, 8+len(r.Data)+2)
+	packet[0] = DirResponse
+	packet[1] = r.Command
+	binary.LittleEndian.PutUint16(packet[2:4], uint16(len(r.Data)+2))
+	binary.LittleEndian.PutUint32(packet[4:8], r.Value)
+	packet = append(packet, r.Data...)
+	return append(packet, r.Status, r.Error)
+}
+
 // IsSuccess returns true if the response indicates success.
 func (r *Response) IsSuccess() bool {
 	return r.Status == 0 && r.Error == 0
@@ -112,7 +179,8 @@ func SyncData() []byte {
 	return data
 }
 
-// FlashEndData creates the data payload for FLASH_END command.
+// FlashEndData creates the data payload for FLASH_END command. With
+// reboot the ROM resets the chip; otherwise it jumps to the application.
 func FlashEndData(reboot bool) []byte {
 	data := make([]byte, 4)
 	if reboot {
@@ -162,6 +230,7 @@ func FlashDeflDataData(compressedData []byte, seq uint32) []byte {
 }
 
 // FlashDeflEndData creates the data payload for FLASH_DEFL_END command.
+// The flag is that of FlashEndData.
 func FlashDeflEndData(reboot bool) []byte {
 	data := make([]byte, 4)
 	if reboot {
@@ -172,6 +241,49 @@ func FlashDeflEndData(reboot bool) []byte {
 	return data
 }
 
+// ReadRegData creates the data payload for READ_REG command.
+func ReadRegData(address uint32) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, address)
+	return data
+}
+
+// WriteRegData creates the data payload for WRITE_REG command, writing
+// all bits of the register with no delay.
+func WriteRegData(address, value uint32) []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint32(data[0:4], address)
+	binary.LittleEndian.PutUint32(data[4:8], value)
+	binary.LittleEndian.PutUint32(data[8:12], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(data[12:16], 0)
+	return data
+}
+
+// SpiFlashMD5Data creates the data payload for SPI_FLASH_MD5 command.
+func SpiFlashMD5Data(address, size uint32) []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint32(data[0:4], address)
+	binary.LittleEndian.PutUint32(data[4:8], size)
+	return data
+}
+
+// ParseFlashMD5 parses the response from SPI_FLASH_MD5 command. The ROM
+// returns the digest as 32 hex characters, the flasher stub as 16 raw bytes.
+func ParseFlashMD5(data []byte) ([16]byte, error) {
+	var sum [16]byte
+	switch {
+	case len(data) >= 32:
+		if _, err := hex.Decode(sum[:], data[:32]); err != nil {
+			return sum, fmt.Errorf("invalid MD5 response: %w", err)
+		}
+	case len(data) == 16:
+		copy(sum[:], data)
+	default:
+		return sum, fmt.Errorf("MD5 response has unexpected length %d", len(data))
+	}
+	return sum, nil
+}
+
 // CalculateDeflBlocks calculates the number of compressed blocks.
 func CalculateDeflBlocks(compressedLen, blockSize int) uint32 {
 	return uint32((compressedLen + blockSize - 1) / blockSize)
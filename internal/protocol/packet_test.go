@@ -336,3 +336,112 @@ func TestDirectionConstants(t *testing.T) {
 		t.Errorf("DirResponse = 0x%02X, want 0x01", DirResponse)
 	}
 }
+
+func TestNewRequest_Checksum_DataCommand(t *testing.T) {
+	// Data commands are checksummed over the payload only, not the header
+	payload := []byte{0x01, 0x02, 0x04}
+	req := NewRequest(CmdFlashDeflData, FlashDeflDataData(payload, 7))
+	expected := byte(0xEF) ^ 0x01 ^ 0x02 ^ 0x04
+	if req.Checksum != uint32(expected) {
+		t.Errorf("NewRequest checksum = 0x%X, want 0x%X", req.Checksum, expected)
+	}
+}
+
+func TestDecodeRequest_RoundTrip(t *testing.T) {
+	req := NewRequest(CmdFlashDeflData, FlashDeflDataData([]byte{0xAA, 0xBB}, 3))
+
+	got, err := DecodeRequest(req.Encode())
+	if err != nil {
+		t.Fatalf("DecodeRequest() error: %v", err)
+	}
+	if got.Command != req.Command || got.Checksum != req.Checksum || !bytes.Equal(got.Data, req.Data) {
+		t.Errorf("DecodeRequest() = %+v, want %+v", got, req)
+	}
+	if !got.ChecksumValid() {
+		t.Error("ChecksumValid() = false for an encoded request")
+	}
+}
+
+func TestDecodeRequest_ChecksumMismatch(t *testing.T) {
+	packet := NewRequest(CmdFlashDeflData, FlashDeflDataData([]byte{0xAA, 0xBB}, 0)).Encode()
+	packet[4] ^= 0xFF
+
+	req, err := DecodeRequest(packet)
+	if err != nil {
+		t.Fatalf("DecodeRequest() error: %v", err)
+	}
+	if req.ChecksumValid() {
+		t.Error("ChecksumValid() = true for a corrupted checksum")
+	}
+
+	// The ROM ignores the checksum of other commands
+	packet = NewRequest(CmdSync, SyncData()).Encode()
+	packet[4] ^= 0xFF
+	req, _ = DecodeRequest(packet)
+	if !req.ChecksumValid() {
+		t.Error("ChecksumValid() = false for SYNC")
+	}
+}
+
+func TestDecodeRequest_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"too short": {0x00, 0x08, 0x00},
+		"direction": {0x01, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		"size":      {0x00, 0x08, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01},
+	}
+	for name, data := range tests {
+		if _, err := DecodeRequest(data); err == nil {
+			t.Errorf("%s: DecodeRequest() expected error", name)
+		}
+	}
+}
+
+func TestRequest_Fields(t *testing.T) {
+	tests := []struct {
+		req  *Request
+		want string
+	}{
+		{NewRequest(CmdSync, SyncData()), ""},
+		{NewRequest(CmdFlashDeflBegin, FlashDeflBeginData(0x2000, 3, 0x400, 0x10000)), "erase_size=8192 blocks=3 block_size=1024 offset=0x10000"},
+		{NewRequest(CmdFlashDeflData, FlashDeflDataData(make([]byte, 100), 2)), "size=100 seq=2 data=100"},
+		{NewRequest(CmdFlashDeflEnd, FlashDeflEndData(true)), "reboot"},
+		{NewRequest(CmdReadReg, ReadRegData(0x60008844)), "addr=0x60008844"},
+		{NewRequest(CmdSpiFlashMD5, SpiFlashMD5Data(0x1000, 0x8000)), "addr=0x1000 size=32768"},
+		{NewRequest(CmdReadReg, nil), "len=0 (short)"},
+	}
+	for _, tt := range tests {
+		if got := tt.req.Fields(); got != tt.want {
+			t.Errorf("%s Fields() = %q, want %q", CommandName(tt.req.Command), got, tt.want)
+		}
+	}
+}
+
+func TestResponse_Fields(t *testing.T) {
+	resp := &Response{Command: CmdReadReg, Value: 0xDEADBEEF}
+	if got := resp.Fields(); got != "value=0xDEADBEEF" {
+		t.Errorf("READ_REG Fields() = %q", got)
+	}
+
+	resp = &Response{Command: CmdGetSecurityInfo, Data: []byte{0x05, 0, 0, 0}}
+	if got := resp.Fields(); !strings.Contains(got, "0x5") {
+		t.Errorf("GET_SECURITY_INFO Fields() = %q", got)
+	}
+
+	resp = &Response{Command: CmdSpiFlashMD5, Data: bytes.Repeat([]byte{0x11}, 16)}
+	if got := resp.Fields(); got != "md5="+strings.Repeat("11", 16) {
+		t.Errorf("SPI_FLASH_MD5 Fields() = %q", got)
+	}
+}
+
+func TestResponse_Encode_RoundTrip(t *testing.T) {
+	resp := &Response{Command: CmdReadReg, Value: 0x12345678, Data: []byte{0xAA}, Status: 1, Error: ErrInvalidCRC}
+
+	got, err := DecodeResponse(resp.Encode())
+	if err != nil {
+		t.Fatalf("DecodeResponse() error: %v", err)
+	}
+	if got.Command != resp.Command || got.Value != resp.Value || !bytes.Equal(got.Data, resp.Data) ||
+		got.Status != resp.Status || got.Error != resp.Error {
+		t.Errorf("DecodeResponse(Encode()) = %+v, want %+v", got, resp)
+	}
+}
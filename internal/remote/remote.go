@@ -0,0 +1,219 @@
+// Package remote connects to serial ports shared over the network, such as
+// devices plugged into a Raspberry Pi running ser2net.
+//
+// socket://host:port is a raw TCP connection to the serial line. Nothing
+// but data crosses it, so the device must already be in its bootloader and
+// the baud rate is fixed by the server.
+//
+// rfc2217://host:port speaks Telnet with the RFC 2217 COM-PORT option, which
+// carries baud rate changes and the DTR and RTS lines, so the device is
+// reset into its bootloader remotely just as on a local port.
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/reset"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+const (
+	// dialTimeout bounds connecting to the server.
+	dialTimeout = 5 * time.Second
+	// flushQuiet is how long the line must stay quiet for Flush to
+	// consider the server's buffer drained, and flushMax bounds the
+	// drain when the device keeps talking.
+	flushQuiet = 10 * time.Millisecond
+	flushMax   = 200 * time.Millisecond
+)
+
+func init() {
+	transport.Register("socket", openSocket)
+	transport.Register("rfc2217", openRFC2217)
+}
+
+// Conn is a serial port reached over TCP.
+type Conn struct {
+	conn net.Conn
+	name string
+	raw  []byte
+
+	// pending holds data received but not yet read.
+	pending []byte
+
+	// telnet is set for rfc2217:// connections.
+	telnet *telnet
+
+	wmu sync.Mutex
+}
+
+func dial(u *url.URL) (net.Conn, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s port URL %q needs host:port", u.Scheme, u.String())
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", u.Host, err)
+	}
+	return conn, nil
+}
+
+// openSocket opens a socket://host:port URL.
+func openSocket(u *url.URL, baudRate int) (transport.Transport, error) {
+	conn, err := dial(u)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, u.String()), nil
+}
+
+func newConn(conn net.Conn, name string) *Conn {
+	return &Conn{conn: conn, name: name, raw: make([]byte, 4096)}
+}
+
+// fill reads from the connection until the deadline, adding the data
+// received to pending. Telnet commands are answered on the way.
+func (c *Conn) fill(deadline time.Time) error {
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	n, err := c.conn.Read(c.raw)
+	if n > 0 {
+		if c.telnet == nil {
+			c.pending = append(c.pending, c.raw[:n]...)
+		} else if perr := c.telnet.receive(c, c.raw[:n]); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (c *Conn) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for len(c.pending) == 0 {
+		if err := c.fill(deadline); err != nil {
+			if isTimeout(err) {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	n := copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// write sends bytes as they are, without Telnet escaping.
+func (c *Conn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *Conn) Write(data []byte) (int, error) {
+	out := data
+	if c.telnet != nil {
+		out = escape(data)
+	}
+	if err := c.write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Flush discards data received but not yet read, including what is still
+// on its way from the server.
+func (c *Conn) Flush() error {
+	if c.telnet != nil {
+		if err := c.telnet.purge(c); err != nil {
+			return err
+		}
+	}
+	stop := time.Now().Add(flushMax)
+	for time.Now().Before(stop) {
+		c.pending = nil
+		if err := c.fill(time.Now().Add(flushQuiet)); err != nil {
+			if isTimeout(err) {
+				break
+			}
+			return err
+		}
+	}
+	c.pending = nil
+	return nil
+}
+
+// SetDTR sets the DTR line. A socket:// connection has no control lines and
+// ignores it.
+func (c *Conn) SetDTR(value bool) error {
+	if c.telnet == nil {
+		return nil
+	}
+	return c.telnet.setControl(c, value, controlDTROn, controlDTROff)
+}
+
+// SetRTS sets the RTS line. A socket:// connection has no control lines and
+// ignores it.
+func (c *Conn) SetRTS(value bool) error {
+	if c.telnet == nil {
+		return nil
+	}
+	return c.telnet.setControl(c, value, controlRTSOn, controlRTSOff)
+}
+
+// SetBaudRate asks the server to change the line speed. The speed of a
+// socket:// connection is set on the server.
+func (c *Conn) SetBaudRate(baudRate int) error {
+	if c.telnet == nil {
+		return fmt.Errorf("%s has a fixed baud rate; use rfc2217:// to change it", c.name)
+	}
+	return c.telnet.setBaudRate(c, baudRate)
+}
+
+// ResetToBootloader resets the ESP32 into bootloader mode using DTR/RTS,
+// the same sequence as on a local serial port. Over socket:// it only
+// flushes the line: the device must already be in its bootloader.
+func (c *Conn) ResetToBootloader() error {
+	if c.telnet == nil {
+		return c.Flush()
+	}
+
+	if err := reset.Classic(c); err != nil {
+		return err
+	}
+	// Discard any garbage from the reset
+	return c.Flush()
+}
+
+// HardReset performs a hard reset (without entering bootloader). It does
+// nothing over socket://.
+func (c *Conn) HardReset() error {
+	if c.telnet == nil {
+		return nil
+	}
+	if err := c.SetRTS(true); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	return c.SetRTS(false)
+}
+
+// PortName returns the URL the connection was opened with.
+func (c *Conn) PortName() string {
+	return c.name
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
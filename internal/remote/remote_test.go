@@ -0,0 +1,321 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/detect"
+	"github.com/bigbag/papyrix-flasher/internal/emulator"
+	"github.com/bigbag/papyrix-flasher/internal/flasher"
+	"github.com/bigbag/papyrix-flasher/internal/protocol"
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// server is an RFC 2217 access server stub in front of an emulated device.
+// It resets the device from RTS and DTR the way the ESP32-C3 USB
+// serial/JTAG controller does: asserting RTS with DTR low resets the chip,
+// into the bootloader if DTR was asserted since the last reset.
+type server struct {
+	ln  net.Listener
+	dev *emulator.Device
+	// refuse makes the server reject the COM-PORT option.
+	refuse bool
+
+	mu       sync.Mutex
+	bauds    []int
+	purges   int
+	dtr, rts bool
+	boot     bool
+
+	wmu  sync.Mutex
+	conn net.Conn
+	dec  telnetDecoder
+}
+
+func startServer(t *testing.T, dev *emulator.Device, refuse bool) *server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	s := &server{ln: ln, dev: dev, refuse: refuse}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *server) url() string {
+	return "rfc2217://" + s.ln.Addr().String()
+}
+
+func (s *server) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.conn = conn
+	s.dev.Serve(s)
+}
+
+// Read returns the data from the client, handling Telnet commands.
+func (s *server) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	n, err := s.conn.Read(buf)
+	data, cmds := s.dec.decode(buf[:n])
+	for _, cmd := range cmds {
+		s.handle(cmd)
+	}
+	return copy(p, data), err
+}
+
+// Write sends device output to the client.
+func (s *server) Write(p []byte) (int, error) {
+	if err := s.send(escape(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *server) send(raw []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.conn.Write(raw)
+	return err
+}
+
+func (s *server) handle(cmd telnetCommand) {
+	switch cmd.Verb {
+	case telnetWILL:
+		if cmd.Option == optComPort && s.refuse {
+			s.send([]byte{telnetIAC, telnetDONT, cmd.Option})
+		} else {
+			s.send([]byte{telnetIAC, telnetDO, cmd.Option})
+		}
+	case telnetDO:
+		s.send([]byte{telnetIAC, telnetWILL, cmd.Option})
+	case telnetSB:
+		if cmd.Option != optComPort || len(cmd.Data) == 0 {
+			return
+		}
+		reset, boot := s.command(cmd.Data[0], cmd.Data[1:])
+		s.send(subnegotiation(cmd.Data[0]+100, cmd.Data[1:]))
+		if reset {
+			if out := s.dev.Reset(boot); len(out) > 0 {
+				s.Write(out)
+			}
+		}
+	}
+}
+
+// command applies a COM-PORT command and reports whether it resets the
+// device, and into which mode.
+func (s *server) command(cmd byte, value []byte) (reset, boot bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case comSetBaudRate:
+		s.bauds = append(s.bauds, int(binary.BigEndian.Uint32(value)))
+	case comPurgeData:
+		s.purges++
+	case comSetControl:
+		inReset := s.rts && !s.dtr
+		switch value[0] {
+		case controlDTROn:
+			s.dtr = true
+		case controlDTROff:
+			s.dtr = false
+		case controlRTSOn:
+			s.rts = true
+		case controlRTSOff:
+			s.rts = false
+		}
+		if s.dtr {
+			s.boot = true
+		}
+		if !inReset && s.rts && !s.dtr {
+			reset, boot = true, s.boot
+			s.boot = false
+		}
+	}
+	return reset, boot
+}
+
+func (s *server) state() (bauds []int, purges int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.bauds...), s.purges
+}
+
+func TestTelnetDecoder(t *testing.T) {
+	stream := []byte{
+		'a', telnetIAC, telnetIAC, 'b',
+		telnetIAC, telnetDO, optComPort,
+		telnetIAC, telnetSB, optComPort, comSetBaudRate + 100, 0, 1, telnetIAC, telnetIAC, 0, telnetIAC, telnetSE,
+		'c',
+	}
+
+	// Feed the stream one byte at a time to split every command
+	var d telnetDecoder
+	var data []byte
+	var cmds []telnetCommand
+	for i := range stream {
+		got, c := d.decode(stream[i : i+1])
+		data = append(data, got...)
+		cmds = append(cmds, c...)
+	}
+
+	if want := []byte{'a', 0xFF, 'b', 'c'}; !bytes.Equal(data, want) {
+		t.Errorf("data = %x, want %x", data, want)
+	}
+	if len(cmds) != 2 {
+		t.Fatalf("got %d commands, want 2", len(cmds))
+	}
+	if cmds[0].Verb != telnetDO || cmds[0].Option != optComPort {
+		t.Errorf("commands[0] = %+v, want DO COM-PORT", cmds[0])
+	}
+	if cmds[1].Verb != telnetSB || cmds[1].Option != optComPort {
+		t.Errorf("commands[1] = %+v, want COM-PORT subnegotiation", cmds[1])
+	}
+	if want := []byte{comSetBaudRate + 100, 0, 1, 0xFF, 0}; !bytes.Equal(cmds[1].Data, want) {
+		t.Errorf("subnegotiation data = %x, want %x", cmds[1].Data, want)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	got := escape([]byte{1, 0xFF, 2, 0xFF, 0xFF})
+	want := []byte{1, 0xFF, 0xFF, 2, 0xFF, 0xFF, 0xFF, 0xFF}
+	if !bytes.Equal(got, want) {
+		t.Errorf("escape() = %x, want %x", got, want)
+	}
+}
+
+func TestRFC2217_Probe(t *testing.T) {
+	dev := emulator.New(0x10000)
+	dev.Reset(false) // running the application
+
+	s := startServer(t, dev, false)
+	port, err := transport.Open(s.url(), 115200)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	defer port.Close()
+
+	result, err := detect.Probe(port)
+	if err != nil {
+		t.Fatalf("Probe() error: %v", err)
+	}
+	if result.ChipID != protocol.ChipIDESP32C3 {
+		t.Errorf("ChipID = 0x%X, want 0x%X", result.ChipID, protocol.ChipIDESP32C3)
+	}
+	if result.Port != s.url() {
+		t.Errorf("Port = %q, want %q", result.Port, s.url())
+	}
+	if !dev.InBootloader() {
+		t.Error("device not in bootloader after Probe()")
+	}
+
+	bauds, purges := s.state()
+	if len(bauds) == 0 || bauds[0] != 115200 {
+		t.Errorf("server baud rates = %v, want 115200 first", bauds)
+	}
+	if purges == 0 {
+		t.Error("Flush() did not purge the server's buffer")
+	}
+}
+
+func TestRFC2217_Flash(t *testing.T) {
+	dev := emulator.New(4 * 1024 * 1024)
+	s := startServer(t, dev, false)
+	port, err := transport.Open(s.url(), 115200)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	defer port.Close()
+
+	f := flasher.New(port)
+	if err := f.Connect(); err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+
+	// Random data is full of 0xFF bytes that must cross escaped
+	image := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(image)
+	if err := f.FlashImageCompressed(image, 0x10000, false); err != nil {
+		t.Fatalf("FlashImageCompressed() error: %v", err)
+	}
+	if got := dev.Flash()[0x10000 : 0x10000+len(image)]; !bytes.Equal(got, image) {
+		t.Error("flash contents differ from the image")
+	}
+
+	if err := port.SetBaudRate(921600); err != nil {
+		t.Fatalf("SetBaudRate() error: %v", err)
+	}
+	if err := port.HardReset(); err != nil {
+		t.Fatalf("HardReset() error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for dev.InBootloader() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dev.InBootloader() {
+		t.Error("device still in bootloader after HardReset()")
+	}
+	if bauds, _ := s.state(); bauds[len(bauds)-1] != 921600 {
+		t.Errorf("server baud rates = %v, want 921600 last", bauds)
+	}
+}
+
+func TestRFC2217_Refused(t *testing.T) {
+	s := startServer(t, emulator.New(0x10000), true)
+	if _, err := transport.Open(s.url(), 115200); err == nil {
+		t.Error("Open() succeeded against a server refusing COM-PORT")
+	}
+}
+
+func TestOpen_NoPort(t *testing.T) {
+	for _, name := range []string{"rfc2217://localhost", "socket://"} {
+		if _, err := transport.Open(name, 115200); err == nil {
+			t.Errorf("Open(%q) succeeded", name)
+		}
+	}
+}
+
+func TestSocket(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer ln.Close()
+	dev := emulator.New(0x10000)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dev.Serve(conn)
+	}()
+
+	port, err := transport.Open("socket://"+ln.Addr().String(), 115200)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	defer port.Close()
+
+	result, err := detect.Probe(port)
+	if err != nil {
+		t.Fatalf("Probe() error: %v", err)
+	}
+	if result.ChipID != protocol.ChipIDESP32C3 {
+		t.Errorf("ChipID = 0x%X, want 0x%X", result.ChipID, protocol.ChipIDESP32C3)
+	}
+	if err := port.SetBaudRate(921600); err == nil {
+		t.Error("SetBaudRate() succeeded on a socket:// port")
+	}
+}
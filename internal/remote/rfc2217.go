@@ -0,0 +1,282 @@
+package remote
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// Telnet commands (RFC 854).
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// Telnet options.
+const (
+	optBinary  = 0
+	optSGA     = 3 // suppress go-ahead
+	optComPort = 44
+)
+
+// COM-PORT option commands (RFC 2217). The server answers each with the
+// command plus 100.
+const (
+	comSetBaudRate = 1
+	comSetDataSize = 2
+	comSetParity   = 3
+	comSetStopSize = 4
+	comSetControl  = 5
+	comPurgeData   = 12
+
+	parityNone    = 1
+	stopSizeOne   = 1
+	purgeReceive  = 1 // the server's buffer of data from the device
+	controlDTROn  = 8
+	controlDTROff = 9
+	controlRTSOn  = 11
+	controlRTSOff = 12
+)
+
+// negotiateTimeout bounds waiting for the server to accept the COM-PORT
+// option. Servers that stay silent are assumed to support it.
+const negotiateTimeout = time.Second
+
+// telnetCommand is an option negotiation or a subnegotiation.
+type telnetCommand struct {
+	Verb   byte // telnetWILL, telnetWONT, telnetDO, telnetDONT or telnetSB
+	Option byte
+	Data   []byte // subnegotiation parameters, unescaped
+}
+
+// Decoder states.
+const (
+	stateData = iota
+	stateIAC
+	stateOption // after WILL, WONT, DO or DONT
+	stateSub
+	stateSubIAC
+)
+
+// telnetDecoder separates data from Telnet commands in a byte stream. A
+// command may be split across reads.
+type telnetDecoder struct {
+	state int
+	verb  byte
+	sub   []byte
+}
+
+// decode returns the data bytes in p and the commands completed by p.
+func (d *telnetDecoder) decode(p []byte) ([]byte, []telnetCommand) {
+	var data []byte
+	var cmds []telnetCommand
+	for _, b := range p {
+		switch d.state {
+		case stateData:
+			if b == telnetIAC {
+				d.state = stateIAC
+			} else {
+				data = append(data, b)
+			}
+		case stateIAC:
+			switch b {
+			case telnetIAC:
+				data = append(data, b)
+				d.state = stateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				d.verb = b
+				d.state = stateOption
+			case telnetSB:
+				d.sub = d.sub[:0]
+				d.state = stateSub
+			default:
+				// NOP, GA and the like carry nothing we use
+				d.state = stateData
+			}
+		case stateOption:
+			cmds = append(cmds, telnetCommand{Verb: d.verb, Option: b})
+			d.state = stateData
+		case stateSub:
+			if b == telnetIAC {
+				d.state = stateSubIAC
+			} else {
+				d.sub = append(d.sub, b)
+			}
+		case stateSubIAC:
+			switch b {
+			case telnetIAC:
+				d.sub = append(d.sub, b)
+				d.state = stateSub
+			case telnetSE:
+				if len(d.sub) > 0 {
+					cmds = append(cmds, telnetCommand{
+						Verb:   telnetSB,
+						Option: d.sub[0],
+						Data:   append([]byte(nil), d.sub[1:]...),
+					})
+				}
+				d.state = stateData
+			default:
+				d.state = stateSub
+			}
+		}
+	}
+	return data, cmds
+}
+
+// escape doubles the IAC bytes in data.
+func escape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			out = append(out, telnetIAC)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// subnegotiation encodes a COM-PORT option command.
+func subnegotiation(cmd byte, value []byte) []byte {
+	out := []byte{telnetIAC, telnetSB, optComPort, cmd}
+	out = append(out, escape(value)...)
+	return append(out, telnetIAC, telnetSE)
+}
+
+// telnet is the client side of an RFC 2217 session.
+type telnet struct {
+	dec telnetDecoder
+	// local and remote hold the options enabled on each side.
+	local  map[byte]bool
+	remote map[byte]bool
+	// comPort is set once the server accepts or refuses the COM-PORT
+	// option: 1 for accepted, -1 for refused.
+	comPort int
+}
+
+// openRFC2217 opens an rfc2217://host:port URL.
+func openRFC2217(u *url.URL, baudRate int) (transport.Transport, error) {
+	conn, err := dial(u)
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(conn, u.String())
+	c.telnet = &telnet{local: map[byte]bool{}, remote: map[byte]bool{}}
+	if err := c.telnet.negotiate(c, baudRate); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// negotiate enables binary transmission and the COM-PORT option, then
+// configures the line.
+func (t *telnet) negotiate(c *Conn, baudRate int) error {
+	var out []byte
+	for _, opt := range []byte{optBinary, optSGA} {
+		out = append(out, telnetIAC, telnetWILL, opt, telnetIAC, telnetDO, opt)
+		t.local[opt] = true
+		t.remote[opt] = true
+	}
+	out = append(out, telnetIAC, telnetWILL, optComPort)
+	t.local[optComPort] = true
+	if err := c.write(out); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(negotiateTimeout)
+	for t.comPort == 0 && time.Now().Before(deadline) {
+		if err := c.fill(deadline); err != nil && !isTimeout(err) {
+			return err
+		}
+	}
+	if t.comPort < 0 {
+		return fmt.Errorf("%s does not support RFC 2217 port control", c.name)
+	}
+
+	if err := t.setBaudRate(c, baudRate); err != nil {
+		return err
+	}
+	return c.write(append(append(
+		subnegotiation(comSetDataSize, []byte{8}),
+		subnegotiation(comSetParity, []byte{parityNone})...),
+		subnegotiation(comSetStopSize, []byte{stopSizeOne})...))
+}
+
+// receive adds the data in p to the pending data of c and answers option
+// negotiations.
+func (t *telnet) receive(c *Conn, p []byte) error {
+	data, cmds := t.dec.decode(p)
+	c.pending = append(c.pending, data...)
+
+	var out []byte
+	for _, cmd := range cmds {
+		opt := cmd.Option
+		supported := opt == optBinary || opt == optSGA || opt == optComPort
+		switch cmd.Verb {
+		case telnetDO:
+			if opt == optComPort {
+				t.comPort = 1
+			}
+			if !supported {
+				out = append(out, telnetIAC, telnetWONT, opt)
+			} else if !t.local[opt] {
+				t.local[opt] = true
+				out = append(out, telnetIAC, telnetWILL, opt)
+			}
+		case telnetDONT:
+			if opt == optComPort {
+				t.comPort = -1
+			}
+			if t.local[opt] {
+				t.local[opt] = false
+				out = append(out, telnetIAC, telnetWONT, opt)
+			}
+		case telnetWILL:
+			// The COM-PORT option runs from client to server only
+			if !supported || opt == optComPort {
+				out = append(out, telnetIAC, telnetDONT, opt)
+			} else if !t.remote[opt] {
+				t.remote[opt] = true
+				out = append(out, telnetIAC, telnetDO, opt)
+			}
+		case telnetWONT:
+			if t.remote[opt] {
+				t.remote[opt] = false
+				out = append(out, telnetIAC, telnetDONT, opt)
+			}
+		}
+		// Subnegotiations from the server acknowledge our commands or
+		// report line state; neither changes what we do next.
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return c.write(out)
+}
+
+func (t *telnet) setBaudRate(c *Conn, baudRate int) error {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(baudRate))
+	return c.write(subnegotiation(comSetBaudRate, value))
+}
+
+func (t *telnet) setControl(c *Conn, value bool, on, off byte) error {
+	if value {
+		return c.write(subnegotiation(comSetControl, []byte{on}))
+	}
+	return c.write(subnegotiation(comSetControl, []byte{off}))
+}
+
+// purge asks the server to discard the device output it holds.
+func (t *telnet) purge(c *Conn) error {
+	return c.write(subnegotiation(comPurgeData, []byte{purgeReceive}))
+}
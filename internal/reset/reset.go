@@ -0,0 +1,60 @@
+// Package reset drives the DTR and RTS lines of a serial port to reset an
+// ESP32 into its ROM bootloader or its application.
+//
+// Boards with a USB-UART bridge wire the lines to the EN and GPIO9 (GPIO0
+// on older chips) pins through two transistors. The ESP32-C3's built-in
+// USB-Serial/JTAG controller has no such circuit: it resets the chip
+// itself, when RTS is set without DTR, and remembers a DTR set without RTS
+// as a request to boot into the bootloader.
+package reset
+
+import "time"
+
+// Lines are the modem control lines of a port.
+type Lines interface {
+	SetDTR(value bool) error
+	SetRTS(value bool) error
+}
+
+// step sets both lines, RTS first, and waits.
+type step struct {
+	dtr, rts bool
+	wait     time.Duration
+}
+
+func run(l Lines, steps []step) error {
+	for _, s := range steps {
+		if err := l.SetRTS(s.rts); err != nil {
+			return err
+		}
+		if err := l.SetDTR(s.dtr); err != nil {
+			return err
+		}
+		time.Sleep(s.wait)
+	}
+	return nil
+}
+
+// Classic resets a chip into its bootloader through the two-transistor
+// circuit: it holds EN low, then releases it with the boot pin low.
+func Classic(l Lines) error {
+	return run(l, []step{
+		{dtr: false, rts: true, wait: 100 * time.Millisecond}, // EN low
+		{dtr: true, rts: false, wait: 50 * time.Millisecond},  // EN high, boot pin low
+		{dtr: false, rts: true, wait: 50 * time.Millisecond},  // boot pin high
+		{dtr: false, rts: false, wait: 100 * time.Millisecond},
+	})
+}
+
+// USBJTAGSerial resets a chip into its bootloader through the USB-Serial/JTAG
+// controller. The lines go from the boot request to reset through both
+// set rather than both clear, which would release the chip early.
+func USBJTAGSerial(l Lines) error {
+	return run(l, []step{
+		{dtr: false, rts: false, wait: 100 * time.Millisecond},
+		{dtr: true, rts: false, wait: 100 * time.Millisecond}, // request the bootloader
+		{dtr: true, rts: true},
+		{dtr: false, rts: true, wait: 100 * time.Millisecond}, // reset
+		{dtr: false, rts: false},
+	})
+}
@@ -0,0 +1,58 @@
+package reset
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// recorder records the state of the lines after each change.
+type recorder struct {
+	dtr, rts bool
+	states   []string
+}
+
+func (r *recorder) SetDTR(value bool) error {
+	r.dtr = value
+	r.record()
+	return nil
+}
+
+func (r *recorder) SetRTS(value bool) error {
+	r.rts = value
+	r.record()
+	return nil
+}
+
+func (r *recorder) record() {
+	state := fmt.Sprintf("dtr=%v rts=%v", r.dtr, r.rts)
+	if len(r.states) == 0 || r.states[len(r.states)-1] != state {
+		r.states = append(r.states, state)
+	}
+}
+
+func TestClassic(t *testing.T) {
+	var r recorder
+	if err := Classic(&r); err != nil {
+		t.Fatalf("Classic() error: %v", err)
+	}
+	// EN is released with the boot pin low, and the lines end clear
+	want := []string{"dtr=false rts=true", "dtr=false rts=false", "dtr=true rts=false", "dtr=true rts=true", "dtr=false rts=true", "dtr=false rts=false"}
+	if !slices.Equal(r.states, want) {
+		t.Errorf("line states = %q, want %q", r.states, want)
+	}
+}
+
+func TestUSBJTAGSerial(t *testing.T) {
+	var r recorder
+	r.rts = true // left set by a previous reset
+	if err := USBJTAGSerial(&r); err != nil {
+		t.Fatalf("USBJTAGSerial() error: %v", err)
+	}
+	// The boot request comes before the reset, and DTR and RTS are never
+	// clear together between them
+	want := []string{"dtr=false rts=false", "dtr=true rts=false", "dtr=true rts=true", "dtr=false rts=true", "dtr=false rts=false"}
+	if !slices.Equal(r.states, want) {
+		t.Errorf("line states = %q, want %q", r.states, want)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"go.bug.st/serial"
+
+	"github.com/bigbag/papyrix-flasher/internal/reset"
 )
 
 // Port wraps a serial port with ESP32-specific functionality.
@@ -143,60 +145,35 @@ func (p *Port) SetRTS(value bool) error {
 	return p.port.SetRTS(value)
 }
 
-// ResetToBootloader resets the ESP32 into bootloader mode using DTR/RTS.
-// This uses the common auto-reset circuit used on most ESP32 dev boards.
-func (p *Port) ResetToBootloader() error {
+// SetBaudRate changes the baud rate.
+func (p *Port) SetBaudRate(baudRate int) error {
 	if p.raw != nil {
-		return p.raw.ResetToBootloader()
-	}
-
-	// Classic reset sequence:
-	// 1. RTS high, DTR low -> EN low (reset), GPIO0 high
-	// 2. RTS low, DTR high -> EN high (run), GPIO0 low (boot mode)
-	// 3. RTS high, DTR low -> release GPIO0
-
-	// Note: Signal polarities are inverted due to transistor drivers
-
-	// Step 1: Assert EN (reset)
-	if err := p.SetRTS(true); err != nil {
-		return err
-	}
-	if err := p.SetDTR(false); err != nil {
-		return err
-	}
-	time.Sleep(100 * time.Millisecond)
-
-	// Step 2: Assert GPIO0 (boot mode), release EN
-	if err := p.SetRTS(false); err != nil {
-		return err
-	}
-	if err := p.SetDTR(true); err != nil {
-		return err
-	}
-	time.Sleep(50 * time.Millisecond)
-
-	// Step 3: Release GPIO0
-	if err := p.SetRTS(true); err != nil {
-		return err
-	}
-	if err := p.SetDTR(false); err != nil {
-		return err
+		if err := p.raw.SetBaudRate(baudRate); err != nil {
+			return err
+		}
+	} else {
+		mode := &serial.Mode{
+			BaudRate: baudRate,
+			DataBits: 8,
+			Parity:   serial.NoParity,
+			StopBits: serial.OneStopBit,
+		}
+		if err := p.port.SetMode(mode); err != nil {
+			return fmt.Errorf("failed to set baud rate: %w", err)
+		}
 	}
-	time.Sleep(50 * time.Millisecond)
+	p.baudRate = baudRate
+	return nil
+}
 
-	// Final: Release all
-	if err := p.SetRTS(false); err != nil {
-		return err
-	}
-	if err := p.SetDTR(false); err != nil {
+// ResetToBootloader resets the ESP32 into bootloader mode using DTR/RTS.
+// This uses the common auto-reset circuit used on most ESP32 dev boards.
+func (p *Port) ResetToBootloader() error {
+	if err := reset.Classic(p); err != nil {
 		return err
 	}
-
 	// Flush any garbage from reset
-	p.Flush()
-	time.Sleep(100 * time.Millisecond)
-
-	return nil
+	return p.Flush()
 }
 
 // HardReset performs a hard reset (without entering bootloader).
@@ -221,6 +198,12 @@ func (p *Port) PortName() string {
 	return p.portName
 }
 
+// USBID returns the USB vendor and product IDs of the port, or zeros if
+// it is not a USB device or they cannot be read.
+func (p *Port) USBID() (vid, pid uint16) {
+	return usbID(p.portName)
+}
+
 // BaudRate returns the current baud rate.
 func (p *Port) BaudRate() int {
 	return p.baudRate
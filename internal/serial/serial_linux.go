@@ -181,6 +181,17 @@ func (p *RawPort) configure() error {
 	return nil
 }
 
+// SetBaudRate changes the baud rate of an open port
+func (p *RawPort) SetBaudRate(baudRate int) error {
+	old := p.baudRate
+	p.baudRate = baudRate
+	if err := p.configure(); err != nil {
+		p.baudRate = old
+		return err
+	}
+	return nil
+}
+
 // Close closes the serial port
 func (p *RawPort) Close() error {
 	if p.file != nil {
@@ -258,34 +269,29 @@ func (p *RawPort) Flush() error {
 
 // SetDTR sets the DTR signal
 func (p *RawPort) SetDTR(value bool) error {
-	var bits int
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(p.fd), TIOCMGET, uintptr(unsafe.Pointer(&bits))); errno != 0 {
-		return errno
-	}
-
-	if value {
-		bits |= TIOCM_DTR
-	} else {
-		bits &^= TIOCM_DTR
-	}
-
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(p.fd), TIOCMSET, uintptr(unsafe.Pointer(&bits))); errno != 0 {
-		return errno
-	}
-	return nil
+	return p.setModemLine(TIOCM_DTR, value)
 }
 
 // SetRTS sets the RTS signal
 func (p *RawPort) SetRTS(value bool) error {
+	return p.setModemLine(TIOCM_RTS, value)
+}
+
+// setModemLine sets or clears a modem control line. Ports without modem
+// lines, such as pseudo-terminals, ignore it.
+func (p *RawPort) setModemLine(line int, value bool) error {
 	var bits int
 	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(p.fd), TIOCMGET, uintptr(unsafe.Pointer(&bits))); errno != 0 {
+		if errno == syscall.ENOTTY || errno == syscall.EINVAL {
+			return nil
+		}
 		return errno
 	}
 
 	if value {
-		bits |= TIOCM_RTS
+		bits |= line
 	} else {
-		bits &^= TIOCM_RTS
+		bits &^= line
 	}
 
 	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(p.fd), TIOCMSET, uintptr(unsafe.Pointer(&bits))); errno != 0 {
@@ -294,51 +300,6 @@ func (p *RawPort) SetRTS(value bool) error {
 	return nil
 }
 
-// ResetToBootloader resets the ESP32 into bootloader mode
-func (p *RawPort) ResetToBootloader() error {
-	// Classic reset sequence for ESP32 bootloader
-	// Step 1: Assert EN (reset)
-	if err := p.SetRTS(true); err != nil {
-		return err
-	}
-	if err := p.SetDTR(false); err != nil {
-		return err
-	}
-	time.Sleep(100 * time.Millisecond)
-
-	// Step 2: Assert GPIO0 (boot mode), release EN
-	if err := p.SetRTS(false); err != nil {
-		return err
-	}
-	if err := p.SetDTR(true); err != nil {
-		return err
-	}
-	time.Sleep(50 * time.Millisecond)
-
-	// Step 3: Release GPIO0
-	if err := p.SetRTS(true); err != nil {
-		return err
-	}
-	if err := p.SetDTR(false); err != nil {
-		return err
-	}
-	time.Sleep(50 * time.Millisecond)
-
-	// Final: Release all
-	if err := p.SetRTS(false); err != nil {
-		return err
-	}
-	if err := p.SetDTR(false); err != nil {
-		return err
-	}
-
-	// Flush any garbage from reset
-	p.Flush()
-	time.Sleep(100 * time.Millisecond)
-
-	return nil
-}
-
 // HardReset performs a hard reset
 func (p *RawPort) HardReset() error {
 	if err := p.SetRTS(true); err != nil {
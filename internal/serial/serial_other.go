@@ -52,12 +52,12 @@ func (p *RawPort) SetRTS(value bool) error {
 	return errors.New("raw serial port not supported on this platform")
 }
 
-// ResetToBootloader is a stub - never called on non-Linux platforms.
-func (p *RawPort) ResetToBootloader() error {
+// HardReset is a stub - never called on non-Linux platforms.
+func (p *RawPort) HardReset() error {
 	return errors.New("raw serial port not supported on this platform")
 }
 
-// HardReset is a stub - never called on non-Linux platforms.
-func (p *RawPort) HardReset() error {
+// SetBaudRate is a stub - never called on non-Linux platforms.
+func (p *RawPort) SetBaudRate(baudRate int) error {
 	return errors.New("raw serial port not supported on this platform")
 }
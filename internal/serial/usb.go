@@ -0,0 +1,35 @@
+//go:build linux || windows || (darwin && cgo)
+
+package serial
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// usbID looks up the USB vendor and product IDs of a port, following
+// symlinks such as those in /dev/serial/by-id. It returns zeros if the
+// port is not a USB device or the IDs cannot be read.
+func usbID(portName string) (vid, pid uint16) {
+	if path, err := filepath.EvalSymlinks(portName); err == nil {
+		portName = path
+	}
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return 0, 0
+	}
+	for _, p := range ports {
+		if p.Name != portName || !p.IsUSB {
+			continue
+		}
+		v, verr := strconv.ParseUint(p.VID, 16, 16)
+		d, perr := strconv.ParseUint(p.PID, 16, 16)
+		if verr != nil || perr != nil {
+			return 0, 0
+		}
+		return uint16(v), uint16(d)
+	}
+	return 0, 0
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows && !(darwin && cgo)
+
+package serial
+
+// usbID returns zeros: listing USB ports needs cgo on macOS and is not
+// implemented elsewhere.
+func usbID(portName string) (vid, pid uint16) {
+	return 0, 0
+}
@@ -0,0 +1,239 @@
+// Package symbols resolves code addresses to functions and source lines
+// with the debug information of an ELF file, as addr2line does.
+package symbols
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Location is the source of a code address.
+type Location struct {
+	Function string // empty when unknown
+	File     string // empty when the address has no line information
+	Line     int
+}
+
+func (l Location) String() string {
+	name := l.Function
+	if name == "" {
+		name = "??"
+	}
+	if l.File == "" {
+		return name
+	}
+	return fmt.Sprintf("%s at %s:%d", name, l.File, l.Line)
+}
+
+// Table resolves the code addresses of an ELF file.
+type Table struct {
+	text  []section  // executable sections
+	funcs []function // functions and inlined calls
+	lines []row      // line table, sorted by address
+}
+
+type span struct {
+	start, end uint64
+}
+
+func (s span) contains(addr uint64) bool {
+	return s.start <= addr && addr < s.end
+}
+
+type section struct {
+	span
+	data []byte
+}
+
+type function struct {
+	span
+	name string
+}
+
+type row struct {
+	addr uint64
+	file string
+	line int
+	end  bool // first address after a sequence of code
+}
+
+// Open reads the symbols of the ELF file at path.
+func Open(path string) (*Table, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Load reads the symbols of an ELF file. Functions come from the debug
+// information and the symbol table; source lines need the debug
+// information.
+func Load(f *elf.File) (*Table, error) {
+	t := &Table{}
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 && s.Flags&elf.SHF_EXECINSTR != 0 && s.Size > 0 {
+			data, err := s.Data()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", s.Name, err)
+			}
+			t.text = append(t.text, section{span{s.Addr, s.Addr + s.Size}, data})
+		}
+	}
+	if len(t.text) == 0 {
+		return nil, fmt.Errorf("ELF file has no code")
+	}
+
+	if f.Section(".debug_info") != nil {
+		d, err := f.DWARF()
+		if err == nil {
+			err = t.loadDWARF(d)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read debug info: %w", err)
+		}
+	}
+
+	// Symbols come after the debug information, which wins a tie
+	syms, _ := f.Symbols()
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Size > 0 {
+			t.funcs = append(t.funcs, function{span{s.Value, s.Value + s.Size}, s.Name})
+		}
+	}
+	if len(t.funcs) == 0 && len(t.lines) == 0 {
+		return nil, fmt.Errorf("ELF file has no symbols or debug info")
+	}
+
+	// At one address, the end of a sequence goes before the code that
+	// starts there
+	sort.SliceStable(t.lines, func(i, j int) bool {
+		a, b := t.lines[i], t.lines[j]
+		if a.addr != b.addr {
+			return a.addr < b.addr
+		}
+		return a.end && !b.end
+	})
+	return t, nil
+}
+
+func (t *Table) loadDWARF(d *dwarf.Data) error {
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return nil
+		}
+
+		switch e.Tag {
+		case dwarf.TagCompileUnit:
+			if err := t.loadLines(d, e); err != nil {
+				return err
+			}
+		case dwarf.TagSubprogram, dwarf.TagInlinedSubroutine:
+			ranges, err := d.Ranges(e)
+			if err != nil {
+				return err
+			}
+			if len(ranges) == 0 {
+				continue
+			}
+			name := functionName(d, e)
+			for _, rg := range ranges {
+				t.funcs = append(t.funcs, function{span{rg[0], rg[1]}, name})
+			}
+		}
+	}
+}
+
+func (t *Table) loadLines(d *dwarf.Data, cu *dwarf.Entry) error {
+	lr, err := d.LineReader(cu)
+	if err != nil || lr == nil {
+		return err
+	}
+	var entry dwarf.LineEntry
+	for {
+		if err := lr.Next(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r := row{addr: entry.Address, line: entry.Line, end: entry.EndSequence}
+		if entry.File != nil {
+			r.file = entry.File.Name
+		}
+		t.lines = append(t.lines, r)
+	}
+}
+
+// functionName returns the name of a function entry. Inlined calls and
+// out-of-line definitions name the function through another entry.
+func functionName(d *dwarf.Data, e *dwarf.Entry) string {
+	for depth := 0; depth < 4; depth++ {
+		if name, ok := e.Val(dwarf.AttrName).(string); ok {
+			return name
+		}
+		off, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		if !ok {
+			off, ok = e.Val(dwarf.AttrSpecification).(dwarf.Offset)
+		}
+		if !ok {
+			return ""
+		}
+		r := d.Reader()
+		r.Seek(off)
+		next, err := r.Next()
+		if err != nil || next == nil {
+			return ""
+		}
+		e = next
+	}
+	return ""
+}
+
+// Code returns the n bytes of code at addr, or false if they are not all
+// in one section of code.
+func (t *Table) Code(addr uint64, n int) ([]byte, bool) {
+	for _, s := range t.text {
+		if s.contains(addr) && addr+uint64(n) <= s.end && len(s.data) > 0 {
+			off := addr - s.start
+			return s.data[off : off+uint64(n)], true
+		}
+	}
+	return nil, false
+}
+
+// Lookup returns the location of a code address. It reports false for an
+// address outside the code of the file.
+func (t *Table) Lookup(addr uint64) (Location, bool) {
+	code := false
+	for _, s := range t.text {
+		code = code || s.contains(addr)
+	}
+	if !code {
+		return Location{}, false
+	}
+
+	// The innermost function, i.e. the inlined call, is the smallest.
+	// Crash reports are short, so a scan is fast enough
+	var loc Location
+	var best uint64
+	for _, f := range t.funcs {
+		if f.contains(addr) && (loc.Function == "" || f.end-f.start < best) {
+			loc.Function, best = f.name, f.end-f.start
+		}
+	}
+
+	i := sort.Search(len(t.lines), func(i int) bool { return t.lines[i].addr > addr }) - 1
+	if i >= 0 && !t.lines[i].end {
+		loc.File, loc.Line = t.lines[i].file, t.lines[i].line
+	}
+	return loc, true
+}
@@ -0,0 +1,56 @@
+package symbols
+
+import "testing"
+
+// testdata/panic.elf is built from testdata/panic.c; see there.
+
+func TestLookup(t *testing.T) {
+	table, err := Open("testdata/panic.elf")
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+
+	tests := []struct {
+		addr uint64
+		want string
+	}{
+		{0x42000020, "app_main at /src/panic.c:17"},
+		{0x4200002a, "scale at /src/panic.c:13"}, // inlined into app_main
+		{0x4200002c, "app_main at /src/panic.c:19"},
+		{0x42000031, "app_main at /src/panic.c:20"},
+		{0x42000047, "_start at /src/panic.c:25"},
+	}
+	for _, tt := range tests {
+		loc, ok := table.Lookup(tt.addr)
+		if !ok || loc.String() != tt.want {
+			t.Errorf("Lookup(%#x) = %q, %v; want %q", tt.addr, loc, ok, tt.want)
+		}
+	}
+
+	// Data and addresses outside the file are not code
+	for _, addr := range []uint64{0x4200004c, 0x40000000, 0} {
+		if loc, ok := table.Lookup(addr); ok {
+			t.Errorf("Lookup(%#x) = %q, want no location", addr, loc)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	table, err := Open("testdata/panic.elf")
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	// call app_main, in _start
+	if code, ok := table.Code(0x42000042, 5); !ok || code[0] != 0xE8 {
+		t.Errorf("Code(0x42000042) = %x, %v; want a call", code, ok)
+	}
+	if _, ok := table.Code(0x4200004c, 4); ok {
+		t.Error("Code() returned data for an address outside the code")
+	}
+}
+
+func TestOpen_NotELF(t *testing.T) {
+	if _, err := Open("testdata/panic.c"); err == nil {
+		t.Error("Open() of a C file succeeded")
+	}
+}
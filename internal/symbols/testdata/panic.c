@@ -0,0 +1,28 @@
+// Source of panic.elf, a stand-in firmware for the symbols tests. Build it
+// from this directory with:
+//
+//	gcc -m32 -g -O2 -fno-pic -nostdlib -static -no-pie -fno-asynchronous-unwind-tables \
+//	    -fdebug-prefix-map=$PWD=/src -Wl,-N,-Ttext=0x42000020,--build-id=none \
+//	    -o panic.elf panic.c
+
+volatile int sink;
+
+static inline int scale(int x)
+{
+	sink = x;
+	return x * 3;
+}
+
+__attribute__((noinline)) int app_main(int v)
+{
+	int r = scale(v);
+	sink = r;
+	return r + 1;
+}
+
+void _start(void)
+{
+	app_main(2);
+	for (;;)
+		;
+}
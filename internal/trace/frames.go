@@ -0,0 +1,66 @@
+package trace
+
+import (
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/slip"
+)
+
+// Frame is a SLIP frame reassembled from a trace or a raw capture.
+type Frame struct {
+	Time    time.Duration // time of the event that completed the frame
+	Dir     Direction     // Write for requests, Read for responses
+	Data    []byte        // decoded packet
+	Skipped []byte        // bytes before the frame outside any frame, e.g. boot messages
+}
+
+// Frames reassembles the frames written and read in a trace. Frames may
+// span several events; each direction is reassembled separately.
+func Frames(events []Event) []Frame {
+	var frames []Frame
+	buffers := map[Direction][]byte{}
+	for _, e := range events {
+		if e.Dir == Control {
+			continue
+		}
+		buffers[e.Dir] = append(buffers[e.Dir], e.Data...)
+		var found []Frame
+		found, buffers[e.Dir] = splitFrames(buffers[e.Dir])
+		for _, f := range found {
+			f.Time = e.Time
+			f.Dir = e.Dir
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// RawFrames splits a raw capture of both directions, e.g. from a logic
+// analyzer, into frames. The direction of each frame is taken from its
+// first byte.
+func RawFrames(data []byte) []Frame {
+	frames, _ := splitFrames(data)
+	for i := range frames {
+		frames[i].Dir = Read
+		if len(frames[i].Data) > 0 && frames[i].Data[0] == 0x00 {
+			frames[i].Dir = Write
+		}
+	}
+	return frames
+}
+
+// splitFrames returns the complete frames in data and the remaining bytes.
+func splitFrames(data []byte) ([]Frame, []byte) {
+	var frames []Frame
+	for {
+		frame, remaining := slip.ReadFrame(data)
+		if frame == nil {
+			return frames, data
+		}
+		skipped := data[:len(data)-len(frame)-len(remaining)]
+		if decoded := slip.Decode(frame); len(decoded) > 0 {
+			frames = append(frames, Frame{Data: decoded, Skipped: skipped})
+		}
+		data = remaining
+	}
+}
@@ -0,0 +1,128 @@
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// Recorder is a transport that writes every operation on the underlying
+// transport to a trace.
+type Recorder struct {
+	port    transport.Transport
+	w       *bufio.Writer
+	closer  io.Closer
+	started time.Time
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewRecorder records the operations on port to w.
+func NewRecorder(port transport.Transport, w io.Writer) *Recorder {
+	r := &Recorder{port: port, w: bufio.NewWriter(w), started: time.Now()}
+	fmt.Fprintf(r.w, "%s\n# port %s\n", Header, port.PortName())
+	if vid, pid := transport.USBID(port); vid != 0 {
+		r.record(Control, []byte(usbOp(vid, pid)))
+	}
+	return r
+}
+
+// Create records the operations on port to a new trace file.
+func Create(path string, port transport.Transport) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(port, file)
+	r.closer = file
+	return r, nil
+}
+
+// Close writes out the trace and closes the trace file and the port.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.port.Close()
+	if ferr := r.w.Flush(); err == nil {
+		err = ferr
+	}
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+func (r *Recorder) record(dir Direction, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := Event{Time: time.Since(r.started), Dir: dir, Data: data}
+	if _, err := fmt.Fprintln(r.w, e); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *Recorder) Write(data []byte) (int, error) {
+	n, err := r.port.Write(data)
+	if n > 0 {
+		r.record(Write, data[:n])
+	}
+	return n, err
+}
+
+func (r *Recorder) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	n, err := r.port.ReadWithTimeout(buf, timeout)
+	if n > 0 {
+		r.record(Read, buf[:n])
+	}
+	return n, err
+}
+
+func (r *Recorder) Flush() error {
+	r.record(Control, []byte(OpFlush))
+	return r.port.Flush()
+}
+
+func (r *Recorder) ResetToBootloader() error {
+	r.record(Control, []byte(OpReset))
+	return r.port.ResetToBootloader()
+}
+
+func (r *Recorder) HardReset() error {
+	r.record(Control, []byte(OpHardReset))
+	return r.port.HardReset()
+}
+
+func (r *Recorder) SetDTR(value bool) error {
+	r.record(Control, []byte(lineOp(OpDTR, value)))
+	return r.port.SetDTR(value)
+}
+
+func (r *Recorder) SetRTS(value bool) error {
+	r.record(Control, []byte(lineOp(OpRTS, value)))
+	return r.port.SetRTS(value)
+}
+
+func (r *Recorder) SetBaudRate(baudRate int) error {
+	r.record(Control, []byte(baudOp(baudRate)))
+	return r.port.SetBaudRate(baudRate)
+}
+
+func (r *Recorder) PortName() string {
+	return r.port.PortName()
+}
+
+func (r *Recorder) USBID() (vid, pid uint16) {
+	return transport.USBID(r.port)
+}
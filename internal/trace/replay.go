@@ -0,0 +1,144 @@
+package trace
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+// MismatchError reports a write that differs from the recorded one.
+type MismatchError struct {
+	Event int // index of the recorded event
+	Want  []byte
+	Got   []byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("trace: write differs from event %d: want %x, got %x", e.Event, e.Want, e.Got)
+}
+
+// Replay is a transport that plays back the device side of a trace. Each
+// write must match the next recorded write; reads return the bytes the
+// device sent in response. When the trace has nothing more to read before
+// the next write, reads wait for their timeout like a quiet line.
+type Replay struct {
+	events   []Event
+	next     int
+	pending  []byte
+	vid, pid uint16
+}
+
+// NewReplay returns a transport that replays events. It reports the USB
+// IDs recorded at the start of the trace, if any.
+func NewReplay(events []Event) *Replay {
+	r := &Replay{events: events}
+	if len(events) > 0 && events[0].Dir == Control {
+		if _, err := fmt.Sscanf(string(events[0].Data), OpUSB+"=%X:%X", &r.vid, &r.pid); err == nil {
+			r.events = events[1:]
+		}
+	}
+	return r
+}
+
+// Done reports whether every recorded write has been replayed.
+func (r *Replay) Done() bool {
+	for _, e := range r.events[r.next:] {
+		if e.Dir == Write {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Replay) Write(data []byte) (int, error) {
+	// Device output the host never read is discarded, as it was during
+	// the recording
+	r.pending = nil
+	for r.next < len(r.events) && r.events[r.next].Dir != Write {
+		r.next++
+	}
+	if r.next == len(r.events) {
+		return 0, fmt.Errorf("trace: write after the end of the trace: %x", data)
+	}
+
+	want := r.events[r.next].Data
+	if string(want) != string(data) {
+		return 0, &MismatchError{Event: r.next, Want: want, Got: data}
+	}
+	r.next++
+	return len(data), nil
+}
+
+func (r *Replay) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	if len(r.pending) == 0 && r.next < len(r.events) && r.events[r.next].Dir == Read {
+		r.pending = r.events[r.next].Data
+		r.next++
+	}
+	if len(r.pending) == 0 {
+		time.Sleep(timeout)
+		return 0, nil
+	}
+	n := copy(buf, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// control consumes the next event if it records the operation op.
+func (r *Replay) control(op string) error {
+	if r.next < len(r.events) && r.events[r.next].Dir == Control && string(r.events[r.next].Data) == op {
+		r.next++
+	}
+	return nil
+}
+
+func (r *Replay) Flush() error {
+	r.pending = nil
+	return r.control(OpFlush)
+}
+
+func (r *Replay) ResetToBootloader() error {
+	return r.control(OpReset)
+}
+
+func (r *Replay) HardReset() error {
+	return r.control(OpHardReset)
+}
+
+func (r *Replay) SetDTR(value bool) error {
+	return r.control(lineOp(OpDTR, value))
+}
+
+func (r *Replay) SetRTS(value bool) error {
+	return r.control(lineOp(OpRTS, value))
+}
+
+func (r *Replay) SetBaudRate(baudRate int) error {
+	return r.control(baudOp(baudRate))
+}
+
+func (r *Replay) PortName() string {
+	return "replay"
+}
+
+func (r *Replay) USBID() (vid, pid uint16) {
+	return r.vid, r.pid
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+func init() {
+	transport.Register("replay", openReplay)
+}
+
+// openReplay opens a replay://session.trace URL.
+func openReplay(u *url.URL, baudRate int) (transport.Transport, error) {
+	events, err := ReadFile(transport.Path(u))
+	if err != nil {
+		return nil, err
+	}
+	return NewReplay(events), nil
+}
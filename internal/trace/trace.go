@@ -0,0 +1,137 @@
+// Package trace records the bytes exchanged with a device and replays
+// them, so that a session captured in the field can be reproduced without
+// the hardware.
+//
+// A trace is a text file with one event per line: the time since the start
+// of the session in seconds, a direction and the bytes in hex. Control
+// operations such as resets are recorded by name. Lines starting with '#'
+// are comments.
+//
+//	# papyrix-flasher trace v1
+//	# port /dev/ttyACM0
+//	0.000012 ! reset
+//	0.301544 > c0000824000000000007071220555555...c0
+//	0.302188 < c0010804000000000000000000c0
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is the first line of a trace file.
+const Header = "# papyrix-flasher trace v1"
+
+// Direction tells who sent the bytes of an event.
+type Direction byte
+
+const (
+	Write   Direction = '>' // host to device
+	Read    Direction = '<' // device to host
+	Control Direction = '!' // line operation on the host side
+)
+
+// Control operations. Line and baud rate changes carry their value, e.g.
+// "dtr=1" or "baud=921600".
+const (
+	OpReset     = "reset"
+	OpHardReset = "hard-reset"
+	OpFlush     = "flush"
+	OpDTR       = "dtr"
+	OpRTS       = "rts"
+	OpBaud      = "baud"
+	OpUSB       = "usb" // the USB IDs of the port, first in the trace
+)
+
+func lineOp(op string, value bool) string {
+	if value {
+		return op + "=1"
+	}
+	return op + "=0"
+}
+
+func baudOp(baudRate int) string {
+	return fmt.Sprintf("%s=%d", OpBaud, baudRate)
+}
+
+func usbOp(vid, pid uint16) string {
+	return fmt.Sprintf("%s=%04X:%04X", OpUSB, vid, pid)
+}
+
+// Event is one read, write or control operation.
+type Event struct {
+	Time time.Duration // since the start of the session
+	Dir  Direction
+	Data []byte // bytes transferred, or the name of a control operation
+}
+
+// String formats the event as a trace line.
+func (e Event) String() string {
+	data := string(e.Data)
+	if e.Dir != Control {
+		data = hex.EncodeToString(e.Data)
+	}
+	return fmt.Sprintf("%.6f %c %s", e.Time.Seconds(), e.Dir, data)
+}
+
+// ParseEvent parses a trace line.
+func ParseEvent(line string) (Event, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || len(fields[1]) != 1 {
+		return Event{}, fmt.Errorf("malformed event %q", line)
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid time %q", fields[0])
+	}
+	e := Event{Time: time.Duration(seconds * float64(time.Second)), Dir: Direction(fields[1][0])}
+
+	switch e.Dir {
+	case Write, Read:
+		e.Data, err = hex.DecodeString(fields[2])
+		if err != nil {
+			return Event{}, fmt.Errorf("invalid data: %w", err)
+		}
+	case Control:
+		e.Data = []byte(fields[2])
+	default:
+		return Event{}, fmt.Errorf("unknown direction %q", fields[1])
+	}
+	return e, nil
+}
+
+// Parse reads the events of a trace.
+func Parse(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		e, err := ParseEvent(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// ReadFile reads the events of a trace file.
+func ReadFile(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
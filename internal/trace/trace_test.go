@@ -0,0 +1,231 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/transport/transporttest"
+)
+
+// fakePort answers every write with a fixed response.
+type fakePort struct {
+	transporttest.Port
+	response []byte
+	unread   []byte
+	written  [][]byte
+	closed   bool
+}
+
+func (p *fakePort) Write(data []byte) (int, error) {
+	p.written = append(p.written, append([]byte(nil), data...))
+	p.unread = p.response
+	return len(data), nil
+}
+
+func (p *fakePort) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	n := copy(buf, p.unread)
+	p.unread = p.unread[n:]
+	return n, nil
+}
+
+func (p *fakePort) Flush() error     { p.unread = nil; return nil }
+func (p *fakePort) PortName() string { return "/dev/fake" }
+func (p *fakePort) Close() error     { p.closed = true; return nil }
+
+func TestEvent_RoundTrip(t *testing.T) {
+	events := []Event{
+		{Time: 1500 * time.Microsecond, Dir: Control, Data: []byte(OpReset)},
+		{Time: 2 * time.Second, Dir: Write, Data: []byte{0xC0, 0x00, 0x08, 0xC0}},
+		{Time: 2*time.Second + time.Millisecond, Dir: Read, Data: []byte{0xC0, 0x01, 0xDB, 0xDC, 0xC0}},
+	}
+	for _, want := range events {
+		got, err := ParseEvent(want.String())
+		if err != nil {
+			t.Fatalf("ParseEvent(%q) error: %v", want.String(), err)
+		}
+		if got.Dir != want.Dir || !bytes.Equal(got.Data, want.Data) || got.Time.Round(time.Microsecond) != want.Time {
+			t.Errorf("ParseEvent(%q) = %+v, want %+v", want.String(), got, want)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []string{
+		"0.1 >",
+		"abc > c0",
+		"0.1 > zz",
+		"0.1 ? c0",
+	}
+	for _, line := range tests {
+		if _, err := Parse(strings.NewReader(Header + "\n" + line + "\n")); err == nil {
+			t.Errorf("Parse(%q) should fail", line)
+		} else if !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Parse(%q) error %q should name the line", line, err)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	port := &fakePort{response: []byte{0xC0, 0x01, 0x08, 0xC0}}
+	var out bytes.Buffer
+	r := NewRecorder(port, &out)
+
+	r.ResetToBootloader()
+	r.SetDTR(true)
+	r.Write([]byte{0xC0, 0x00, 0x08, 0xC0})
+	buf := make([]byte, 2)
+	r.ReadWithTimeout(buf, time.Millisecond)
+	r.ReadWithTimeout(buf, time.Millisecond)
+	r.ReadWithTimeout(buf, time.Millisecond) // nothing left, not recorded
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if !port.closed {
+		t.Error("Close() should close the port")
+	}
+
+	if !strings.HasPrefix(out.String(), Header+"\n# port /dev/fake\n") {
+		t.Errorf("trace should start with the header and port, got:\n%s", out.String())
+	}
+	events, err := Parse(&out)
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	want := []Event{
+		{Dir: Control, Data: []byte(OpReset)},
+		{Dir: Control, Data: []byte("dtr=1")},
+		{Dir: Write, Data: []byte{0xC0, 0x00, 0x08, 0xC0}},
+		{Dir: Read, Data: []byte{0xC0, 0x01}},
+		{Dir: Read, Data: []byte{0x08, 0xC0}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i := range want {
+		if events[i].Dir != want[i].Dir || !bytes.Equal(events[i].Data, want[i].Data) {
+			t.Errorf("event %d = %v, want %v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	events := []Event{
+		{Dir: Control, Data: []byte(OpReset)},
+		{Dir: Write, Data: []byte{1, 2}},
+		{Dir: Read, Data: []byte{3, 4, 5}},
+		{Dir: Read, Data: []byte{6}},
+		{Dir: Write, Data: []byte{7}},
+		{Dir: Read, Data: []byte{8}},
+	}
+	r := NewReplay(events)
+	r.ResetToBootloader()
+
+	if _, err := r.Write([]byte{1, 2}); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	var got []byte
+	buf := make([]byte, 2)
+	for range 3 {
+		n, _ := r.ReadWithTimeout(buf, time.Millisecond)
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, []byte{3, 4, 5, 6}) {
+		t.Errorf("read %v, want [3 4 5 6]", got)
+	}
+	if n, _ := r.ReadWithTimeout(buf, time.Millisecond); n != 0 {
+		t.Errorf("read past the recorded response returned %d bytes", n)
+	}
+	if r.Done() {
+		t.Error("Done() should be false with a write left")
+	}
+
+	// The unread response to the second write is skipped by the next one
+	if _, err := r.Write([]byte{7}); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if !r.Done() {
+		t.Error("Done() should be true after the last write")
+	}
+	if _, err := r.Write([]byte{9}); err == nil {
+		t.Error("Write() past the end of the trace should fail")
+	}
+}
+
+// usbPort is a fakePort that knows its USB IDs.
+type usbPort struct{ fakePort }
+
+func (p *usbPort) USBID() (vid, pid uint16) { return 0x303A, 0x1001 }
+
+func TestRecorder_USBID(t *testing.T) {
+	var out bytes.Buffer
+	r := NewRecorder(&usbPort{}, &out)
+	r.HardReset()
+	r.Close()
+
+	events, err := Parse(&out)
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if len(events) != 2 || string(events[0].Data) != "usb=303A:1001" {
+		t.Fatalf("events = %v, want the USB IDs first", events)
+	}
+
+	replay := NewReplay(events)
+	if vid, pid := replay.USBID(); vid != 0x303A || pid != 0x1001 {
+		t.Errorf("USBID() = %04X:%04X, want 303A:1001", vid, pid)
+	}
+	if err := replay.HardReset(); err != nil {
+		t.Errorf("HardReset() error: %v", err)
+	}
+}
+
+func TestReplay_Mismatch(t *testing.T) {
+	r := NewReplay([]Event{{Dir: Write, Data: []byte{1, 2}}})
+	_, err := r.Write([]byte{1, 3})
+
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Write() error = %v, want MismatchError", err)
+	}
+	if mismatch.Event != 0 || !bytes.Equal(mismatch.Got, []byte{1, 3}) {
+		t.Errorf("MismatchError = %+v", mismatch)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	events := []Event{
+		{Time: 1 * time.Millisecond, Dir: Write, Data: []byte{0xC0, 0x00, 0x08, 0xC0}},
+		{Time: 2 * time.Millisecond, Dir: Read, Data: []byte("boot\r\n\xC0\x01")},
+		{Time: 3 * time.Millisecond, Dir: Control, Data: []byte(OpFlush)},
+		{Time: 4 * time.Millisecond, Dir: Read, Data: []byte{0xDB, 0xDC, 0xC0, 0xC0, 0x01, 0x02, 0xC0}},
+	}
+	frames := Frames(events)
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+
+	if frames[0].Dir != Write || !bytes.Equal(frames[0].Data, []byte{0x00, 0x08}) {
+		t.Errorf("frame 0 = %+v", frames[0])
+	}
+	// The response spans two reads and follows a boot message
+	if frames[1].Dir != Read || frames[1].Time != 4*time.Millisecond ||
+		!bytes.Equal(frames[1].Data, []byte{0x01, 0xC0}) || string(frames[1].Skipped) != "boot\r\n" {
+		t.Errorf("frame 1 = %+v", frames[1])
+	}
+	if !bytes.Equal(frames[2].Data, []byte{0x01, 0x02}) || len(frames[2].Skipped) != 0 {
+		t.Errorf("frame 2 = %+v", frames[2])
+	}
+}
+
+func TestRawFrames(t *testing.T) {
+	frames := RawFrames([]byte{0xC0, 0x00, 0x08, 0xC0, 0xC0, 0x01, 0x08, 0xC0, 0xC0, 0x01})
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	if frames[0].Dir != Write || frames[1].Dir != Read {
+		t.Errorf("directions = %c %c, want > <", frames[0].Dir, frames[1].Dir)
+	}
+}
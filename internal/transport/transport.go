@@ -0,0 +1,132 @@
+// Package transport defines the connection between the flasher and a
+// device, and opens connections by name.
+//
+// A plain name such as /dev/ttyACM0 or COM3 is a serial port. Other
+// transports are selected by URL scheme, e.g. serial:///dev/ttyACM0 or
+// emulator://, and are registered by the packages implementing them.
+package transport
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/serial"
+)
+
+// Transport is a byte stream to a device, with the modem control lines
+// used to reset it. *serial.Port implements it.
+type Transport interface {
+	// Write sends data to the device.
+	Write(data []byte) (int, error)
+	// ReadWithTimeout reads available data, waiting up to timeout for
+	// some to arrive. It returns 0 bytes if none did.
+	ReadWithTimeout(buf []byte, timeout time.Duration) (int, error)
+	// Flush discards data received but not yet read.
+	Flush() error
+
+	SetDTR(value bool) error
+	SetRTS(value bool) error
+	// ResetToBootloader resets the device into the ROM bootloader.
+	ResetToBootloader() error
+	// HardReset resets the device into its application.
+	HardReset() error
+	// SetBaudRate changes the line speed.
+	SetBaudRate(baudRate int) error
+
+	// PortName returns the name the transport was opened with.
+	PortName() string
+	Close() error
+}
+
+// USBDevice is implemented by transports that know the USB IDs of the
+// device, such as *serial.Port.
+type USBDevice interface {
+	USBID() (vid, pid uint16)
+}
+
+// USBID returns the USB vendor and product IDs of the device behind t, or
+// zeros if they are unknown.
+func USBID(t Transport) (vid, pid uint16) {
+	if d, ok := t.(USBDevice); ok {
+		return d.USBID()
+	}
+	return 0, 0
+}
+
+// OpenFunc opens a transport for a URL of its scheme.
+type OpenFunc func(u *url.URL, baudRate int) (Transport, error)
+
+var (
+	mu      sync.Mutex
+	schemes = map[string]OpenFunc{
+		"serial": openSerial,
+	}
+)
+
+// Register makes a transport available under a URL scheme.
+func Register(scheme string, open OpenFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	schemes[scheme] = open
+}
+
+// Schemes returns the registered URL schemes.
+func Schemes() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(schemes))
+	for name := range schemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the transport named by name: a serial port path, or a URL
+// whose scheme selects the transport.
+func Open(name string, baudRate int) (Transport, error) {
+	if !strings.Contains(name, "://") {
+		return openSerialPath(name, baudRate)
+	}
+
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", name, err)
+	}
+	mu.Lock()
+	open, ok := schemes[u.Scheme]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown port scheme %q (use %s)", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	return open(u, baudRate)
+}
+
+// Path returns the location in a transport URL: the host and path, so
+// that both serial:///dev/ttyACM0 and replay://session.trace work.
+func Path(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+func openSerial(u *url.URL, baudRate int) (Transport, error) {
+	path := Path(u)
+	if path == "" {
+		return nil, fmt.Errorf("serial port URL %q has no path", u.String())
+	}
+	return openSerialPath(path, baudRate)
+}
+
+func openSerialPath(path string, baudRate int) (Transport, error) {
+	port, err := serial.Open(path, baudRate)
+	if err != nil {
+		return nil, err
+	}
+	return port, nil
+}
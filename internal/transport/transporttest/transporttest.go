@@ -0,0 +1,31 @@
+// Package transporttest provides a transport stub for tests.
+package transporttest
+
+import (
+	"time"
+
+	"github.com/bigbag/papyrix-flasher/internal/transport"
+)
+
+var _ transport.Transport = Port{}
+
+// Port is a transport that does nothing: writes are discarded, reads time
+// out and every line operation succeeds. Test fakes embed it and override
+// the methods they exercise.
+type Port struct{}
+
+func (Port) Write(data []byte) (int, error) { return len(data), nil }
+
+func (Port) ReadWithTimeout(buf []byte, timeout time.Duration) (int, error) {
+	time.Sleep(timeout)
+	return 0, nil
+}
+
+func (Port) Flush() error                   { return nil }
+func (Port) SetDTR(value bool) error        { return nil }
+func (Port) SetRTS(value bool) error        { return nil }
+func (Port) ResetToBootloader() error       { return nil }
+func (Port) HardReset() error               { return nil }
+func (Port) SetBaudRate(baudRate int) error { return nil }
+func (Port) PortName() string               { return "test" }
+func (Port) Close() error                   { return nil }
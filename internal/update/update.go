@@ -0,0 +1,256 @@
+package update
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the GitHub REST API.
+const DefaultBaseURL = "https://api.github.com"
+
+// Release channels
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+// Repos maps firmware names to their GitHub repositories.
+var Repos = map[string]string{
+	"papyrix":    "bigbag/papyrix-reader",
+	"crosspoint": "daveallie/crosspoint-reader",
+}
+
+// maxAssetSize limits the size of a downloaded asset.
+const maxAssetSize = 64 * 1024 * 1024
+
+// Release is a release as returned by the GitHub Releases API.
+type Release struct {
+	TagName    string  `json:"tag_name"`
+	Name       string  `json:"name"`
+	Draft      bool    `json:"draft"`
+	Prerelease bool    `json:"prerelease"`
+	Assets     []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release.
+type Asset struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	DownloadURL string `json:"browser_download_url"`
+	// Digest is the published checksum, e.g. "sha256:<hex>".
+	Digest string `json:"digest"`
+}
+
+// Client queries a GitHub-Releases-compatible API and caches downloads.
+type Client struct {
+	BaseURL  string
+	CacheDir string
+	HTTP     *http.Client
+}
+
+// NewClient creates a client for the given API base URL that caches
+// downloads in cacheDir.
+func NewClient(baseURL, cacheDir string) *Client {
+	return &Client{
+		BaseURL:  strings.TrimRight(baseURL, "/"),
+		CacheDir: cacheDir,
+		HTTP:     &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// DefaultCacheDir returns the directory used to cache downloaded firmware.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "papyrix-flasher", "firmware"), nil
+}
+
+// Latest returns the newest release of repo on the given channel. The
+// stable channel skips pre-releases; beta includes them.
+func (c *Client) Latest(repo, channel string) (*Release, error) {
+	if channel != ChannelStable && channel != ChannelBeta {
+		return nil, fmt.Errorf("unknown channel %q (use %s or %s)", channel, ChannelStable, ChannelBeta)
+	}
+
+	body, err := c.get(fmt.Sprintf("%s/repos/%s/releases", c.BaseURL, repo), 4*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []Release
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return nil, fmt.Errorf("invalid releases response: %w", err)
+	}
+
+	for i := range releases {
+		r := &releases[i]
+		if r.Draft || (r.Prerelease && channel == ChannelStable) {
+			continue
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("no %s release found for %s", channel, repo)
+}
+
+// FirmwareAsset picks the asset to flash: a firmware .bin (or .bin.gz),
+// otherwise a release bundle.
+func (r *Release) FirmwareAsset() (*Asset, error) {
+	rank := func(name string) int {
+		lower := strings.ToLower(name)
+		switch {
+		case strings.Contains(lower, "bootloader"), strings.Contains(lower, "partition"):
+			return 0
+		case strings.HasSuffix(lower, ".bin"):
+			return 4
+		case strings.HasSuffix(lower, ".bin.gz"):
+			return 3
+		case strings.HasSuffix(lower, ".zip"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+			return 2
+		default:
+			return 0
+		}
+	}
+
+	var best *Asset
+	for i := range r.Assets {
+		if rank(r.Assets[i].Name) > 0 && (best == nil || rank(r.Assets[i].Name) > rank(best.Name)) {
+			best = &r.Assets[i]
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("release %s has no firmware asset", r.TagName)
+	}
+	return best, nil
+}
+
+// Checksum returns the published SHA-256 of an asset, taken from the
+// asset digest or from a <name>.sha256 or SHA256SUMS-style release asset.
+func (c *Client) Checksum(r *Release, asset *Asset) (string, error) {
+	if sum, ok := strings.CutPrefix(asset.Digest, "sha256:"); ok && sum != "" {
+		return strings.ToLower(sum), nil
+	}
+
+	for _, a := range r.Assets {
+		lower := strings.ToLower(a.Name)
+		single := lower == strings.ToLower(asset.Name)+".sha256"
+		list := strings.Contains(lower, "sha256sum") || lower == "checksums.txt"
+		if !single && !list {
+			continue
+		}
+
+		body, err := c.get(a.DownloadURL, 1024*1024)
+		if err != nil {
+			return "", err
+		}
+		if sum, ok := findChecksum(body, asset.Name, single); ok {
+			return sum, nil
+		}
+	}
+
+	return "", fmt.Errorf("release %s publishes no SHA-256 for %s", r.TagName, asset.Name)
+}
+
+// findChecksum finds the hash for name in sha256sum output. A single-file
+// checksum may list just the hash.
+func findChecksum(body []byte, name string, single bool) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+			continue
+		}
+		if (len(fields) == 1 && single) || (len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == name) {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// Download fetches an asset into the cache, verifying it against sha256sum.
+// A cached copy with a matching checksum is reused.
+func (c *Client) Download(repo string, r *Release, asset *Asset, sha256sum string) (path string, cached bool, err error) {
+	dir := filepath.Join(c.CacheDir, strings.ReplaceAll(repo, "/", "_"), filepath.Base(r.TagName))
+	path = filepath.Join(dir, filepath.Base(asset.Name))
+
+	if data, err := os.ReadFile(path); err == nil && hashHex(data) == sha256sum {
+		return path, true, nil
+	}
+
+	data, err := c.get(asset.DownloadURL, maxAssetSize)
+	if err != nil {
+		return "", false, err
+	}
+	if got := hashHex(data); got != sha256sum {
+		return "", false, &ChecksumError{Name: asset.Name, Expected: sha256sum, Actual: got}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", false, err
+	}
+	return path, false, nil
+}
+
+// ChecksumError reports a downloaded asset that does not match its
+// published SHA-256.
+type ChecksumError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: SHA-256 mismatch (expected %s, got %s)", e.Name, e.Expected, e.Actual)
+}
+
+func (c *Client) get(url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json, application/octet-stream;q=0.9")
+	req.Header.Set("User-Agent", "papyrix-flasher")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errors.New("response too large")
+	}
+	return body, nil
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
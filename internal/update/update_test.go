@@ -0,0 +1,173 @@
+package update
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+var (
+	stableFirmware = []byte("stable firmware image")
+	betaFirmware   = []byte("beta firmware image")
+)
+
+func sum(data []byte) string {
+	s := sha256.Sum256(data)
+	return hex.EncodeToString(s[:])
+}
+
+// mockServer serves a GitHub-style releases list for bigbag/papyrix-reader.
+func mockServer(t *testing.T, downloads *int) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+
+	mux.HandleFunc("/repos/bigbag/papyrix-reader/releases", func(w http.ResponseWriter, r *http.Request) {
+		releases := []Release{
+			{TagName: "v2.0.0-beta.1", Prerelease: true, Assets: []Asset{
+				{Name: "papyrix-firmware.bin", DownloadURL: srv.URL + "/dl/beta.bin", Digest: "sha256:" + sum(betaFirmware)},
+			}},
+			{TagName: "v1.9.0-draft", Draft: true},
+			{TagName: "v1.8.0", Assets: []Asset{
+				{Name: "bootloader.bin", DownloadURL: srv.URL + "/dl/bootloader.bin"},
+				{Name: "papyrix-firmware.bin", DownloadURL: srv.URL + "/dl/stable.bin"},
+				{Name: "SHA256SUMS", DownloadURL: srv.URL + "/dl/SHA256SUMS"},
+			}},
+		}
+		json.NewEncoder(w).Encode(releases)
+	})
+	mux.HandleFunc("/dl/stable.bin", func(w http.ResponseWriter, r *http.Request) {
+		*downloads++
+		w.Write(stableFirmware)
+	})
+	mux.HandleFunc("/dl/beta.bin", func(w http.ResponseWriter, r *http.Request) {
+		*downloads++
+		w.Write(betaFirmware)
+	})
+	mux.HandleFunc("/dl/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sum([]byte("bootloader")) + "  bootloader.bin\n" + sum(stableFirmware) + " *papyrix-firmware.bin\n"))
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLatest_Channels(t *testing.T) {
+	var downloads int
+	srv := mockServer(t, &downloads)
+	c := NewClient(srv.URL, t.TempDir())
+
+	stable, err := c.Latest("bigbag/papyrix-reader", ChannelStable)
+	if err != nil {
+		t.Fatalf("Latest(stable) error = %v", err)
+	}
+	if stable.TagName != "v1.8.0" {
+		t.Errorf("Latest(stable) = %s, want v1.8.0", stable.TagName)
+	}
+
+	beta, err := c.Latest("bigbag/papyrix-reader", ChannelBeta)
+	if err != nil {
+		t.Fatalf("Latest(beta) error = %v", err)
+	}
+	if beta.TagName != "v2.0.0-beta.1" {
+		t.Errorf("Latest(beta) = %s, want v2.0.0-beta.1", beta.TagName)
+	}
+
+	if _, err := c.Latest("bigbag/papyrix-reader", "nightly"); err == nil {
+		t.Error("Latest(nightly) expected error")
+	}
+	if _, err := c.Latest("nobody/nothing", ChannelStable); err == nil {
+		t.Error("Latest() of unknown repo expected error")
+	}
+}
+
+func TestDownload_VerifiesAndCaches(t *testing.T) {
+	var downloads int
+	srv := mockServer(t, &downloads)
+	c := NewClient(srv.URL, t.TempDir())
+
+	for _, channel := range []string{ChannelStable, ChannelBeta} {
+		release, err := c.Latest("bigbag/papyrix-reader", channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset, err := release.FirmwareAsset()
+		if err != nil {
+			t.Fatalf("FirmwareAsset() error = %v", err)
+		}
+		if asset.Name != "papyrix-firmware.bin" {
+			t.Errorf("FirmwareAsset() = %s", asset.Name)
+		}
+
+		checksum, err := c.Checksum(release, asset)
+		if err != nil {
+			t.Fatalf("%s: Checksum() error = %v", channel, err)
+		}
+
+		path, cached, err := c.Download("bigbag/papyrix-reader", release, asset, checksum)
+		if err != nil {
+			t.Fatalf("%s: Download() error = %v", channel, err)
+		}
+		if cached {
+			t.Errorf("%s: first Download() reported a cache hit", channel)
+		}
+		data, _ := os.ReadFile(path)
+		if sum(data) != checksum {
+			t.Errorf("%s: downloaded file does not match checksum", channel)
+		}
+
+		before := downloads
+		if _, cached, err := c.Download("bigbag/papyrix-reader", release, asset, checksum); err != nil || !cached {
+			t.Errorf("%s: second Download() cached = %v, err = %v", channel, cached, err)
+		}
+		if downloads != before {
+			t.Errorf("%s: cached download hit the server", channel)
+		}
+	}
+}
+
+func TestDownload_ChecksumMismatch(t *testing.T) {
+	var downloads int
+	srv := mockServer(t, &downloads)
+	c := NewClient(srv.URL, t.TempDir())
+
+	release, _ := c.Latest("bigbag/papyrix-reader", ChannelStable)
+	asset, _ := release.FirmwareAsset()
+
+	_, _, err := c.Download("bigbag/papyrix-reader", release, asset, sum([]byte("something else")))
+	var mismatch *ChecksumError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Download() error = %v, want ChecksumError", err)
+	}
+}
+
+func TestChecksum_Missing(t *testing.T) {
+	c := NewClient("http://unused", t.TempDir())
+	release := &Release{TagName: "v1", Assets: []Asset{{Name: "firmware.bin"}}}
+	if _, err := c.Checksum(release, &release.Assets[0]); err == nil {
+		t.Error("Checksum() without published hash expected error")
+	}
+}
+
+func TestFirmwareAsset_Preference(t *testing.T) {
+	release := &Release{Assets: []Asset{
+		{Name: "papyrix-1.0.zip"},
+		{Name: "partitions.bin"},
+		{Name: "firmware.bin.gz"},
+		{Name: "notes.txt"},
+	}}
+	asset, err := release.FirmwareAsset()
+	if err != nil || asset.Name != "firmware.bin.gz" {
+		t.Errorf("FirmwareAsset() = %v, %v; want firmware.bin.gz", asset, err)
+	}
+
+	if _, err := (&Release{Assets: []Asset{{Name: "notes.txt"}}}).FirmwareAsset(); err == nil {
+		t.Error("FirmwareAsset() without firmware expected error")
+	}
+}